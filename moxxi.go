@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 
 	"github.com/JackKnifed/moxxi/moxxiconf"
@@ -13,6 +20,11 @@ import (
 	"github.com/natefinch/lumberjack"
 )
 
+// the templates used by any handler that does not name its own
+//
+//go:embed proxy.template response.template response.flat.template simple_form.html
+var bundledTemplates embed.FS
+
 // BroadCastSignal() a single signal across all channels ain an array
 func BroadcastSignal(in chan os.Signal, out []chan os.Signal, done chan struct{}) {
 	var val os.Signal
@@ -39,10 +51,35 @@ func RotateLog(l *lumberjack.Logger, c chan os.Signal, done chan struct{}) {
 	}
 }
 
+// AccessLogFormatter() writes the combined log format followed by the request ID
+func AccessLogFormatter(w io.Writer, p gorillaHandlers.LogFormatterParams) {
+	host, _, err := net.SplitHostPort(p.Request.RemoteAddr)
+	if err != nil {
+		host = p.Request.RemoteAddr
+	}
+
+	user := "-"
+	if p.URL.User != nil && p.URL.User.Username() != "" {
+		user = p.URL.User.Username()
+	}
+
+	fmt.Fprintf(w, "%s - %s [%s] %q %d %d %q %q %q\n",
+		host,
+		user,
+		p.TimeStamp.Format("02/Jan/2006:15:04:05 -0700"),
+		p.Request.Method+" "+p.URL.RequestURI()+" "+p.Request.Proto,
+		p.StatusCode,
+		p.Size,
+		p.Request.Referer(),
+		p.Request.UserAgent(),
+		p.Request.Header.Get(moxxiConf.RequestIDHeader))
+}
+
 func main() {
 	var err error
 
-	listens, accessLogFile, errorLogFile, handlers, err := moxxiConf.LoadConfig()
+	moxxiConf.DefaultTemplates = bundledTemplates
+	config, err := moxxiConf.LoadConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -56,9 +93,9 @@ func main() {
 	sigArr := []chan os.Signal{}
 
 	var errorLog, accessLog io.Writer
-	if errorLogFile != "" {
+	if config.ErrorLog != "" {
 		intLogger := &lumberjack.Logger{
-			Filename:   errorLogFile,
+			Filename:   config.ErrorLog,
 			MaxBackups: 5,
 		}
 		myChan := make(chan os.Signal)
@@ -70,9 +107,9 @@ func main() {
 		errorLog = os.Stderr
 	}
 
-	if accessLogFile != "" {
+	if config.AccessLog != "" {
 		intLogger := &lumberjack.Logger{
-			Filename:   accessLogFile,
+			Filename:   config.AccessLog,
 			MaxBackups: 5,
 		}
 		myChan := make(chan os.Signal)
@@ -81,29 +118,84 @@ func main() {
 		sigArr = append(sigArr, myChan)
 		accessLog = intLogger
 	} else {
-		errorLog = os.Stdout
+		accessLog = os.Stdout
 	}
 
 	go BroadcastSignal(sigUsr, sigArr, done)
 
-	logger := log.New(errorLog, "", log.LstdFlags|log.LUTC|log.Lshortfile)
-	mux := moxxiConf.CreateMux(handlers, logger)
+	logger, err := moxxiConf.NewLogger(errorLog, config.LogFormat, config.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	background, stopBackground := context.WithCancel(context.Background())
+	mux := moxxiConf.CreateMux(background, config.Handlers, logger)
+	handler := moxxiConf.RequestIDHandler(
+		gorillaHandlers.CustomLoggingHandler(accessLog, mux, AccessLogFormatter))
+
+	sigTerm := make(chan os.Signal, 1)
+	signal.Notify(sigTerm, syscall.SIGTERM, syscall.SIGINT)
+
+	errChan := make(chan error, len(config.Listens))
+	var servers []*http.Server
+
+	for _, singleListener := range config.Listens {
+		srv := &http.Server{
+			Addr:         singleListener.Addr,
+			Handler:      handler,
+			ReadTimeout:  singleListener.ReadTimeout,
+			WriteTimeout: singleListener.WriteTimeout,
+			IdleTimeout:  singleListener.IdleTimeout,
+		}
+		servers = append(servers, srv)
+
+		go func(srv *http.Server, l moxxiConf.ListenConfig) {
+			ln, listenErr := l.Listen()
+			if listenErr != nil {
+				errChan <- listenErr
+				return
+			}
 
-	var errChan chan error
+			var err error
+			logger.Info("started server", "address", l.Addr)
+			if l.CertFile != "" {
+				err = srv.ServeTLS(ln, l.CertFile, l.KeyFile)
+			} else {
+				err = srv.Serve(ln)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				errChan <- err
+			}
+		}(srv, singleListener)
+	}
 
-	for _, singleListener := range listens {
-		srv := http.Server{
-			Addr:         singleListener,
-			Handler:      gorillaHandlers.LoggingHandler(accessLog, mux),
-			ReadTimeout:  moxxiConf.ConnTimeout,
-			WriteTimeout: moxxiConf.ConnTimeout,
-		}
+	select {
+	case err = <-errChan:
+		logger.Error("server failed", "error", err)
+	case sig := <-sigTerm:
+		logger.Info("draining connections", "signal", sig.String())
+	}
+
+	stopBackground()
+	ShutdownServers(servers, config.Listens, logger)
 
-		go func() {
-			logger.Printf("started server on %s\n", singleListener)
-			errChan <- srv.ListenAndServe()
-		}()
+	if err != nil {
+		os.Exit(1)
 	}
+}
 
-	log.Fatal(<-errChan)
+// ShutdownServers() gracefully stops every server, giving each its own timeout
+func ShutdownServers(servers []*http.Server, listens []moxxiConf.ListenConfig, logger *slog.Logger) {
+	var wg sync.WaitGroup
+	for id, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server, l moxxiConf.ListenConfig) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), l.ShutdownTimeout)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.Error("failed to shut down server", "address", l.Addr, "error", err)
+			}
+		}(srv, listens[id])
+	}
+	wg.Wait()
 }
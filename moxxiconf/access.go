@@ -0,0 +1,173 @@
+package moxxiConf
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/dchest/uniuri"
+)
+
+// AuthUser is the user name given with generated credentials
+const AuthUser = "moxxi"
+
+// AuthPasswordLen is the length of generated passwords
+const AuthPasswordLen = 24
+
+// AuthSaltLen is the length of the salt used to hash passwords
+const AuthSaltLen = 8
+
+// AuthFileExt is the extension of the htpasswd file written beside the config
+const AuthFileExt = "htpasswd"
+
+// cryptChars are the characters crypt(3) encodes hashes and salts with
+var cryptChars = []byte("./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
+
+// checkAccess validates the access protection asked for in proxy, filling it
+// into conf - each network allowed can be a CIDR or a single address
+func checkAccess(proxy siteParams, conf *siteParams) Err {
+	for _, each := range proxy.AllowFrom {
+		if each == "" {
+			continue
+		}
+		network := each
+		if ip := net.ParseIP(each); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			network = fmt.Sprintf("%s/%d", ip, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return &NewErr{Code: ErrBadAccess, value: each, deepErr: fmt.Errorf("not an address or CIDR")}
+		}
+		if !inArr(conf.AllowFrom, ipNet.String()) {
+			conf.AllowFrom = append(conf.AllowFrom, ipNet.String())
+		}
+	}
+	conf.BasicAuth = proxy.BasicAuth
+	return nil
+}
+
+// newCredentials fills in a fresh user, password, and password hash
+func newCredentials(site *siteParams) {
+	site.AuthUser = AuthUser
+	site.AuthPassword = uniuri.NewLen(AuthPasswordLen)
+	site.AuthHash = md5Crypt(site.AuthPassword, uniuri.NewLenChars(AuthSaltLen, cryptChars))
+}
+
+// basicAuthUnsupported names the first output that cannot check generated
+// passwords, like the bundled Caddy template - found by rendering a sample
+// proxy with and without them, so that proxies asking for BasicAuth are turned
+// away before anything is written
+func basicAuthUnsupported(outputs []confOutput) string {
+	sample := siteParams{
+		ExtHost:  "sample.moxxi.invalid",
+		IntHost:  "sample.invalid",
+		IntIP:    "127.0.0.1",
+		IntPort:  80,
+		AuthUser: AuthUser,
+	}
+	protected := sample
+	protected.BasicAuth = true
+	protected.AuthHash = md5Crypt("sample", "sample")
+	protected.AuthFile = "sample.moxxi.invalid" + DomainSep + AuthFileExt
+
+	for _, out := range outputs {
+		if out.confTempl == nil {
+			continue
+		}
+		if out.confTempl.Execute(ioutil.Discard, protected) != nil &&
+			out.confTempl.Execute(ioutil.Discard, sample) == nil {
+			if out.name != "" {
+				return out.name
+			}
+			return out.confFile
+		}
+	}
+	return ""
+}
+
+// authFileName is where the htpasswd file for the ExtHost goes - beside the
+// first config written for it, so both go together
+func authFileName(outputs []confOutput, extHost string) string {
+	out := confOutput{confPath: outputs[0].confPath, confExt: AuthFileExt}
+	fileName := out.fileName(extHost)
+	if abs, err := filepath.Abs(fileName); err == nil {
+		return abs
+	}
+	return fileName
+}
+
+// md5Crypt hashes a password the way crypt(3) does for $1$ - nginx, Apache
+// and HAProxy can all check it, and a generated password is long enough that
+// the weakness of MD5 does not matter
+func md5Crypt(password, salt string) string {
+	const magic = "$1$"
+	pw, s := []byte(password), []byte(salt)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write(s)
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic))
+	d.Write(s)
+	for i := len(pw); i > 0; i -= md5.Size {
+		if i > md5.Size {
+			d.Write(altSum)
+		} else {
+			d.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	sum := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write(s)
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 == 1 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+		sum = round.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(magic + salt + "$")
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(cryptChars[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(sum[group[0]])<<16|uint(sum[group[1]])<<8|uint(sum[group[2]]), 4)
+	}
+	encode(uint(sum[11]), 2)
+	return out.String()
+}
@@ -0,0 +1,148 @@
+package moxxiConf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMD5Crypt(t *testing.T) {
+	// from openssl passwd -1 -salt
+	var testData = []struct {
+		password string
+		salt     string
+		out      string
+	}{
+		{"correct horse battery staple", "abcdefgh", "$1$abcdefgh$4/U5.w6NPtLkJ2WyrTwm91"},
+		{"aB3dEfGhIjKlMnOpQrStUvWx1234567", "Ab.9/xYz", "$1$Ab.9/xYz$nVrh5Tv67J/SZjOS/vvxo0"},
+		{"p", "s", "$1$s$e3cU4diUKuLjXnDANdfhU0"},
+	}
+	for id, test := range testData {
+		assert.Equal(t, test.out, md5Crypt(test.password, test.salt), "test %d - wrong hash", id)
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	var testData = []struct {
+		in      siteParams
+		out     siteParams
+		errCode ErrCode
+	}{
+		{},
+		{
+			in:  siteParams{BasicAuth: true, AuthUser: "admin", AuthPassword: "mine"},
+			out: siteParams{BasicAuth: true},
+		}, {
+			in:  siteParams{AllowFrom: []string{"10.1.2.3/8", "", "192.0.2.7", "2001:db8::1", "10.0.0.0/8"}},
+			out: siteParams{AllowFrom: []string{"10.0.0.0/8", "192.0.2.7/32", "2001:db8::1/128"}},
+		}, {
+			in:      siteParams{AllowFrom: []string{"10.0.0.0/33"}},
+			errCode: ErrBadAccess,
+		}, {
+			in:      siteParams{AllowFrom: []string{"10.0.0.0/8; allow all"}},
+			errCode: ErrBadAccess,
+		},
+	}
+
+	for id, test := range testData {
+		var out siteParams
+		locErr := checkAccess(test.in, &out)
+		if test.errCode != 0 {
+			assert.ErrorIs(t, locErr, test.errCode, "test %d - wrong error", id)
+			continue
+		}
+		assert.Nil(t, locErr, "test %d - unexpected error - %v", id, locErr)
+		assert.Equal(t, test.out, out, "test %d - wrong access", id)
+	}
+}
+
+func TestConfWrite_basicAuth(t *testing.T) {
+	testConfig := HandlerConfig{
+		baseURL:      "proxy.com",
+		confPath:     t.TempDir(),
+		confExt:      "conf",
+		confTempl:    template.Must(template.New("testing").Parse("{{ .AuthFile }}")),
+		subdomainLen: 8,
+	}
+
+	out, locErr := confWrite(testConfig)(siteParams{IntHost: "domain.com", BasicAuth: true})
+	if !assert.Nil(t, locErr, "should write with credentials - %v", locErr) {
+		return
+	}
+	assert.Equal(t, AuthUser, out.AuthUser, "wrong user")
+	assert.Len(t, out.AuthPassword, AuthPasswordLen, "wrong password length")
+	assert.Equal(t, filepath.Join(testConfig.confPath, out.ExtHost+DomainSep+AuthFileExt), out.AuthFile,
+		"the htpasswd file should be beside the config")
+
+	contents, _ := ioutil.ReadFile(testConfig.confOutputs()[0].fileName(out.ExtHost))
+	assert.Equal(t, out.AuthFile, string(contents), "the config should use the htpasswd file")
+	htpasswd, err := ioutil.ReadFile(out.AuthFile)
+	if assert.NoError(t, err, "the htpasswd file should be written") {
+		parts := strings.Split(strings.TrimSpace(string(htpasswd)), "$")
+		if assert.Len(t, parts, 4, "should be user:$1$salt$hash - %s", htpasswd) {
+			assert.Equal(t, AuthUser+":"+md5Crypt(out.AuthPassword, parts[2])+"\n", string(htpasswd),
+				"the hash should be of the password")
+		}
+	}
+
+	out, locErr = confWrite(testConfig)(siteParams{IntHost: "domain.com"})
+	assert.Nil(t, locErr, "should write without credentials - %v", locErr)
+	assert.Empty(t, out.AuthPassword, "should not make a password")
+	_, err = os.Stat(filepath.Join(testConfig.confPath, out.ExtHost+DomainSep+AuthFileExt))
+	assert.True(t, os.IsNotExist(err), "should not write an htpasswd file")
+
+	// a config that fails to render takes its htpasswd file with it
+	testConfig.confPath = t.TempDir()
+	testConfig.confTempl = template.Must(template.New("testing").Funcs(templateFuncs).Parse(
+		`{{ if .AuthHash }}{{ fail "no passwords here" }}{{ end }}`))
+	_, locErr = confWrite(testConfig)(siteParams{IntHost: "domain.com", BasicAuth: true})
+	assert.ErrorIs(t, locErr, ErrRenderTemplate, "the template should fail")
+	files, _ := ioutil.ReadDir(testConfig.confPath)
+	assert.Empty(t, files, "nothing should be left behind")
+}
+
+func TestJobStatus_password(t *testing.T) {
+	store := newJobStore(0)
+	j, _ := store.add(1)
+	j.record(0, siteParams{ExtHost: "first", AuthUser: AuthUser, AuthPassword: "secret"})
+
+	assert.Equal(t, "secret", j.status().Results[0].AuthPassword, "the password should be shown once")
+	assert.Empty(t, j.status().Results[0].AuthPassword, "the password should not be shown again")
+	assert.Equal(t, AuthUser, j.status().Results[0].AuthUser, "the user should still be shown")
+}
+
+func TestBasicAuthUnsupported(t *testing.T) {
+	var outputs []confOutput
+	for _, name := range []string{"nginx", "apache", "haproxy", "caddy"} {
+		file := "proxy." + name + ".template"
+		if name == "nginx" {
+			file = "proxy.template"
+		}
+		outputs = append(outputs, confOutput{
+			name:      name,
+			confPath:  t.TempDir(),
+			confExt:   "conf",
+			confTempl: template.Must(parseTemplate(filepath.Join("..", file))),
+		})
+	}
+	assert.Equal(t, "", basicAuthUnsupported(outputs[:3]), "nginx, Apache and HAProxy check passwords")
+	assert.Equal(t, "caddy", basicAuthUnsupported(outputs), "Caddy cannot check the passwords")
+
+	testConfig := HandlerConfig{
+		baseURL:      "proxy.com",
+		subdomainLen: 8,
+		outputs:      outputs,
+		noBasicAuth:  basicAuthUnsupported(outputs),
+	}
+	_, locErr := confCheck(siteParams{IntHost: "domain.com", IntIP: "10.0.0.1", BasicAuth: true}, testConfig)
+	assert.ErrorIs(t, locErr, ErrBadAccess, "BasicAuth should be turned away up front")
+	out, locErr := confWrite(testConfig)(siteParams{IntHost: "domain.com", IntIP: "10.0.0.1",
+		AllowFrom: []string{"10.0.0.0/8"}})
+	assert.Nil(t, locErr, "other protection should still work - %v", locErr)
+	assert.NotEmpty(t, out.ExtHost, "the proxy should be written")
+}
@@ -0,0 +1,445 @@
+package moxxiConf
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ACMEPollInterval is how long to wait between checks on a pending order
+const ACMEPollInterval = 2 * time.Second
+
+// ACMEPollTimeout is how long an order can stay pending before giving up
+const ACMEPollTimeout = 2 * time.Minute
+
+// the challenge types moxxi can solve
+const (
+	ChallengeHTTP = "http-01"
+	ChallengeDNS  = "dns-01"
+)
+
+// acmeDirectory - where the ACME server takes each kind of request
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// acmeProblem - an error sent back by the ACME server
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("%s - %s", p.Type, p.Detail)
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	Status         string           `json:"status"`
+	Identifiers    []acmeIdentifier `json:"identifiers"`
+	Authorizations []string         `json:"authorizations"`
+	Finalize       string           `json:"finalize"`
+	Certificate    string           `json:"certificate,omitempty"`
+	Error          *acmeProblem     `json:"error,omitempty"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error,omitempty"`
+}
+
+type acmeAuthorization struct {
+	Status     string          `json:"status"`
+	Identifier acmeIdentifier  `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+	Wildcard   bool            `json:"wildcard,omitempty"`
+}
+
+// challengeSolver - publishes the proof for a challenge, and takes it down after
+type challengeSolver interface {
+	present(domain, token, keyAuth string) error
+	cleanUp(domain, token, keyAuth string) error
+}
+
+// acmeClient - gets certificates from an ACME (RFC 8555) server for one account
+type acmeClient struct {
+	sync.Mutex
+	directoryURL string
+	email        string
+	key          *ecdsa.PrivateKey
+	client       *http.Client
+	pollInterval time.Duration
+	pollTimeout  time.Duration
+
+	dir   acmeDirectory
+	kid   string
+	nonce string
+}
+
+// loadAccountKey reads the ACME account key, making a new one if there is none
+func loadAccountKey(file string) (*ecdsa.PrivateKey, error) {
+	raw, err := ioutil.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := encodeKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, replaceFile(file, keyPEM, 0600)
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", file)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// encodeKey gives the PEM for a private key
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// b64 is the unpadded URL safe base64 used throughout ACME
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// jwk is the public half of the account key as a JSON Web Key
+func (c *acmeClient) jwk() (map[string]string, error) {
+	pub, err := c.key.PublicKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	// uncompressed point - 0x04, then X, then Y
+	size := (len(pub) - 1) / 2
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   b64(pub[1 : 1+size]),
+		"y":   b64(pub[1+size:]),
+	}, nil
+}
+
+// thumbprint identifies the account key in key authorizations
+func (c *acmeClient) thumbprint() (string, error) {
+	jwk, err := c.jwk()
+	if err != nil {
+		return "", err
+	}
+	// encoding/json sorts map keys, which is the order the thumbprint needs
+	raw, err := json.Marshal(jwk)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return b64(sum[:]), nil
+}
+
+// discover fetches the directory of the ACME server, once
+// must be called with the lock held
+func (c *acmeClient) discover() error {
+	if c.dir.NewNonce != "" {
+		return nil
+	}
+	resp, err := c.client.Get(c.directoryURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("directory %s gave status %d", c.directoryURL, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(&c.dir)
+}
+
+// getNonce gives a nonce to sign the next request with
+// must be called with the lock held
+func (c *acmeClient) getNonce() (string, error) {
+	if nonce := c.nonce; nonce != "" {
+		c.nonce = ""
+		return nonce, nil
+	}
+	resp, err := c.client.Head(c.dir.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		return nonce, nil
+	}
+	return "", fmt.Errorf("no nonce from %s", c.dir.NewNonce)
+}
+
+// sign wraps the payload in a JWS for url - signed with the account key, and
+// identified by the account URL once there is one
+func (c *acmeClient) sign(url, nonce string, payload []byte) ([]byte, error) {
+	protected := map[string]interface{}{
+		"alg":   "ES256",
+		"nonce": nonce,
+		"url":   url,
+	}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		jwk, err := c.jwk()
+		if err != nil {
+			return nil, err
+		}
+		protected["jwk"] = jwk
+	}
+	rawProtected, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := b64(rawProtected) + "." + b64(payload)
+	hash := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	// ES256 signatures are the two halves back to back, not ASN.1
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return json.Marshal(map[string]string{
+		"protected": b64(rawProtected),
+		"payload":   b64(payload),
+		"signature": b64(sig),
+	})
+}
+
+// post sends a signed request, decoding the JSON response into out if given
+// a nil payload is a POST-as-GET. A rejected nonce is retried once.
+// must be called with the lock held
+func (c *acmeClient) post(url string, payload, out interface{}) (*http.Response, []byte, error) {
+	var rawPayload []byte
+	if payload != nil {
+		var err error
+		if rawPayload, err = json.Marshal(payload); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		nonce, err := c.getNonce()
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := c.sign(url, nonce, rawPayload)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := c.client.Post(url, "application/jose+json", bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		raw, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return resp, nil, err
+		}
+		c.nonce = resp.Header.Get("Replay-Nonce")
+
+		if resp.StatusCode >= http.StatusBadRequest {
+			problem := &acmeProblem{Status: resp.StatusCode}
+			json.Unmarshal(raw, problem)
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt < 1 {
+				continue
+			}
+			return resp, raw, problem
+		}
+		if out != nil {
+			if err = json.Unmarshal(raw, out); err != nil {
+				return resp, raw, fmt.Errorf("bad response from %s - %v", url, err)
+			}
+		}
+		return resp, raw, nil
+	}
+}
+
+// register makes sure the account exists, and learns its URL
+// must be called with the lock held
+func (c *acmeClient) register() error {
+	if c.kid != "" {
+		return nil
+	}
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if c.email != "" {
+		account["contact"] = []string{"mailto:" + c.email}
+	}
+	resp, _, err := c.post(c.dir.NewAccount, account, nil)
+	if err != nil {
+		return fmt.Errorf("registering the account - %v", err)
+	}
+	if c.kid = resp.Header.Get("Location"); c.kid == "" {
+		return fmt.Errorf("no account URL given")
+	}
+	return nil
+}
+
+// obtain gets a new certificate for the domains - the first is the common
+// name - solving every challenge of the given type along the way. The
+// certificate chain and its private key come back as PEM.
+func (c *acmeClient) obtain(domains []string, challengeType string,
+	solver challengeSolver) (certPEM, keyPEM []byte, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if err = c.discover(); err != nil {
+		return nil, nil, fmt.Errorf("loading the directory - %v", err)
+	}
+	if err = c.register(); err != nil {
+		return nil, nil, err
+	}
+
+	var order acmeOrder
+	for _, domain := range domains {
+		order.Identifiers = append(order.Identifiers, acmeIdentifier{Type: "dns", Value: domain})
+	}
+	resp, _, err := c.post(c.dir.NewOrder, map[string]interface{}{"identifiers": order.Identifiers}, &order)
+	if err != nil {
+		return nil, nil, fmt.Errorf("placing the order - %v", err)
+	}
+	orderURL := resp.Header.Get("Location")
+
+	for _, authzURL := range order.Authorizations {
+		if err = c.authorize(authzURL, challengeType, solver); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, _, err = c.post(order.Finalize, map[string]string{"csr": b64(csr)}, &order); err != nil {
+		return nil, nil, fmt.Errorf("finalizing the order - %v", err)
+	}
+
+	deadline := time.Now().Add(c.pollTimeout)
+	for order.Status != "valid" {
+		switch {
+		case order.Status == "invalid":
+			return nil, nil, fmt.Errorf("order failed - %v", order.Error)
+		case time.Now().After(deadline):
+			return nil, nil, fmt.Errorf("order still %s after %s", order.Status, c.pollTimeout)
+		}
+		time.Sleep(c.pollInterval)
+		if _, _, err = c.post(orderURL, nil, &order); err != nil {
+			return nil, nil, fmt.Errorf("checking the order - %v", err)
+		}
+	}
+
+	if _, certPEM, err = c.post(order.Certificate, nil, nil); err != nil {
+		return nil, nil, fmt.Errorf("downloading the certificate - %v", err)
+	}
+	if keyPEM, err = encodeKey(key); err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// authorize proves control of the domain in one authorization
+// must be called with the lock held
+func (c *acmeClient) authorize(authzURL, challengeType string, solver challengeSolver) error {
+	var authz acmeAuthorization
+	if _, _, err := c.post(authzURL, nil, &authz); err != nil {
+		return fmt.Errorf("loading the authorization - %v", err)
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	var chal *acmeChallenge
+	for id := range authz.Challenges {
+		if authz.Challenges[id].Type == challengeType {
+			chal = &authz.Challenges[id]
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no %s challenge offered for %s", challengeType, authz.Identifier.Value)
+	}
+
+	thumbprint, err := c.thumbprint()
+	if err != nil {
+		return err
+	}
+	keyAuth := chal.Token + "." + thumbprint
+	domain := authz.Identifier.Value
+	if authz.Wildcard {
+		domain = "*." + domain
+	}
+	if err = solver.present(domain, chal.Token, keyAuth); err != nil {
+		return fmt.Errorf("setting up the %s challenge for %s - %v", challengeType, domain, err)
+	}
+	defer solver.cleanUp(domain, chal.Token, keyAuth)
+
+	if _, _, err = c.post(chal.URL, struct{}{}, nil); err != nil {
+		return fmt.Errorf("starting the %s challenge for %s - %v", challengeType, domain, err)
+	}
+
+	deadline := time.Now().Add(c.pollTimeout)
+	for {
+		if _, _, err = c.post(authzURL, nil, &authz); err != nil {
+			return fmt.Errorf("checking the authorization - %v", err)
+		}
+		switch {
+		case authz.Status == "valid":
+			return nil
+		case authz.Status != "pending" && authz.Status != "processing":
+			for _, each := range authz.Challenges {
+				if each.Type == challengeType && each.Error != nil {
+					return fmt.Errorf("%s challenge for %s failed - %v", challengeType, domain, each.Error)
+				}
+			}
+			return fmt.Errorf("authorization for %s is %s", domain, authz.Status)
+		case time.Now().After(deadline):
+			return fmt.Errorf("authorization for %s still pending after %s", domain, c.pollTimeout)
+		}
+		time.Sleep(c.pollInterval)
+	}
+}
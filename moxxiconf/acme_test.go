@@ -0,0 +1,489 @@
+package moxxiConf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// acmeStandIn is a small ACME server for tests, in the spirit of Pebble.
+// It checks every request is signed properly, and really checks challenges -
+// HTTP-01 against httpAddr, and DNS-01 through lookupTXT.
+type acmeStandIn struct {
+	sync.Mutex
+	server    *httptest.Server
+	caKey     *ecdsa.PrivateKey
+	caCert    *x509.Certificate
+	validity  time.Duration
+	httpAddr  string
+	lookupTXT func(fqdn string) []string
+	// badNonces is how many good nonces to reject before accepting any
+	badNonces int
+
+	nonces   map[string]bool
+	accounts map[string]*ecdsa.PublicKey
+	jwks     map[string]string
+	orders   map[string]*standInOrder
+	authzs   map[string]*standInAuthz
+	counter  int
+	issued   int
+}
+
+type standInOrder struct {
+	acmeOrder
+	account string
+	authzs  []*standInAuthz
+	cert    []byte
+}
+
+type standInAuthz struct {
+	acmeAuthorization
+	account string
+}
+
+func newACMEStandIn(t *testing.T) *acmeStandIn {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "could not make the CA key - %v", err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "stand-in ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	assert.Nil(t, err, "could not make the CA - %v", err)
+	caCert, _ := x509.ParseCertificate(der)
+
+	s := &acmeStandIn{
+		caKey:    caKey,
+		caCert:   caCert,
+		validity: 90 * 24 * time.Hour,
+		nonces:   make(map[string]bool),
+		accounts: make(map[string]*ecdsa.PublicKey),
+		jwks:     make(map[string]string),
+		orders:   make(map[string]*standInOrder),
+		authzs:   make(map[string]*standInAuthz),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// client gives an acmeClient for a new account on the stand-in
+func (s *acmeStandIn) client(t *testing.T) *acmeClient {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "could not make the account key - %v", err)
+	return &acmeClient{
+		directoryURL: s.server.URL + "/dir",
+		email:        "test@proxy.com",
+		key:          key,
+		client:       s.server.Client(),
+		pollInterval: time.Millisecond,
+		pollTimeout:  time.Second,
+	}
+}
+
+func (s *acmeStandIn) nextID() string {
+	s.counter++
+	return fmt.Sprint(s.counter)
+}
+
+func (s *acmeStandIn) newNonce(w http.ResponseWriter) {
+	nonce := "nonce" + s.nextID()
+	s.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+func (s *acmeStandIn) problem(w http.ResponseWriter, status int, kind, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(acmeProblem{
+		Type:   "urn:ietf:params:acme:error:" + kind,
+		Detail: detail,
+		Status: status,
+	})
+}
+
+func (s *acmeStandIn) reply(w http.ResponseWriter, status int, location string, body interface{}) {
+	if location != "" {
+		w.Header().Set("Location", s.server.URL+location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// verify checks the JWS in the request, giving the account and payload
+func (s *acmeStandIn) verify(r *http.Request) (account string, payload []byte, kind string, err error) {
+	var jws struct{ Protected, Payload, Signature string }
+	if err = json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return "", nil, "malformed", err
+	}
+	rawProtected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  map[string]string
+	}
+	if err = json.Unmarshal(rawProtected, &protected); err != nil {
+		return "", nil, "malformed", err
+	}
+
+	if !s.nonces[protected.Nonce] {
+		return "", nil, "badNonce", fmt.Errorf("unknown nonce %q", protected.Nonce)
+	}
+	delete(s.nonces, protected.Nonce)
+	if s.badNonces > 0 {
+		s.badNonces--
+		return "", nil, "badNonce", fmt.Errorf("nonce rejected for the test")
+	}
+	if protected.URL != s.server.URL+r.URL.Path || protected.Alg != "ES256" {
+		return "", nil, "malformed", fmt.Errorf("bad url %q or alg %q", protected.URL, protected.Alg)
+	}
+
+	var pub *ecdsa.PublicKey
+	if protected.Kid != "" {
+		account = strings.TrimPrefix(protected.Kid, s.server.URL+"/acct/")
+		if pub = s.accounts[account]; pub == nil {
+			return "", nil, "accountDoesNotExist", fmt.Errorf("no account %q", protected.Kid)
+		}
+	} else if r.URL.Path == "/new-account" && protected.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.JWK["x"])
+		y, _ := base64.RawURLEncoding.DecodeString(protected.JWK["y"])
+		if pub, err = ecdsa.ParseUncompressedPublicKey(elliptic.P256(),
+			append(append([]byte{4}, x...), y...)); err != nil {
+			return "", nil, "badPublicKey", err
+		}
+		account = s.nextID()
+		s.accounts[account] = pub
+		s.jwks[account] = fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+			protected.JWK["x"], protected.JWK["y"])
+	} else {
+		return "", nil, "malformed", fmt.Errorf("no kid or jwk")
+	}
+
+	sig, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	hash := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(pub, hash[:],
+		new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return "", nil, "unauthorized", fmt.Errorf("bad signature")
+	}
+	payload, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+	return account, payload, "", nil
+}
+
+func (s *acmeStandIn) serve(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if r.URL.Path == "/dir" {
+		s.reply(w, http.StatusOK, "", acmeDirectory{
+			NewNonce:   s.server.URL + "/nonce",
+			NewAccount: s.server.URL + "/new-account",
+			NewOrder:   s.server.URL + "/new-order",
+		})
+		return
+	}
+	s.newNonce(w)
+	if r.URL.Path == "/nonce" {
+		return
+	}
+
+	account, payload, kind, err := s.verify(r)
+	if err != nil {
+		s.problem(w, http.StatusBadRequest, kind, err.Error())
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	id := parts[len(parts)-1]
+	switch parts[0] {
+	case "new-account":
+		s.reply(w, http.StatusCreated, "/acct/"+account, map[string]string{"status": "valid"})
+
+	case "new-order":
+		var req struct{ Identifiers []acmeIdentifier }
+		json.Unmarshal(payload, &req)
+		order := &standInOrder{account: account}
+		order.Status = "pending"
+		order.Identifiers = req.Identifiers
+		orderID := s.nextID()
+		order.Finalize = s.server.URL + "/finalize/" + orderID
+		for _, ident := range req.Identifiers {
+			authzID := s.nextID()
+			authz := &standInAuthz{account: account}
+			authz.Status = "pending"
+			authz.Identifier = acmeIdentifier{Type: "dns", Value: strings.TrimPrefix(ident.Value, "*.")}
+			authz.Wildcard = strings.HasPrefix(ident.Value, "*.")
+			for _, kind := range []string{ChallengeHTTP, ChallengeDNS} {
+				authz.Challenges = append(authz.Challenges, acmeChallenge{
+					Type:   kind,
+					URL:    s.server.URL + "/chal/" + authzID + "/" + kind,
+					Token:  "token" + s.nextID(),
+					Status: "pending",
+				})
+			}
+			s.authzs[authzID] = authz
+			order.authzs = append(order.authzs, authz)
+			order.Authorizations = append(order.Authorizations, s.server.URL+"/authz/"+authzID)
+		}
+		s.orders[orderID] = order
+		s.reply(w, http.StatusCreated, "/order/"+orderID, order.acmeOrder)
+
+	case "authz":
+		if authz := s.authzs[id]; authz != nil && authz.account == account {
+			s.reply(w, http.StatusOK, "", authz.acmeAuthorization)
+			return
+		}
+		s.problem(w, http.StatusNotFound, "malformed", "no such authorization")
+
+	case "chal":
+		authz := s.authzs[parts[1]]
+		if authz == nil || authz.account != account {
+			s.problem(w, http.StatusNotFound, "malformed", "no such challenge")
+			return
+		}
+		for i := range authz.Challenges {
+			chal := &authz.Challenges[i]
+			if chal.Type != id {
+				continue
+			}
+			sum := sha256.Sum256([]byte(s.jwks[account]))
+			keyAuth := chal.Token + "." + base64.RawURLEncoding.EncodeToString(sum[:])
+			if err := s.check(authz.Identifier.Value, chal, keyAuth); err != nil {
+				chal.Status, authz.Status = "invalid", "invalid"
+				chal.Error = &acmeProblem{Type: "urn:ietf:params:acme:error:incorrectResponse",
+					Detail: err.Error()}
+			} else {
+				chal.Status, authz.Status = "valid", "valid"
+			}
+			s.reply(w, http.StatusOK, "", chal)
+		}
+
+	case "finalize":
+		order := s.orders[id]
+		if order == nil || order.account != account {
+			s.problem(w, http.StatusNotFound, "malformed", "no such order")
+			return
+		}
+		for _, authz := range order.authzs {
+			if authz.Status != "valid" {
+				s.problem(w, http.StatusForbidden, "orderNotReady", "not authorized")
+				return
+			}
+		}
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || csr.CheckSignature() != nil {
+			s.problem(w, http.StatusBadRequest, "badCSR", fmt.Sprint(err))
+			return
+		}
+		var names []string
+		for _, ident := range order.Identifiers {
+			names = append(names, ident.Value)
+		}
+		if strings.Join(csr.DNSNames, ",") != strings.Join(names, ",") {
+			s.problem(w, http.StatusBadRequest, "badCSR", "names do not match the order")
+			return
+		}
+		s.issued++
+		leaf, _ := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(int64(s.counter) + 100),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(s.validity),
+		}, s.caCert, csr.PublicKey, s.caKey)
+		order.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...)
+		// the order is only ready the next time it is asked about
+		order.Status = "processing"
+		s.reply(w, http.StatusOK, "", order.acmeOrder)
+
+	case "order":
+		order := s.orders[id]
+		if order == nil || order.account != account {
+			s.problem(w, http.StatusNotFound, "malformed", "no such order")
+			return
+		}
+		if order.Status == "processing" {
+			order.Status = "valid"
+			order.Certificate = s.server.URL + "/cert/" + id
+		}
+		s.reply(w, http.StatusOK, "", order.acmeOrder)
+
+	case "cert":
+		order := s.orders[id]
+		if order == nil || order.account != account || order.cert == nil {
+			s.problem(w, http.StatusNotFound, "malformed", "no such certificate")
+			return
+		}
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(order.cert)
+
+	default:
+		s.problem(w, http.StatusNotFound, "malformed", "unknown path "+r.URL.Path)
+	}
+}
+
+// check does the real check of a challenge, like a real ACME server would
+func (s *acmeStandIn) check(domain string, chal *acmeChallenge, keyAuth string) error {
+	switch chal.Type {
+	case ChallengeHTTP:
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+ChallengePath+chal.Token, nil)
+		req.Host = domain
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != keyAuth {
+			return fmt.Errorf("got %d %q", resp.StatusCode, body)
+		}
+		return nil
+	case ChallengeDNS:
+		sum := sha256.Sum256([]byte(keyAuth))
+		want := base64.RawURLEncoding.EncodeToString(sum[:])
+		for _, value := range s.lookupTXT("_acme-challenge." + domain) {
+			if value == want {
+				return nil
+			}
+		}
+		return fmt.Errorf("no TXT record %q", want)
+	}
+	return fmt.Errorf("unknown challenge %s", chal.Type)
+}
+
+// fakeDNSProvider keeps TXT records in memory
+type fakeDNSProvider struct {
+	sync.Mutex
+	records map[string][]string
+}
+
+func (p *fakeDNSProvider) Present(fqdn, value string) error {
+	p.Lock()
+	defer p.Unlock()
+	p.records[fqdn] = append(p.records[fqdn], value)
+	return nil
+}
+
+func (p *fakeDNSProvider) CleanUp(fqdn, value string) error {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.records, fqdn)
+	return nil
+}
+
+func (p *fakeDNSProvider) lookup(fqdn string) []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string{}, p.records[fqdn]...)
+}
+
+func TestACMEClient_obtain(t *testing.T) {
+	standIn := newACMEStandIn(t)
+	defer standIn.server.Close()
+	challenges := httptest.NewServer(ChallengeHandler(HandlerConfig{}))
+	defer challenges.Close()
+	standIn.httpAddr = strings.TrimPrefix(challenges.URL, "http://")
+	dns := &fakeDNSProvider{records: make(map[string][]string)}
+	standIn.lookupTXT = dns.lookup
+
+	var testData = []struct {
+		domains   []string
+		challenge string
+		solver    challengeSolver
+		badNonces int
+		fails     bool
+	}{
+		{
+			domains:   []string{"abcdefgh.proxy.com"},
+			challenge: ChallengeHTTP,
+			solver:    httpSolver{},
+		}, {
+			domains:   []string{"*.proxy.com", "proxy.com"},
+			challenge: ChallengeDNS,
+			solver:    dnsSolver{provider: dns},
+		}, {
+			domains:   []string{"abcdefgh.proxy.com"},
+			challenge: ChallengeHTTP,
+			solver:    httpSolver{},
+			badNonces: 1,
+		}, {
+			domains:   []string{"abcdefgh.proxy.com"},
+			challenge: ChallengeHTTP,
+			solver:    httpSolver{},
+			badNonces: 2,
+			fails:     true,
+		}, {
+			// nothing is published, so the check fails
+			domains:   []string{"abcdefgh.proxy.com"},
+			challenge: ChallengeDNS,
+			solver:    dnsSolver{provider: &fakeDNSProvider{records: make(map[string][]string)}},
+			fails:     true,
+		},
+	}
+
+	for id, test := range testData {
+		standIn.badNonces = test.badNonces
+		certPEM, keyPEM, err := standIn.client(t).obtain(test.domains, test.challenge, test.solver)
+		if test.fails {
+			assert.Error(t, err, "test %d - should have failed", id)
+			continue
+		}
+		if !assert.NoError(t, err, "test %d - should have got a certificate", id) {
+			continue
+		}
+
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if assert.NoError(t, err, "test %d - the key should match the certificate", id) {
+			assert.Len(t, pair.Certificate, 2, "test %d - should get the whole chain", id)
+			leaf, _ := x509.ParseCertificate(pair.Certificate[0])
+			assert.Equal(t, test.domains, leaf.DNSNames, "test %d - wrong names", id)
+			assert.Equal(t, test.domains[0], leaf.Subject.CommonName, "test %d - wrong common name", id)
+		}
+	}
+
+	challengeTokens.RLock()
+	assert.Empty(t, challengeTokens.answers, "every challenge should be cleaned up")
+	challengeTokens.RUnlock()
+	assert.Empty(t, dns.records, "every record should be cleaned up")
+}
+
+func TestLoadAccountKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "account.key")
+
+	key, err := loadAccountKey(file)
+	assert.NoError(t, err, "should make a new key")
+	again, err := loadAccountKey(file)
+	assert.NoError(t, err, "should load the key")
+	if key != nil && again != nil {
+		assert.True(t, key.Equal(again), "should get the same key back")
+	}
+
+	_, err = loadAccountKey(filepath.Join(t.TempDir(), "missing", "account.key"))
+	assert.Error(t, err, "should not make a key where it cannot be saved")
+}
@@ -0,0 +1,257 @@
+package moxxiConf
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the actions recorded in the audit log - a proxy is recorded as deleted
+// once none of its configs are left
+const (
+	AuditCreate = "create"
+	AuditDelete = "delete"
+)
+
+// MaxAuditLine is the longest single record the audit lookup will read
+const MaxAuditLine = 1 << 20
+
+// auditRecord - one line in the audit log
+// Proxy is the proxy as it was created, without its password
+type auditRecord struct {
+	Time          time.Time
+	Action        string
+	RequestID     string `json:",omitempty"`
+	Client        string `json:",omitempty"`
+	ForwardedFor  string `json:",omitempty"`
+	Identity      string `json:",omitempty"`
+	UserAgent     string `json:",omitempty"`
+	Route         string
+	RequestedHost string      `json:",omitempty"`
+	Proxy         *siteParams `json:",omitempty"`
+	ExtHost       string
+	IntHost       string
+}
+
+// matches checks if the record is for the given ExtHost or IntHost
+// the IntHost is checked both as requested and after redirect tracing
+func (rec auditRecord) matches(extHost, intHost string) bool {
+	if extHost != "" && !strings.EqualFold(rec.ExtHost, extHost) {
+		return false
+	}
+	if intHost != "" && !strings.EqualFold(rec.IntHost, intHost) &&
+		!strings.EqualFold(rec.RequestedHost, intHost) {
+		return false
+	}
+	return true
+}
+
+// auditLog - an append only JSON lines file shared by every handler using it
+type auditLog struct {
+	sync.Mutex
+	path string
+	file *os.File
+}
+
+var auditLogs = make(map[string]*auditLog)
+var auditLogsLock sync.Mutex
+
+// openAuditLog opens the audit log at path, reusing it if already open
+func openAuditLog(path string) (*auditLog, Err) {
+	auditLogsLock.Lock()
+	defer auditLogsLock.Unlock()
+
+	if a, ok := auditLogs[path]; ok {
+		return a, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, NewErr{Code: ErrConfigBadAuditLog, value: path, deepErr: err}
+	}
+
+	a := &auditLog{path: path, file: f}
+	auditLogs[path] = a
+	return a, nil
+}
+
+// write appends one record to the log
+func (a *auditLog) write(rec auditRecord) Err {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return NewErr{Code: ErrAuditWrite, value: a.path, deepErr: err}
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if _, err = a.file.Write(append(line, '\n')); err != nil {
+		return NewErr{Code: ErrAuditWrite, value: a.path, deepErr: err}
+	}
+	return nil
+}
+
+// readAuditLog calls each with every record in the log at path, in order
+func readAuditLog(path string, each func(auditRecord)) Err {
+	f, err := os.Open(path)
+	if err != nil {
+		return NewErr{Code: ErrAuditRead, value: path, deepErr: err}
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 4096), MaxAuditLine)
+	for s.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			continue
+		}
+		each(rec)
+	}
+	if err := s.Err(); err != nil {
+		return NewErr{Code: ErrAuditRead, value: path, deepErr: err}
+	}
+	return nil
+}
+
+// searchAuditLog returns every record in the log at path for the ExtHost or IntHost
+func searchAuditLog(path, extHost, intHost string) ([]auditRecord, Err) {
+	var found []auditRecord
+	err := readAuditLog(path, func(rec auditRecord) {
+		if rec.matches(extHost, intHost) {
+			found = append(found, rec)
+		}
+	})
+	return found, err
+}
+
+// newAuditRecord fills in everything about who made the request
+func newAuditRecord(config HandlerConfig, r *http.Request, action string,
+	request, site siteParams) auditRecord {
+
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+
+	identity, _, _ := r.BasicAuth()
+	if config.identityHeader != "" && r.Header.Get(config.identityHeader) != "" {
+		identity = r.Header.Get(config.identityHeader)
+	}
+
+	// the proxy is recorded as it was checked and written, not as it was
+	// asked for - so nothing the client sent, like a password, gets logged
+	proxy := site
+	proxy.AuthPassword = ""
+	proxy.Error = ""
+	proxy.ErrorID = ""
+
+	return auditRecord{
+		Time:          time.Now().UTC(),
+		Action:        action,
+		RequestID:     RequestID(r),
+		Client:        client,
+		ForwardedFor:  r.Header.Get("X-Forwarded-For"),
+		Identity:      identity,
+		UserAgent:     r.UserAgent(),
+		Route:         config.handlerRoute,
+		RequestedHost: request.IntHost,
+		Proxy:         &proxy,
+		ExtHost:       site.ExtHost,
+		IntHost:       site.IntHost,
+	}
+}
+
+// auditCreate records a newly created proxy if the handler has an audit log
+func auditCreate(config HandlerConfig, r *http.Request, request, site siteParams) Err {
+	if config.audit == nil {
+		return nil
+	}
+	return config.audit.write(newAuditRecord(config, r, AuditCreate, request, site))
+}
+
+// auditRemoved records every proxy the handler created whose configs are
+// all gone as deleted - outputs are those of every handler, as handlers can
+// share a confPath
+// proxies created within SweepInterval are left alone, as they may still be
+// being written
+func auditRemoved(config HandlerConfig, outputs []confOutput) Err {
+	if config.audit == nil {
+		return nil
+	}
+
+	live := make(map[string]auditRecord)
+	err := readAuditLog(config.audit.path, func(rec auditRecord) {
+		if rec.Route != config.handlerRoute {
+			return
+		}
+		switch rec.Action {
+		case AuditCreate:
+			live[strings.ToLower(rec.ExtHost)] = rec
+		case AuditDelete:
+			delete(live, strings.ToLower(rec.ExtHost))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-SweepInterval)
+	for _, rec := range live {
+		if rec.Time.After(cutoff) || proxyExists(rec.ExtHost, outputs) {
+			continue
+		}
+		if err = config.audit.write(auditRecord{
+			Time:    time.Now().UTC(),
+			Action:  AuditDelete,
+			Route:   config.handlerRoute,
+			ExtHost: rec.ExtHost,
+			IntHost: rec.IntHost,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuditHandler - creates and returns a Handler to search the audit log
+// requests must carry the auditToken as a bearer token, and give an extHost
+// or intHost (or both) to search for
+func AuditHandler(config HandlerConfig) http.HandlerFunc {
+	want := []byte("Bearer " + config.auditToken)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.auditToken == "" ||
+			subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			pkgErr := &NewErr{Code: ErrAuditAuth}
+			sendErr(w, r, config, pkgErr)
+			return
+		}
+
+		extHost := r.FormValue("extHost")
+		intHost := r.FormValue("intHost")
+		if extHost == "" && intHost == "" {
+			pkgErr := &NewErr{Code: ErrNoAuditQuery}
+			sendErr(w, r, config, pkgErr)
+			return
+		}
+
+		found, pkgErr := searchAuditLog(config.auditLog, extHost, intHost)
+		if pkgErr != nil {
+			sendErr(w, r, config, pkgErr)
+			return
+		}
+
+		if found == nil {
+			found = []auditRecord{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(found)
+	}
+}
@@ -0,0 +1,216 @@
+package moxxiConf
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "moxxi_test_")
+	assert.Nil(t, err, "could not make temp dir - %v", err)
+	defer os.RemoveAll(dir)
+
+	auditPath := filepath.Join(dir, "audit.jsonl")
+	audit, locErr := openAuditLog(auditPath)
+	assert.Nil(t, locErr, "could not open the audit log - %v", locErr)
+
+	again, _ := openAuditLog(auditPath)
+	assert.True(t, audit == again, "the same audit log should be shared")
+
+	testConfig := HandlerConfig{
+		handlerRoute:   "/form/",
+		baseURL:        "test.com",
+		confPath:       dir,
+		confExt:        ".conf",
+		subdomainLen:   8,
+		confTempl:      template.Must(template.New("testing").Parse("{{ .IntHost }}")),
+		resTempl:       template.Must(template.New("testing").Parse("{{ range . }}{{ .ExtHost }}{{ end }}")),
+		audit:          audit,
+		identityHeader: "X-Remote-User",
+	}
+
+	formServer := httptest.NewServer(FormHandler(testConfig,
+		slog.New(slog.NewTextHandler(ioutil.Discard, nil))))
+	defer formServer.Close()
+
+	var created []string
+	for _, host := range []string{"one.com", "two.com", "one.com"} {
+		req, _ := http.NewRequest("POST", formServer.URL, strings.NewReader(url.Values{
+			"host": []string{host},
+			"ip":   []string{"10.10.10.10"},
+		}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("User-Agent", "moxxi-test")
+		req.Header.Set("X-Remote-User", "jdoe")
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "got an error creating a proxy")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		created = append(created, string(body))
+	}
+
+	auditServer := httptest.NewServer(AuditHandler(HandlerConfig{auditLog: auditPath, auditToken: "sesame"}))
+	defer auditServer.Close()
+
+	var testData = []struct {
+		query   url.Values
+		token   string
+		resCode int
+		found   []string
+	}{
+		{
+			query:   url.Values{"intHost": []string{"one.com"}},
+			resCode: http.StatusUnauthorized,
+		}, {
+			query:   url.Values{"intHost": []string{"one.com"}},
+			token:   "open",
+			resCode: http.StatusUnauthorized,
+		}, {
+			query:   url.Values{"intHost": []string{"one.com"}},
+			token:   "sesame",
+			resCode: http.StatusOK,
+			found:   []string{created[0], created[2]},
+		}, {
+			query:   url.Values{"extHost": []string{strings.ToUpper(created[1])}},
+			token:   "sesame",
+			resCode: http.StatusOK,
+			found:   []string{created[1]},
+		}, {
+			query:   url.Values{"extHost": []string{created[1]}, "intHost": []string{"one.com"}},
+			token:   "sesame",
+			resCode: http.StatusOK,
+			found:   []string{},
+		}, {
+			query:   url.Values{},
+			token:   "sesame",
+			resCode: http.StatusBadRequest,
+		},
+	}
+
+	for id, test := range testData {
+		req, _ := http.NewRequest("GET", auditServer.URL+"?"+test.query.Encode(), nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "test %d - got an error searching", id)
+		assert.Equal(t, test.resCode, resp.StatusCode, "test %d - wrong response code", id)
+		if test.resCode == http.StatusUnauthorized {
+			assert.Equal(t, ErrAuditAuth.ID(), resp.Header.Get("X-Moxxi-Error"), "test %d - wrong error", id)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			continue
+		}
+
+		var records []auditRecord
+		err = json.NewDecoder(resp.Body).Decode(&records)
+		resp.Body.Close()
+		assert.NoError(t, err, "test %d - could not decode records", id)
+
+		found := []string{}
+		for _, rec := range records {
+			found = append(found, rec.ExtHost)
+			assert.Equal(t, AuditCreate, rec.Action, "test %d - wrong action", id)
+			assert.Equal(t, "127.0.0.1", rec.Client, "test %d - wrong client", id)
+			assert.Equal(t, "jdoe", rec.Identity, "test %d - wrong identity", id)
+			assert.Equal(t, "moxxi-test", rec.UserAgent, "test %d - wrong user agent", id)
+			assert.Equal(t, "10.10.10.10", rec.Proxy.IntIP, "test %d - wrong request", id)
+		}
+		assert.Equal(t, test.found, found, "test %d - wrong records found", id)
+	}
+}
+
+func TestAuditLog_noPassword(t *testing.T) {
+	dir := t.TempDir()
+	auditPath := filepath.Join(dir, "audit.jsonl")
+	audit, locErr := openAuditLog(auditPath)
+	if !assert.Nil(t, locErr, "could not open the audit log - %v", locErr) {
+		return
+	}
+
+	testConfig := HandlerConfig{
+		handlerRoute: "/json/",
+		baseURL:      "test.com",
+		confPath:     dir,
+		confExt:      ".conf",
+		subdomainLen: 8,
+		confTempl:    template.Must(template.New("testing").Parse("{{ .IntHost }}")),
+		resTempl: template.Must(template.New("testing").Parse(
+			`{{ define "start" }}{{ end }}{{ define "body" }}{{ .ExtHost }}{{ end }}{{ define "end" }}{{ end }}`)),
+		audit: audit,
+	}
+
+	jsonServer := httptest.NewServer(JSONHandler(testConfig,
+		slog.New(slog.NewTextHandler(ioutil.Discard, nil))))
+	defer jsonServer.Close()
+
+	resp, err := http.Post(jsonServer.URL, "application/json", strings.NewReader(
+		`{"IntHost":"one.com","IntIP":"10.10.10.10","BasicAuth":true,"AuthPassword":"hunter2"}`))
+	if !assert.NoError(t, err, "got an error creating a proxy") {
+		return
+	}
+	resp.Body.Close()
+
+	contents, _ := ioutil.ReadFile(auditPath)
+	assert.Contains(t, string(contents), `"IntHost":"one.com"`, "the proxy should be recorded")
+	assert.NotContains(t, string(contents), "hunter2", "the password should not be recorded")
+	assert.NotContains(t, string(contents), "AuthPassword", "no password should be recorded")
+}
+
+func TestAuditRemoved(t *testing.T) {
+	dir := t.TempDir()
+	auditPath := filepath.Join(dir, "audit.jsonl")
+	audit, locErr := openAuditLog(auditPath)
+	if !assert.Nil(t, locErr, "could not open the audit log - %v", locErr) {
+		return
+	}
+
+	testConfig := HandlerConfig{
+		handlerType:  "json",
+		handlerRoute: "/json/",
+		confPath:     dir,
+		confExt:      "conf",
+		audit:        audit,
+	}
+	old := time.Now().Add(-2 * SweepInterval).UTC()
+	for _, rec := range []auditRecord{
+		{Time: old, Action: AuditCreate, Route: "/json/", ExtHost: "gone.test.com", IntHost: "one.com"},
+		{Time: old, Action: AuditCreate, Route: "/json/", ExtHost: "kept.test.com", IntHost: "two.com"},
+		{Time: time.Now().UTC(), Action: AuditCreate, Route: "/json/", ExtHost: "new.test.com", IntHost: "three.com"},
+		{Time: old, Action: AuditCreate, Route: "/json/", ExtHost: "deleted.test.com", IntHost: "four.com"},
+		{Time: old, Action: AuditDelete, Route: "/json/", ExtHost: "deleted.test.com", IntHost: "four.com"},
+		{Time: old, Action: AuditCreate, Route: "/form/", ExtHost: "other.test.com", IntHost: "five.com"},
+	} {
+		assert.Nil(t, audit.write(rec), "could not write a record")
+	}
+	ioutil.WriteFile(testConfig.confOutputs()[0].fileName("kept.test.com"), nil, 0644)
+
+	// a second sweep should find nothing left to record
+	for i := 0; i < 2; i++ {
+		assert.Empty(t, sweepRemoved([]HandlerConfig{testConfig}), "sweep %d - should sweep cleanly", i)
+	}
+
+	var deleted []string
+	readAuditLog(auditPath, func(rec auditRecord) {
+		if rec.Action == AuditDelete {
+			deleted = append(deleted, rec.ExtHost)
+			assert.Equal(t, "/json/", rec.Route, "%s - wrong route", rec.ExtHost)
+		}
+	})
+	assert.Equal(t, []string{"deleted.test.com", "gone.test.com"}, deleted,
+		"only the proxy whose config is gone should be recorded as deleted")
+}
@@ -0,0 +1,330 @@
+package moxxiConf
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRenewBefore is how long before they expire certificates are renewed
+const DefaultRenewBefore = 30 * 24 * time.Hour
+
+// CertRenewInterval is how often certificates are checked for renewal
+const CertRenewInterval = 12 * time.Hour
+
+// ChallengePath is where moxxi answers HTTP-01 challenges
+const ChallengePath = "/.well-known/acme-challenge/"
+
+// WildcardCertName is the start of the file names of the wildcard certificate
+// it can never be a generated subdomain
+const WildcardCertName = "_wildcard"
+
+// the file extensions of certificates and their keys in the certDir
+const (
+	CertExt = ".crt"
+	KeyExt  = ".key"
+)
+
+// challengeTokens - the answers to the HTTP-01 challenges in progress, by token
+var challengeTokens = struct {
+	sync.RWMutex
+	answers map[string]string
+}{answers: make(map[string]string)}
+
+// httpSolver solves HTTP-01 challenges by answering them from ChallengeHandler
+type httpSolver struct{}
+
+func (httpSolver) present(domain, token, keyAuth string) error {
+	challengeTokens.Lock()
+	defer challengeTokens.Unlock()
+	challengeTokens.answers[token] = keyAuth
+	return nil
+}
+
+func (httpSolver) cleanUp(domain, token, keyAuth string) error {
+	challengeTokens.Lock()
+	defer challengeTokens.Unlock()
+	delete(challengeTokens.answers, token)
+	return nil
+}
+
+// ChallengeHandler - answers HTTP-01 challenges for certificates being issued
+// the web server in front of moxxi must send ChallengePath for every
+// generated subdomain here
+func ChallengeHandler(config HandlerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Path[strings.LastIndex(r.URL.Path, PathSep)+1:]
+
+		challengeTokens.RLock()
+		keyAuth, ok := challengeTokens.answers[token]
+		challengeTokens.RUnlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte(keyAuth))
+	}
+}
+
+// certManagers - the certManager for each certDir, shared by every handler
+// that keeps its certificates there
+var certManagers = make(map[string]*certManager)
+var certManagersLock sync.Mutex
+
+// certManager - keeps certificates for a handler's proxies issued and renewed
+// each certificate is issued under its own lock, so one slow issuance does not
+// hold up the others
+type certManager struct {
+	sync.Mutex
+	issuing     map[string]*nameLock
+	client      *acmeClient
+	baseURL     string
+	certDir     string
+	challenge   string
+	solver      challengeSolver
+	wildcard    bool
+	renewBefore time.Duration
+	started     sync.Once
+}
+
+// sharedCertManager returns the manager already looking after m's certDir,
+// or makes m that manager - so handlers sharing a certDir never issue or renew
+// the same certificate twice. They have to agree on how certificates are
+// issued to share it.
+func sharedCertManager(m *certManager) (*certManager, Err) {
+	certManagersLock.Lock()
+	defer certManagersLock.Unlock()
+
+	dir := filepath.Clean(m.certDir)
+	have, ok := certManagers[dir]
+	if !ok {
+		certManagers[dir] = m
+		return m, nil
+	}
+	if have.baseURL != m.baseURL || have.wildcard != m.wildcard ||
+		have.challenge != m.challenge || have.client.directoryURL != m.client.directoryURL {
+		return nil, NewErr{
+			Code:    ErrConfigBadACME,
+			value:   "certDir " + m.certDir,
+			deepErr: fmt.Errorf("shared by handlers with different baseURL or acme settings"),
+		}
+	}
+	return have, nil
+}
+
+// nameLock - the lock on one certificate, and how many are holding or waiting
+// for it
+type nameLock struct {
+	sync.Mutex
+	users int
+}
+
+// lockName locks the certificate under name alone, returning the unlock
+func (m *certManager) lockName(name string) func() {
+	m.Lock()
+	if m.issuing == nil {
+		m.issuing = make(map[string]*nameLock)
+	}
+	l, ok := m.issuing[name]
+	if !ok {
+		l = &nameLock{}
+		m.issuing[name] = l
+	}
+	l.users++
+	m.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.Lock()
+		if l.users--; l.users < 1 {
+			delete(m.issuing, name)
+		}
+		m.Unlock()
+	}
+}
+
+// issueTimeout is the longest issuing one certificate can take - answering
+// its challenge, then waiting on the authorization and on the order
+func (m *certManager) issueTimeout() time.Duration {
+	timeout := 2 * m.client.pollTimeout
+	if solver, ok := m.solver.(dnsSolver); ok {
+		timeout += solver.wait
+	}
+	return timeout
+}
+
+// certPaths gives where the certificate and key for name are kept
+func (m *certManager) certPaths(name string) (certFile, keyFile string) {
+	base := filepath.Join(m.certDir, name)
+	return base + CertExt, base + KeyExt
+}
+
+// certName is the name the certificate for a new proxy is kept under - the
+// wildcard certificate, or one just for extHost
+func (m *certManager) certName(extHost string) string {
+	if m.wildcard {
+		return WildcardCertName + DomainSep + m.baseURL
+	}
+	return extHost
+}
+
+// certFor gives the certificate and key files to use for a new proxy,
+// getting the certificate if needed
+func (m *certManager) certFor(extHost string) (certFile, keyFile string, err error) {
+	if m.wildcard {
+		return m.ensure(m.certName(extHost), []string{"*" + DomainSep + m.baseURL, m.baseURL})
+	}
+	return m.ensure(m.certName(extHost), []string{extHost})
+}
+
+// reserve claims the certificate for extHost before it is issued, with an
+// empty file that cannot be made if the name is already taken - so a name
+// that turns out to be in use never costs an issuance
+// the wildcard certificate covers every name, so there is nothing to reserve
+func (m *certManager) reserve(extHost string) Err {
+	if m.wildcard {
+		return nil
+	}
+	certFile, _ := m.certPaths(extHost)
+	return writeNewFile(certFile, nil)
+}
+
+// release gives up the certificate for extHost if it will not be used
+func (m *certManager) release(extHost string) {
+	if m.wildcard {
+		return
+	}
+	certFile, keyFile := m.certPaths(extHost)
+	os.Remove(certFile)
+	os.Remove(keyFile)
+}
+
+// ensure makes sure there is a certificate for the domains under name that is
+// not due for renewal, getting a new one if needed
+func (m *certManager) ensure(name string, domains []string) (certFile, keyFile string, err error) {
+	unlock := m.lockName(name)
+	defer unlock()
+
+	certFile, keyFile = m.certPaths(name)
+	if expiry, err := certExpiry(certFile); err == nil && time.Until(expiry) > m.renewBefore {
+		return certFile, keyFile, nil
+	}
+
+	certPEM, keyPEM, err := m.client.obtain(domains, m.challenge, m.solver)
+	if err != nil {
+		return "", "", err
+	}
+	// the key goes first, so a new certificate is never paired with an old key
+	if err = replaceFile(keyFile, keyPEM, 0600); err != nil {
+		return "", "", err
+	}
+	if err = replaceFile(certFile, certPEM, ConfFileMode); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// certExpiry reads when the first certificate in file expires
+func certExpiry(file string) (time.Time, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return time.Time{}, fmt.Errorf("no PEM data in %s", file)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// renewAll renews every certificate in the certDir that is due. Certificates
+// for proxies that no longer have any config are removed instead. Anything
+// newer than SweepInterval that is not a certificate yet is left alone, as it
+// is reserved for a proxy still being written.
+func (m *certManager) renewAll(outputs []confOutput) []error {
+	var errs []error
+	if m.wildcard {
+		if _, _, err := m.certFor(""); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	files, err := ioutil.ReadDir(m.certDir)
+	if err != nil {
+		return append(errs, err)
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), CertExt) ||
+			strings.HasPrefix(file.Name(), WildcardCertName+DomainSep) {
+			continue
+		}
+		extHost := strings.TrimSuffix(file.Name(), CertExt)
+		certFile, keyFile := m.certPaths(extHost)
+		expiry, err := certExpiry(certFile)
+		if err == nil && time.Until(expiry) > m.renewBefore {
+			continue
+		}
+		if err != nil && file.ModTime().After(time.Now().Add(-SweepInterval)) {
+			continue
+		}
+
+		if !proxyExists(extHost, outputs) {
+			os.Remove(certFile)
+			os.Remove(keyFile)
+			continue
+		}
+		if _, _, err := m.ensure(extHost, []string{extHost}); err != nil {
+			errs = append(errs, fmt.Errorf("%s - %v", extHost, err))
+		}
+	}
+	return errs
+}
+
+// proxyExists checks if any of the config files for extHost are still around
+func proxyExists(extHost string, outputs []confOutput) bool {
+	for _, out := range outputs {
+		if _, err := os.Stat(out.fileName(extHost)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// start checks for certificates to renew now, and every CertRenewInterval
+// after until ctx is done - only the first call for a manager does anything,
+// so outputs must be those of every handler sharing it
+func (m *certManager) start(ctx context.Context, outputs []confOutput, l *slog.Logger) {
+	m.started.Do(func() {
+		go func() {
+			ticker := time.NewTicker(CertRenewInterval)
+			defer ticker.Stop()
+			for {
+				for _, err := range m.renewAll(outputs) {
+					l.Error("failed to renew certificate", "certDir", m.certDir,
+						"error", NewErr{Code: ErrACME, value: m.baseURL, deepErr: err})
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	})
+}
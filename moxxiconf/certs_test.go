@@ -0,0 +1,431 @@
+package moxxiConf
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCertManager gives a certManager issuing from the stand-in through HTTP-01
+func testCertManager(t *testing.T, standIn *acmeStandIn) *certManager {
+	challenges := httptest.NewServer(ChallengeHandler(HandlerConfig{}))
+	t.Cleanup(challenges.Close)
+	standIn.httpAddr = strings.TrimPrefix(challenges.URL, "http://")
+
+	return &certManager{
+		client:      standIn.client(t),
+		baseURL:     "proxy.com",
+		certDir:     t.TempDir(),
+		challenge:   ChallengeHTTP,
+		solver:      httpSolver{},
+		renewBefore: DefaultRenewBefore,
+	}
+}
+
+func TestChallengeHandler(t *testing.T) {
+	httpSolver{}.present("abcdefgh.proxy.com", "known", "known.thumbprint")
+	defer httpSolver{}.cleanUp("abcdefgh.proxy.com", "known", "known.thumbprint")
+	handler := ChallengeHandler(HandlerConfig{})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", ChallengePath+"known", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "should answer a known token")
+	assert.Equal(t, "known.thumbprint", w.Body.String(), "wrong answer")
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", ChallengePath+"unknown", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, "should not answer an unknown token")
+}
+
+func TestCertManager_certFor(t *testing.T) {
+	standIn := newACMEStandIn(t)
+	defer standIn.server.Close()
+	m := testCertManager(t, standIn)
+
+	certFile, keyFile, err := m.certFor("abcdefgh.proxy.com")
+	assert.NoError(t, err, "should get a certificate")
+	assert.Equal(t, filepath.Join(m.certDir, "abcdefgh.proxy.com.crt"), certFile, "wrong certificate file")
+	assert.Equal(t, filepath.Join(m.certDir, "abcdefgh.proxy.com.key"), keyFile, "wrong key file")
+	info, err := os.Stat(keyFile)
+	if assert.NoError(t, err, "the key should be written") {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "the key should be private")
+	}
+
+	_, _, err = m.certFor("abcdefgh.proxy.com")
+	assert.NoError(t, err, "should reuse the certificate")
+	assert.Equal(t, 1, standIn.issued, "a good certificate should not be issued again")
+
+	// anything expiring within renewBefore is issued again
+	standIn.validity = 24 * time.Hour
+	m.certFor("ijklmnop.proxy.com")
+	_, _, err = m.certFor("ijklmnop.proxy.com")
+	assert.NoError(t, err, "should renew the certificate")
+	assert.Equal(t, 3, standIn.issued, "a certificate due for renewal should be issued again")
+}
+
+func TestCertManager_renewAll(t *testing.T) {
+	standIn := newACMEStandIn(t)
+	defer standIn.server.Close()
+	m := testCertManager(t, standIn)
+	confDir := t.TempDir()
+	outputs := []confOutput{{confPath: confDir, confExt: "conf"}}
+
+	standIn.validity = 24 * time.Hour
+	for _, host := range []string{"kept.proxy.com", "gone.proxy.com"} {
+		_, _, err := m.certFor(host)
+		assert.NoError(t, err, "should get a certificate for %s", host)
+	}
+	assert.Nil(t, ioutil.WriteFile(outputs[0].fileName("kept.proxy.com"), nil, 0644))
+
+	standIn.validity = 90 * 24 * time.Hour
+	assert.Empty(t, m.renewAll(outputs), "should renew without errors")
+	assert.Equal(t, 3, standIn.issued, "only the proxy still around should be renewed")
+
+	expiry, err := certExpiry(filepath.Join(m.certDir, "kept.proxy.com"+CertExt))
+	assert.NoError(t, err, "the renewed certificate should be there")
+	assert.True(t, time.Until(expiry) > m.renewBefore, "the certificate should be renewed")
+	for _, ext := range []string{CertExt, KeyExt} {
+		_, err = os.Stat(filepath.Join(m.certDir, "gone.proxy.com"+ext))
+		assert.True(t, errors.Is(err, os.ErrNotExist), "the %s for a removed proxy should go", ext)
+	}
+
+	// a name reserved for a proxy being written is kept, until it is stale
+	for _, host := range []string{"writing.proxy.com", "stale.proxy.com"} {
+		assert.Nil(t, m.reserve(host), "should reserve %s", host)
+	}
+	stale, _ := m.certPaths("stale.proxy.com")
+	old := time.Now().Add(-2 * SweepInterval)
+	os.Chtimes(stale, old, old)
+	assert.Empty(t, m.renewAll(outputs), "should pass over reservations without errors")
+	writing, _ := m.certPaths("writing.proxy.com")
+	_, err = os.Stat(writing)
+	assert.NoError(t, err, "a new reservation should be kept")
+	_, err = os.Stat(stale)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "a stale reservation should go")
+	assert.Equal(t, 3, standIn.issued, "reservations should not be issued")
+}
+
+func TestConfWrite_certs(t *testing.T) {
+	standIn := newACMEStandIn(t)
+	defer standIn.server.Close()
+	dns := &fakeDNSProvider{records: make(map[string][]string)}
+	standIn.lookupTXT = dns.lookup
+
+	m := testCertManager(t, standIn)
+	testConfig := HandlerConfig{
+		baseURL:      "proxy.com",
+		confPath:     t.TempDir(),
+		confExt:      "conf",
+		confTempl:    template.Must(template.New("testing").Parse("{{ .CertFile }} {{ .KeyFile }}")),
+		subdomainLen: 8,
+		certs:        m,
+	}
+
+	out, locErr := confWrite(testConfig)(siteParams{IntHost: "domain.com"})
+	assert.Nil(t, locErr, "should write with a certificate - %v", locErr)
+	contents, _ := ioutil.ReadFile(testConfig.confOutputs()[0].fileName(out.ExtHost))
+	base := filepath.Join(m.certDir, out.ExtHost)
+	assert.Equal(t, base+CertExt+" "+base+KeyExt, string(contents), "should use the new certificate")
+
+	m.wildcard, m.challenge, m.solver = true, ChallengeDNS, dnsSolver{provider: dns}
+	out, locErr = confWrite(testConfig)(siteParams{IntHost: "domain.com"})
+	assert.Nil(t, locErr, "should write with the wildcard certificate - %v", locErr)
+	contents, _ = ioutil.ReadFile(testConfig.confOutputs()[0].fileName(out.ExtHost))
+	base = filepath.Join(m.certDir, WildcardCertName+".proxy.com")
+	assert.Equal(t, base+CertExt+" "+base+KeyExt, string(contents), "should use the wildcard certificate")
+
+	// without a certificate, the proxy is not created
+	m.wildcard, m.challenge, m.solver = false, ChallengeHTTP, dnsSolver{provider: dns}
+	_, locErr = confWrite(testConfig)(siteParams{IntHost: "domain.com"})
+	assert.ErrorIs(t, locErr, ErrACME, "should fail without a certificate")
+	files, _ := ioutil.ReadDir(testConfig.confPath)
+	assert.Len(t, files, 2, "no config should be written without a certificate")
+}
+
+func TestValidateConfigACME(t *testing.T) {
+	var testData = []struct {
+		in      interface{}
+		out     map[string]interface{}
+		errCode ErrCode
+	}{
+		{
+			in: map[string]interface{}{
+				"directory":  "https://acme.test/dir",
+				"accountKey": "/etc/moxxi/account.key",
+				"certDir":    "/etc/moxxi/certs",
+			},
+			out: map[string]interface{}{
+				"directory":   "https://acme.test/dir",
+				"email":       "",
+				"accountKey":  "/etc/moxxi/account.key",
+				"certDir":     "/etc/moxxi/certs",
+				"challenge":   ChallengeHTTP,
+				"dnsProvider": "",
+				"dnsSettings": map[string]interface{}{},
+				"dnsWait":     0,
+				"renewBefore": 0,
+				"wildcard":    false,
+			},
+		}, {
+			in: map[string]interface{}{
+				"directory":   "https://acme.test/dir",
+				"accountKey":  "/etc/moxxi/account.key",
+				"certDir":     "/etc/moxxi/certs",
+				"wildcard":    true,
+				"dnsProvider": "exec",
+				"dnsSettings": map[string]interface{}{"command": "/bin/true"},
+				"dnsWait":     float64(30),
+				"renewBefore": float64(14),
+			},
+			out: map[string]interface{}{
+				"directory":   "https://acme.test/dir",
+				"email":       "",
+				"accountKey":  "/etc/moxxi/account.key",
+				"certDir":     "/etc/moxxi/certs",
+				"challenge":   ChallengeDNS,
+				"dnsProvider": "exec",
+				"dnsSettings": map[string]interface{}{"command": "/bin/true"},
+				"dnsWait":     30,
+				"renewBefore": 14,
+				"wildcard":    true,
+			},
+		}, {
+			in:      "https://acme.test/dir",
+			errCode: ErrConfigBadStructure,
+		}, {
+			in:      map[string]interface{}{"directory": "https://acme.test/dir", "certDir": "/tmp"},
+			errCode: ErrConfigBadACME,
+		}, {
+			in: map[string]interface{}{"directory": "https://acme.test/dir", "certDir": "/tmp",
+				"accountKey": "/tmp/key", "challenge": "tls-alpn-01"},
+			errCode: ErrConfigBadACME,
+		}, {
+			in: map[string]interface{}{"directory": "https://acme.test/dir", "certDir": "/tmp",
+				"accountKey": "/tmp/key", "challenge": ChallengeHTTP, "wildcard": true},
+			errCode: ErrConfigBadACME,
+		}, {
+			in: map[string]interface{}{"directory": "https://acme.test/dir", "certDir": "/tmp",
+				"accountKey": "/tmp/key", "challenge": ChallengeDNS, "dnsProvider": "nope"},
+			errCode: ErrConfigBadACME,
+		}, {
+			in: map[string]interface{}{"directory": "https://acme.test/dir", "certDir": "/tmp",
+				"accountKey": "/tmp/key", "renewBefore": float64(-1)},
+			errCode: ErrConfigBadACME,
+		},
+	}
+
+	for id, test := range testData {
+		locErr := validateConfigACME(test.in)
+		if test.errCode != 0 {
+			assert.ErrorIs(t, locErr, test.errCode, "test %d - wrong error", id)
+			continue
+		}
+		assert.Nil(t, locErr, "test %d - unexpected error - %v", id, locErr)
+		assert.Equal(t, test.out, test.in, "test %d - wrong settings", id)
+	}
+}
+
+func TestLoadConfig_acme(t *testing.T) {
+	DefaultTemplates = os.DirFS("..")
+	defer func() { DefaultTemplates = nil }()
+	dir := t.TempDir()
+
+	c := map[string]interface{}{
+		"baseURL":  "proxy.com",
+		"confPath": dir,
+		"listen":   []interface{}{"localhost:8080"},
+		// certificates are issued while the request waits
+		"writeTimeout": 240,
+		"acme": map[string]interface{}{
+			"directory":  "https://acme.test/dir",
+			"accountKey": filepath.Join(dir, "account.key"),
+			"certDir":    filepath.Join(dir, "certs"),
+		},
+		"handler": []interface{}{
+			map[string]interface{}{"handlerType": "form", "handlerRoute": "/submit/"},
+			map[string]interface{}{"handlerType": "acme", "handlerRoute": ChallengePath},
+		},
+	}
+	assert.Nil(t, validateConfig(&c), "acme config should be valid")
+	server, locErr := loadConfig(&c)
+	if !assert.Nil(t, locErr, "acme config should load - %v", locErr) {
+		return
+	}
+	if assert.NotNil(t, server.Handlers[0].certs, "the form should get certificates") {
+		assert.Equal(t, "proxy.com", server.Handlers[0].certs.baseURL, "wrong baseURL")
+	}
+	assert.Nil(t, server.Handlers[1].certs, "the challenge handler makes no proxies")
+	_, err := os.Stat(filepath.Join(dir, "account.key"))
+	assert.NoError(t, err, "the account key should be made")
+
+	// the challenge handler answers from the route
+	httpSolver{}.present("abcdefgh.proxy.com", "known", "known.thumbprint")
+	defer httpSolver{}.cleanUp("abcdefgh.proxy.com", "known", "known.thumbprint")
+	mux := CreateMux(context.Background(), server.Handlers[1:], slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", ChallengePath+"known", nil))
+	assert.Equal(t, "known.thumbprint", w.Body.String(), "the challenge should be answered")
+}
+
+func TestConfWrite_certsIssuedOnce(t *testing.T) {
+	standIn := newACMEStandIn(t)
+	defer standIn.server.Close()
+	m := testCertManager(t, standIn)
+	testConfig := HandlerConfig{
+		baseURL:      "proxy.com",
+		confPath:     t.TempDir(),
+		confExt:      "conf",
+		confTempl:    template.Must(template.New("testing").Parse("{{ .CertFile }}")),
+		subdomainLen: 1,
+		certs:        m,
+	}
+
+	// two in three names are taken, by a config or by another certificate
+	taken := make(map[string]bool)
+	for id, c := range SubdomainChars {
+		name := string(c) + ".proxy.com"
+		switch id % 3 {
+		case 1:
+			assert.Nil(t, ioutil.WriteFile(testConfig.confOutputs()[0].fileName(name), nil, 0644))
+			taken[name] = true
+		case 2:
+			assert.Nil(t, ioutil.WriteFile(filepath.Join(m.certDir, name+CertExt), nil, 0644))
+			taken[name] = true
+		}
+	}
+	for i := 0; i < 3; i++ {
+		out, locErr := confWrite(testConfig)(siteParams{IntHost: "domain.com"})
+		if assert.Nil(t, locErr, "should find a free name - %v", locErr) {
+			assert.False(t, taken[out.ExtHost], "%s was already taken", out.ExtHost)
+			taken[out.ExtHost] = true
+		}
+	}
+	assert.Equal(t, 3, standIn.issued, "only the names used should get a certificate")
+	before, _ := filepath.Glob(filepath.Join(m.certDir, "*"+CertExt))
+
+	// a config that does not render never gets a certificate
+	testConfig.confPath = t.TempDir()
+	testConfig.subdomainLen = 8
+	testConfig.confTempl = template.Must(template.New("testing").Funcs(templateFuncs).Parse(
+		`{{ fail "no" }}`))
+	_, locErr := confWrite(testConfig)(siteParams{IntHost: "domain.com"})
+	assert.ErrorIs(t, locErr, ErrRenderTemplate, "the template should fail")
+	assert.Equal(t, 3, standIn.issued, "nothing should be issued for a config that failed")
+	after, _ := filepath.Glob(filepath.Join(m.certDir, "*"+CertExt))
+	assert.Equal(t, before, after, "the reservation should be given up")
+}
+
+func TestCertManager_start(t *testing.T) {
+	standIn := newACMEStandIn(t)
+	defer standIn.server.Close()
+	m := testCertManager(t, standIn)
+
+	standIn.validity = 24 * time.Hour
+	certFile, _, err := m.certFor("gone.proxy.com")
+	assert.NoError(t, err, "should get a certificate")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.start(ctx, []confOutput{{confPath: t.TempDir(), confExt: "conf"}},
+		slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+	defer cancel()
+
+	for i := 0; i < 50; i++ {
+		if _, err = os.Stat(certFile); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, errors.Is(err, os.ErrNotExist), "the renewal should run as soon as it starts")
+}
+
+func TestDecodeACME_shared(t *testing.T) {
+	dir := t.TempDir()
+	acme := map[string]interface{}{
+		"directory":  "https://acme.example.com/directory",
+		"accountKey": filepath.Join(dir, "account.key"),
+		"certDir":    filepath.Join(dir, "certs"),
+		"challenge":  ChallengeHTTP,
+	}
+
+	first, err := decodeACME(acme, "proxy.com")
+	if !assert.Nil(t, err, "should load - %v", err) {
+		return
+	}
+	second, err := decodeACME(acme, "proxy.com")
+	assert.Nil(t, err, "should load again - %v", err)
+	assert.True(t, first == second, "handlers sharing a certDir should share a manager")
+
+	_, err = decodeACME(acme, "other.com")
+	assert.ErrorIs(t, err, ErrConfigBadACME, "a certDir cannot be shared across baseURLs")
+
+	acme["certDir"] = filepath.Join(dir, "others")
+	third, err := decodeACME(acme, "other.com")
+	assert.Nil(t, err, "should load with its own certDir - %v", err)
+	assert.False(t, first == third, "a different certDir should get its own manager")
+}
+
+func TestCertManager_lockName(t *testing.T) {
+	m := &certManager{}
+	unlockFirst := m.lockName("first.proxy.com")
+
+	done := make(chan bool)
+	go func() {
+		m.lockName("second.proxy.com")()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("another certificate should not wait on the first")
+	}
+
+	go func() {
+		m.lockName("first.proxy.com")()
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatal("the same certificate should wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockFirst()
+	<-done
+
+	m.Lock()
+	assert.Empty(t, m.issuing, "locks nobody holds should be forgotten")
+	m.Unlock()
+}
+
+func TestCheckIssueTimeouts(t *testing.T) {
+	m := &certManager{client: &acmeClient{pollTimeout: ACMEPollTimeout}, solver: httpSolver{}}
+	server := ServerConfig{
+		Listens:  []ListenConfig{{Addr: "127.0.0.1:8080", WriteTimeout: ConnTimeout}},
+		Handlers: []HandlerConfig{{handlerType: "json", certs: m}},
+	}
+	assert.ErrorIs(t, checkIssueTimeouts(server), ErrConfigBadACME,
+		"a request should not time out while its certificate is issued")
+
+	server.Listens[0].WriteTimeout = 2 * ACMEPollTimeout
+	assert.Nil(t, checkIssueTimeouts(server), "the timeout is long enough")
+
+	m.solver = dnsSolver{wait: time.Minute}
+	assert.ErrorIs(t, checkIssueTimeouts(server), ErrConfigBadACME, "waiting on DNS takes time too")
+
+	m.wildcard = true
+	assert.Nil(t, checkIssueTimeouts(server), "the wildcard certificate is not issued per request")
+
+	m.wildcard = false
+	server.Listens[0].WriteTimeout = 0
+	assert.Nil(t, checkIssueTimeouts(server), "no timeout is always long enough")
+}
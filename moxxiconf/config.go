@@ -4,27 +4,29 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
-	"text/template"
+	"time"
 )
 
-func LoadConfig() ([]string, string, string, []HandlerConfig, Err) {
+func LoadConfig() (ServerConfig, Err) {
 	config, err := prepConfig()
 	if err != nil {
-		return nil, "", "", []HandlerConfig{}, err
+		return ServerConfig{}, err
 	}
 
 	if err = validateConfig(config); err != nil {
-		return nil, "", "", []HandlerConfig{}, err
+		return ServerConfig{}, err
 	}
 
-	listens, accessLog, errorLog, handlers, err := loadConfig(config)
+	server, err := loadConfig(config)
 	if err != nil {
-		return nil, "", "", []HandlerConfig{}, err
+		return ServerConfig{}, err
 	}
 
-	return listens, accessLog, errorLog, handlers, nil
+	return server, nil
 }
 
 func prepConfig() (*map[string]interface{}, Err) {
@@ -62,17 +64,31 @@ ValidConfig:
 	}
 
 	if _, ok := c["listen"]; !ok {
-		c["listen"] = []string{"localhost:8080"}
+		c["listen"] = []interface{}{"localhost:8080"}
+	}
+
+	if _, ok := c["handler"]; !ok {
+		c["handler"] = defaultHandlers()
 	}
 
 	return &c, nil
 }
 
+// defaultHandlers are used when the config does not list any - the form to
+// fill out, what it submits to, and somewhere to send JSON
+func defaultHandlers() []interface{} {
+	return []interface{}{
+		map[string]interface{}{"handlerType": "static", "handlerRoute": "/"},
+		map[string]interface{}{"handlerType": "form", "handlerRoute": "/submit/"},
+		map[string]interface{}{"handlerType": "json", "handlerRoute": "/json/"},
+	}
+}
+
 func validateConfig(dirtyConfig *map[string]interface{}) Err {
 	c := *dirtyConfig
 
 	// clean up array top level lines
-	for _, part := range []string{"listen", "exclude"} {
+	for _, part := range []string{"exclude"} {
 		if _, ok := c[part]; ok {
 			chkArray, ok := c[part].([]interface{})
 			if !ok {
@@ -93,6 +109,35 @@ func validateConfig(dirtyConfig *map[string]interface{}) Err {
 		}
 	}
 
+	// timeouts given at the top level are defaults for every listener
+	for _, part := range listenTimeouts {
+		if _, ok := c[part]; ok {
+			switch c[part].(type) {
+			case int:
+			case float64:
+				c[part] = int(c[part].(float64))
+			default:
+				return NewErr{
+					Code:    ErrConfigBadStructure,
+					value:   part,
+					deepErr: fmt.Errorf("wrong type %T - %#v", c[part], c[part]),
+				}
+			}
+		}
+	}
+
+	// the listen lines can be a single entry or an array
+	if _, ok := c["listen"].([]interface{}); !ok {
+		c["listen"] = []interface{}{c["listen"]}
+	}
+
+	for id := range c["listen"].([]interface{}) {
+		locErr := validateConfigListen(&c, id)
+		if locErr != nil {
+			return locErr
+		}
+	}
+
 	// check that the following things are strings in the top level
 	for _, part := range []string{
 		"baseURL",
@@ -103,6 +148,13 @@ func validateConfig(dirtyConfig *map[string]interface{}) Err {
 		"ipFile",
 		"accessLog",
 		"errorLog",
+		"logFormat",
+		"logLevel",
+		"auditLog",
+		"identityHeader",
+		"messageDir",
+		"traceUserAgent",
+		"probe",
 	} {
 		if _, ok := c[part]; ok {
 			if _, ok := c[part].(string); !ok {
@@ -129,12 +181,46 @@ func validateConfig(dirtyConfig *map[string]interface{}) Err {
 		}
 	}
 
-	if _, ok := c["redirectTracing"]; ok {
-		if _, ok = c["redirectTracing"].(bool); !ok {
+	for _, part := range []string{"redirectTracing", "async",
+		"traceGetFallback", "traceCrossDomain", "traceVerifyTLS"} {
+		if _, ok := c[part]; ok {
+			if _, ok = c[part].(bool); !ok {
+				return NewErr{
+					Code:    ErrConfigBadStructure,
+					value:   part,
+					deepErr: fmt.Errorf("%T - %#v", c[part], c[part]),
+				}
+			}
+		}
+	}
+
+	for _, part := range handlerLimits {
+		if _, ok := c[part]; ok {
+			switch c[part].(type) {
+			case int:
+			case float64:
+				c[part] = int(c[part].(float64))
+			default:
+				return NewErr{
+					Code:    ErrConfigBadStructure,
+					value:   part,
+					deepErr: fmt.Errorf("wrong type %T - %#v", c[part], c[part]),
+				}
+			}
+		}
+	}
+
+	if _, ok := c["jobRetention"]; ok {
+		switch c["jobRetention"].(type) {
+		case int:
+		case float64:
+			c["jobRetention"] = int(c["jobRetention"].(float64))
+		default:
 			return NewErr{
-				Code:    ErrConfigBadStructure,
-				value:   "redirectTracing",
-				deepErr: fmt.Errorf("%T - %#v", c["redirectTracing"], c["redirectTracing"]),
+				Code:  ErrConfigBadStructure,
+				value: "jobRetention",
+				deepErr: fmt.Errorf("wrong type %T - %#v",
+					c["jobRetention"], c["jobRetention"]),
 			}
 		}
 	}
@@ -161,6 +247,126 @@ func validateConfig(dirtyConfig *map[string]interface{}) Err {
 	return nil
 }
 
+// listenTimeouts are the timeouts (in seconds) that can be set per listener
+var listenTimeouts = []string{
+	"readTimeout",
+	"writeTimeout",
+	"idleTimeout",
+	"shutdownTimeout",
+}
+
+// the handler limits that are whole numbers - all propagated to handlers
+var handlerLimits = []string{
+	"traceTimeout",
+	"traceMaxHops",
+	"probeTimeout",
+}
+
+func validateConfigListen(pConfig *map[string]interface{}, id int) Err {
+
+	// unpack everything
+	c := *pConfig
+	var allListens []interface{}
+	var l map[string]interface{}
+	var ok bool
+
+	if allListens, ok = c["listen"].([]interface{}); !ok {
+		return NewErr{
+			Code:  ErrConfigBadStructure,
+			value: "listen",
+		}
+	}
+
+	// a plain string is just the address
+	switch each := allListens[id].(type) {
+	case string:
+		l = map[string]interface{}{"address": each}
+	case map[string]interface{}:
+		l = each
+	default:
+		return NewErr{
+			Code:    ErrConfigBadStructure,
+			value:   "listen",
+			deepErr: fmt.Errorf("%T - %#v", allListens[id], allListens[id]),
+		}
+	}
+
+	if addr, ok := l["address"].(string); !ok || addr == "" {
+		return NewErr{
+			Code:    ErrConfigBadStructure,
+			value:   "listen address",
+			deepErr: fmt.Errorf("%T - %#v", l["address"], l["address"]),
+		}
+	}
+
+	for _, part := range []string{"certFile", "keyFile"} {
+		if _, ok := l[part]; ok {
+			if _, ok := l[part].(string); !ok {
+				return NewErr{
+					Code:    ErrConfigBadStructure,
+					value:   "listen " + part,
+					deepErr: fmt.Errorf("%T - %#v", l[part], l[part]),
+				}
+			}
+		} else {
+			l[part] = ""
+		}
+	}
+
+	if _, ok := l["socketMode"]; ok {
+		mode, ok := l["socketMode"].(string)
+		if !ok {
+			return NewErr{
+				Code:    ErrConfigBadStructure,
+				value:   "listen socketMode",
+				deepErr: fmt.Errorf("%T - %#v", l["socketMode"], l["socketMode"]),
+			}
+		}
+		if _, err := strconv.ParseUint(mode, 8, 32); err != nil {
+			return NewErr{
+				Code:    ErrConfigBadValue,
+				value:   "listen socketMode",
+				deepErr: err,
+			}
+		}
+	}
+
+	if (l["certFile"] == "") != (l["keyFile"] == "") {
+		return NewErr{
+			Code:    ErrConfigBadValue,
+			value:   "listen " + l["address"].(string),
+			deepErr: fmt.Errorf("certFile and keyFile must be given together"),
+		}
+	}
+
+	for _, part := range listenTimeouts {
+		if _, ok := l[part]; ok {
+			switch l[part].(type) {
+			case int:
+			case float64:
+				l[part] = int(l[part].(float64))
+			default:
+				return NewErr{
+					Code:  ErrConfigBadStructure,
+					value: "listen " + part,
+					deepErr: fmt.Errorf("listen portion wrong type %T - %#v",
+						l[part], l[part]),
+				}
+			}
+		} else {
+			if _, ok := c[part]; ok {
+				l[part] = c[part]
+			}
+		}
+	}
+
+	// pack things back in
+	allListens[id] = l
+	c["listen"] = allListens
+	pConfig = &c
+	return nil
+}
+
 func validateConfigHandler(pConfig *map[string]interface{}, id int) Err {
 
 	// unpack everything
@@ -186,6 +392,11 @@ func validateConfigHandler(pConfig *map[string]interface{}, id int) Err {
 	case "static":
 	case "form":
 	case "json":
+	case "metrics":
+	case "health":
+	case "audit":
+	case "errors":
+	case "acme":
 	default:
 		return NewErr{
 			Code:  ErrConfigBadStructure,
@@ -231,6 +442,11 @@ func validateConfigHandler(pConfig *map[string]interface{}, id int) Err {
 		"confFile",
 		"resFile",
 		"ipFile",
+		"auditLog",
+		"identityHeader",
+		"messageDir",
+		"traceUserAgent",
+		"probe",
 	} {
 		if _, ok := h[part]; ok {
 			if _, ok := h[part].(string); !ok {
@@ -249,6 +465,16 @@ func validateConfigHandler(pConfig *map[string]interface{}, id int) Err {
 		}
 	}
 
+	switch h["probe"] {
+	case "", ProbeOff, ProbeWarn, ProbeReject:
+	default:
+		return NewErr{
+			Code:    ErrConfigBadValue,
+			value:   "probe",
+			deepErr: fmt.Errorf("must be %s, %s or %s - not %q", ProbeOff, ProbeWarn, ProbeReject, h["probe"]),
+		}
+	}
+
 	if _, ok = h["subdomainLen"]; ok {
 		switch h["subdomainLen"].(type) {
 		case int:
@@ -273,17 +499,146 @@ func validateConfigHandler(pConfig *map[string]interface{}, id int) Err {
 		}
 	}
 
-	if _, ok = h["redirectTracing"]; ok {
-		if _, ok = h["redirectTracing"].(bool); !ok {
+	for _, part := range []string{"redirectTracing", "async",
+		"traceGetFallback", "traceCrossDomain", "traceVerifyTLS"} {
+		if _, ok = h[part]; ok {
+			if _, ok = h[part].(bool); !ok {
+				return NewErr{
+					Code:    ErrConfigBadStructure,
+					value:   part,
+					deepErr: fmt.Errorf("%T - %#v", h[part], h[part]),
+				}
+			}
+		} else {
+			if _, ok := c[part]; ok {
+				h[part] = c[part]
+			}
+		}
+	}
+
+	for _, part := range handlerLimits {
+		if _, ok = h[part]; ok {
+			switch h[part].(type) {
+			case int:
+			case float64:
+				h[part] = int(h[part].(float64))
+			default:
+				return NewErr{
+					Code:    ErrConfigBadStructure,
+					value:   part,
+					deepErr: fmt.Errorf("handler portion wrong type %T - %#v", h[part], h[part]),
+				}
+			}
+			if h[part].(int) < 0 {
+				return NewErr{
+					Code:    ErrConfigBadValue,
+					value:   part,
+					deepErr: fmt.Errorf("cannot be negative"),
+				}
+			}
+		} else if _, ok := c[part]; ok {
+			h[part] = c[part]
+		}
+	}
+
+	if _, ok = h["jobRetention"]; ok {
+		switch h["jobRetention"].(type) {
+		case int:
+		case float64:
+			h["jobRetention"] = int(h["jobRetention"].(float64))
+		default:
 			return NewErr{
-				Code:    ErrConfigBadStructure,
-				value:   "redirectTracing",
-				deepErr: fmt.Errorf("%T - %#v", c["redirectTracing"], c["redirectTracing"]),
+				Code:  ErrConfigBadStructure,
+				value: "jobRetention",
+				deepErr: fmt.Errorf("handler portion wrong type %T - %#v",
+					h["jobRetention"], h["jobRetention"]),
 			}
 		}
 	} else {
-		if _, ok := c["redirectTracing"]; ok {
-			h["redirectTracing"] = c["redirectTracing"]
+		if _, ok := c["jobRetention"]; ok {
+			h["jobRetention"] = c["jobRetention"]
+		}
+	}
+
+	if _, ok = h["minFreeSpace"]; ok {
+		switch h["minFreeSpace"].(type) {
+		case int:
+		case float64:
+			h["minFreeSpace"] = int(h["minFreeSpace"].(float64))
+		default:
+			return NewErr{
+				Code:  ErrConfigBadStructure,
+				value: "minFreeSpace",
+				deepErr: fmt.Errorf("handler portion wrong type %T - %#v",
+					h["minFreeSpace"], h["minFreeSpace"]),
+			}
+		}
+		if h["minFreeSpace"].(int) < 0 {
+			h["minFreeSpace"] = 0
+		}
+	}
+
+	if _, ok = h["nginxTest"]; ok {
+		if _, ok = h["nginxTest"].(string); !ok {
+			return NewErr{
+				Code:    ErrConfigBadStructure,
+				value:   "nginxTest",
+				deepErr: fmt.Errorf("%T - %#v", h["nginxTest"], h["nginxTest"]),
+			}
+		}
+	}
+
+	if _, ok = h["auditToken"]; ok {
+		if _, ok = h["auditToken"].(string); !ok {
+			return NewErr{
+				Code:    ErrConfigBadStructure,
+				value:   "auditToken",
+				deepErr: fmt.Errorf("%T", h["auditToken"]),
+			}
+		}
+	}
+
+	if _, ok = h["outputs"]; !ok {
+		if _, ok := c["outputs"]; ok {
+			h["outputs"] = c["outputs"]
+		}
+	}
+	if _, ok = h["outputs"]; ok {
+		if locErr := validateConfigOutputs(h); locErr != nil {
+			return locErr
+		}
+	}
+
+	for _, part := range []string{"caBundles", "clientCerts"} {
+		if _, ok = h[part]; !ok {
+			if _, ok := c[part]; ok {
+				h[part] = c[part]
+			}
+		}
+	}
+	if locErr := validateConfigUpstream(h); locErr != nil {
+		return locErr
+	}
+
+	for _, part := range []string{"substitutions", "substituteTypes"} {
+		if _, ok = h[part]; !ok {
+			if _, ok := c[part]; ok {
+				h[part] = c[part]
+			}
+		}
+	}
+	if locErr := validateConfigSubstitutions(h); locErr != nil {
+		return locErr
+	}
+
+	if _, ok = h["acme"]; !ok {
+		if _, ok := c["acme"]; ok {
+			h["acme"] = c["acme"]
+		}
+	}
+	if _, ok = h["acme"]; ok {
+		if locErr := validateConfigACME(h["acme"]); locErr != nil {
+			return locErr
 		}
 	}
 
@@ -294,46 +649,299 @@ func validateConfigHandler(pConfig *map[string]interface{}, id int) Err {
 	return nil
 }
 
-func loadConfig(pConfig *map[string]interface{}) (
-	[]string, string, string, []HandlerConfig, Err) {
+// validateConfigOutputs checks the list of config files to write for each proxy
+// an output without a confPath or confExt uses the one from the handler
+func validateConfigOutputs(h map[string]interface{}) Err {
+	raw, ok := h["outputs"].([]interface{})
+	if !ok {
+		return NewErr{
+			Code:    ErrConfigBadStructure,
+			value:   "outputs",
+			deepErr: fmt.Errorf("%T - %#v", h["outputs"], h["outputs"]),
+		}
+	}
+
+	outputs := make([]interface{}, len(raw))
+	for id, each := range raw {
+		in, ok := each.(map[string]interface{})
+		if !ok {
+			return NewErr{
+				Code:    ErrConfigBadOutput,
+				value:   strconv.Itoa(id),
+				deepErr: fmt.Errorf("wrong type %T - %#v", each, each),
+			}
+		}
+
+		out := map[string]interface{}{
+			"name":     "",
+			"confPath": h["confPath"],
+			"confExt":  h["confExt"],
+		}
+		for _, part := range []string{"name", "confPath", "confExt", "confFile"} {
+			if _, ok := in[part]; !ok {
+				continue
+			}
+			if _, ok := in[part].(string); !ok {
+				return NewErr{
+					Code:    ErrConfigBadOutput,
+					value:   strconv.Itoa(id),
+					deepErr: fmt.Errorf("%s of wrong type %T", part, in[part]),
+				}
+			}
+			out[part] = in[part]
+		}
+		if file, _ := out["confFile"].(string); file == "" {
+			return NewErr{
+				Code:    ErrConfigBadOutput,
+				value:   strconv.Itoa(id),
+				deepErr: fmt.Errorf("no confFile given"),
+			}
+		}
+		if out["name"] == "" {
+			out["name"] = strconv.Itoa(id)
+		}
+		outputs[id] = out
+	}
+
+	h["outputs"] = outputs
+	return nil
+}
+
+// validateConfigUpstream checks the CA bundles and client certificates
+// offered for proxies to use with their backends
+func validateConfigUpstream(h map[string]interface{}) Err {
+	if raw, ok := h["caBundles"]; ok {
+		bundles, ok := raw.(map[string]interface{})
+		if !ok {
+			return NewErr{
+				Code:    ErrConfigBadStructure,
+				value:   "caBundles",
+				deepErr: fmt.Errorf("%T - %#v", raw, raw),
+			}
+		}
+		for name, file := range bundles {
+			if file, ok := file.(string); !ok || file == "" {
+				return NewErr{
+					Code:    ErrConfigBadValue,
+					value:   "caBundles " + name,
+					deepErr: fmt.Errorf("must be the path to a file"),
+				}
+			}
+		}
+	}
+
+	if raw, ok := h["clientCerts"]; ok {
+		certs, ok := raw.(map[string]interface{})
+		if !ok {
+			return NewErr{
+				Code:    ErrConfigBadStructure,
+				value:   "clientCerts",
+				deepErr: fmt.Errorf("%T - %#v", raw, raw),
+			}
+		}
+		for name, cert := range certs {
+			cert, ok := cert.(map[string]interface{})
+			if !ok {
+				return NewErr{
+					Code:    ErrConfigBadStructure,
+					value:   "clientCerts " + name,
+					deepErr: fmt.Errorf("must have a certFile and keyFile"),
+				}
+			}
+			for _, part := range []string{"certFile", "keyFile"} {
+				if file, ok := cert[part].(string); !ok || file == "" {
+					return NewErr{
+						Code:    ErrConfigBadValue,
+						value:   "clientCerts " + name,
+						deepErr: fmt.Errorf("%s must be the path to a file", part),
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateConfigSubstitutions checks the substitutions and MIME types a
+// handler gives every site
+func validateConfigSubstitutions(h map[string]interface{}) Err {
+	if raw, ok := h["substitutions"]; ok {
+		rules, ok := raw.([]interface{})
+		if !ok {
+			return NewErr{
+				Code:    ErrConfigBadStructure,
+				value:   "substitutions",
+				deepErr: fmt.Errorf("%T - %#v", raw, raw),
+			}
+		}
+		for id, each := range rules {
+			in, ok := each.(map[string]interface{})
+			if !ok {
+				return NewErr{
+					Code:    ErrConfigBadStructure,
+					value:   "substitutions " + strconv.Itoa(id),
+					deepErr: fmt.Errorf("must have a from and to"),
+				}
+			}
+			// no to means the ExtHost
+			from, _ := in["from"].(string)
+			to, toOK := in["to"].(string)
+			if _, given := in["to"]; given && !toOK {
+				return NewErr{
+					Code:    ErrConfigBadStructure,
+					value:   "substitutions " + strconv.Itoa(id),
+					deepErr: fmt.Errorf("to must be a string"),
+				}
+			}
+			if err := checkSubstitution(substitution{From: from, To: to}); err != nil {
+				return NewErr{Code: ErrConfigBadValue, value: "substitutions " + strconv.Itoa(id), deepErr: err}
+			}
+		}
+	}
+
+	if raw, ok := h["substituteTypes"]; ok {
+		if _, ok := raw.([]interface{}); !ok {
+			raw = []interface{}{raw}
+		}
+		types := raw.([]interface{})
+		for _, each := range types {
+			mimeType, _ := each.(string)
+			if _, err := checkSubstituteType(mimeType); err != nil {
+				return NewErr{Code: ErrConfigBadValue, value: "substituteTypes", deepErr: err}
+			}
+		}
+		h["substituteTypes"] = types
+	}
+	return nil
+}
+
+// validateConfigACME checks the settings for getting certificates from ACME
+func validateConfigACME(raw interface{}) Err {
+	a, ok := raw.(map[string]interface{})
+	if !ok {
+		return NewErr{
+			Code:    ErrConfigBadStructure,
+			value:   "acme",
+			deepErr: fmt.Errorf("%T - %#v", raw, raw),
+		}
+	}
+
+	for _, part := range []string{"directory", "email", "accountKey", "certDir",
+		"challenge", "dnsProvider"} {
+		if _, ok := a[part]; !ok {
+			a[part] = ""
+		} else if _, ok := a[part].(string); !ok {
+			return NewErr{
+				Code:    ErrConfigBadACME,
+				value:   part,
+				deepErr: fmt.Errorf("wrong type %T", a[part]),
+			}
+		}
+	}
+	for _, part := range []string{"directory", "accountKey", "certDir"} {
+		if a[part] == "" {
+			return NewErr{Code: ErrConfigBadACME, value: part, deepErr: fmt.Errorf("must be given")}
+		}
+	}
+
+	if _, ok := a["wildcard"]; !ok {
+		a["wildcard"] = false
+	} else if _, ok := a["wildcard"].(bool); !ok {
+		return NewErr{Code: ErrConfigBadACME, value: "wildcard", deepErr: fmt.Errorf("wrong type %T", a["wildcard"])}
+	}
+
+	for _, part := range []string{"dnsWait", "renewBefore"} {
+		switch a[part].(type) {
+		case nil:
+			a[part] = 0
+		case int:
+		case float64:
+			a[part] = int(a[part].(float64))
+		default:
+			return NewErr{Code: ErrConfigBadACME, value: part, deepErr: fmt.Errorf("wrong type %T", a[part])}
+		}
+		if a[part].(int) < 0 {
+			return NewErr{Code: ErrConfigBadACME, value: part, deepErr: fmt.Errorf("cannot be negative")}
+		}
+	}
+
+	if _, ok := a["dnsSettings"]; !ok {
+		a["dnsSettings"] = map[string]interface{}{}
+	} else if _, ok := a["dnsSettings"].(map[string]interface{}); !ok {
+		return NewErr{Code: ErrConfigBadACME, value: "dnsSettings", deepErr: fmt.Errorf("wrong type %T", a["dnsSettings"])}
+	}
+
+	switch {
+	case a["challenge"] == "":
+		a["challenge"] = ChallengeHTTP
+		if a["wildcard"] == true {
+			a["challenge"] = ChallengeDNS
+		}
+	case a["challenge"] != ChallengeHTTP && a["challenge"] != ChallengeDNS:
+		return NewErr{
+			Code:    ErrConfigBadACME,
+			value:   "challenge",
+			deepErr: fmt.Errorf("must be %s or %s - not %q", ChallengeHTTP, ChallengeDNS, a["challenge"]),
+		}
+	}
+	if a["wildcard"] == true && a["challenge"] != ChallengeDNS {
+		return NewErr{
+			Code:    ErrConfigBadACME,
+			value:   "wildcard",
+			deepErr: fmt.Errorf("wildcard certificates can only be had with %s", ChallengeDNS),
+		}
+	}
+	if a["challenge"] == ChallengeDNS {
+		if _, ok := dnsProviders[a["dnsProvider"].(string)]; !ok {
+			return NewErr{
+				Code:    ErrConfigBadACME,
+				value:   "dnsProvider",
+				deepErr: fmt.Errorf("no DNS provider called %q", a["dnsProvider"]),
+			}
+		}
+	}
+	return nil
+}
+
+func loadConfig(pConfig *map[string]interface{}) (ServerConfig, Err) {
 
 	c := *pConfig
 	var ok bool
-	var listens []string
-	var accessLog, errorLog string
+	var server ServerConfig
 
 	if untypedListens, ok := c["listen"].([]interface{}); ok {
 		for _, each := range untypedListens {
-			if oneListen, ok := each.(string); ok {
-				listens = append(listens, oneListen)
-			} else {
-				return nil, "", "", nil, NewErr{
-					Code:    ErrConfigLoadType,
-					value:   "listen",
-					deepErr: fmt.Errorf("wrong type of %T - %#v", each, each),
-				}
+			cleanListen, err := decodeListen(each)
+			if err != nil {
+				return ServerConfig{}, err
 			}
+			server.Listens = append(server.Listens, cleanListen)
 		}
 	} else {
-		return nil, "", "", nil, NewErr{
+		return ServerConfig{}, NewErr{
 			Code:    ErrConfigLoadStructure,
 			value:   "listen",
 			deepErr: fmt.Errorf("wrong type of %T - %#v", untypedListens, untypedListens),
 		}
 	}
 
-	if accessLog, ok = c["accessLog"].(string); !ok {
-		accessLog = ""
+	if server.AccessLog, ok = c["accessLog"].(string); !ok {
+		server.AccessLog = ""
 	}
-	if errorLog, ok = c["errorLog"].(string); !ok {
-		errorLog = ""
+	if server.ErrorLog, ok = c["errorLog"].(string); !ok {
+		server.ErrorLog = ""
+	}
+	if server.LogFormat, ok = c["logFormat"].(string); !ok {
+		server.LogFormat = ""
+	}
+	if server.LogLevel, ok = c["logLevel"].(string); !ok {
+		server.LogLevel = ""
 	}
 
-	var handlers []HandlerConfig
 	var dirtyHandlers []interface{}
 
 	if dirtyHandlers, ok = c["handler"].([]interface{}); !ok {
-		return nil, "", "", nil, NewErr{
+		return ServerConfig{}, NewErr{
 			Code:    ErrConfigLoadStructure,
 			value:   "handler",
 			deepErr: fmt.Errorf("wrong type of %T", c["listen"]),
@@ -343,13 +951,121 @@ func loadConfig(pConfig *map[string]interface{}) (
 	for _, oneHandler := range dirtyHandlers {
 		cleanHandler, err := decodeHandler(oneHandler)
 		if err != nil {
-			return nil, "", "", nil, err
+			return ServerConfig{}, err
 		} else {
-			handlers = append(handlers, cleanHandler)
+			server.Handlers = append(server.Handlers, cleanHandler)
 		}
 	}
 
-	return listens, accessLog, errorLog, handlers, nil
+	if err := checkIssueTimeouts(server); err != nil {
+		return ServerConfig{}, err
+	}
+
+	return server, nil
+}
+
+// checkIssueTimeouts makes sure a proxy can get its certificate before its
+// request times out - without a wildcard certificate, every proxy's
+// certificate is issued while the request for it waits
+func checkIssueTimeouts(server ServerConfig) Err {
+	for _, h := range server.Handlers {
+		if h.certs == nil || h.certs.wildcard {
+			continue
+		}
+		for _, l := range server.Listens {
+			if l.WriteTimeout > 0 && l.WriteTimeout < h.certs.issueTimeout() {
+				return NewErr{
+					Code:  ErrConfigBadACME,
+					value: "listen writeTimeout " + l.Addr,
+					deepErr: fmt.Errorf("issuing a certificate can take up to %s - raise writeTimeout or use a wildcard certificate",
+						h.certs.issueTimeout()),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func decodeListen(dirtyListen interface{}) (ListenConfig, Err) {
+	l := ListenConfig{
+		ReadTimeout:     ConnTimeout,
+		WriteTimeout:    ConnTimeout,
+		ShutdownTimeout: DefaultShutdownTimeout,
+	}
+
+	var addressed map[string]interface{}
+	var ok bool
+
+	if addressed, ok = dirtyListen.(map[string]interface{}); !ok {
+		return ListenConfig{}, NewErr{
+			Code:    ErrConfigLoadStructure,
+			value:   "listen",
+			deepErr: fmt.Errorf("bad listen in config - %#v", dirtyListen),
+		}
+	}
+
+	if l.Addr, ok = addressed["address"].(string); !ok {
+		return ListenConfig{}, NewErr{
+			Code:  ErrConfigLoadValue,
+			value: "listen address",
+		}
+	}
+
+	if _, ok = addressed["certFile"]; ok {
+		if l.CertFile, ok = addressed["certFile"].(string); !ok {
+			return ListenConfig{}, NewErr{
+				Code:  ErrConfigLoadValue,
+				value: "listen certFile",
+			}
+		}
+	}
+	if _, ok = addressed["keyFile"]; ok {
+		if l.KeyFile, ok = addressed["keyFile"].(string); !ok {
+			return ListenConfig{}, NewErr{
+				Code:  ErrConfigLoadValue,
+				value: "listen keyFile",
+			}
+		}
+	}
+
+	if _, ok = addressed["socketMode"]; ok {
+		mode, ok := addressed["socketMode"].(string)
+		if !ok {
+			return ListenConfig{}, NewErr{
+				Code:  ErrConfigLoadValue,
+				value: "listen socketMode",
+			}
+		}
+		parsed, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return ListenConfig{}, NewErr{
+				Code:    ErrConfigLoadType,
+				value:   "listen socketMode",
+				deepErr: err,
+			}
+		}
+		l.SocketMode = os.FileMode(parsed)
+	}
+
+	for part, target := range map[string]*time.Duration{
+		"readTimeout":     &l.ReadTimeout,
+		"writeTimeout":    &l.WriteTimeout,
+		"idleTimeout":     &l.IdleTimeout,
+		"shutdownTimeout": &l.ShutdownTimeout,
+	} {
+		if _, ok = addressed[part]; ok {
+			if seconds, ok := addressed[part].(int); !ok {
+				return ListenConfig{}, NewErr{
+					Code:  ErrConfigLoadValue,
+					value: "listen " + part,
+				}
+			} else {
+				*target = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	return l, nil
 }
 
 func decodeHandler(dirtyHandler interface{}) (HandlerConfig, Err) {
@@ -435,6 +1151,129 @@ func decodeHandler(dirtyHandler interface{}) (HandlerConfig, Err) {
 		}
 	}
 
+	var traceErr Err
+	if h.trace, traceErr = decodeTracePolicy(addressed); traceErr != nil {
+		return HandlerConfig{}, traceErr
+	}
+
+	if _, ok = addressed["probe"]; ok {
+		if h.probe.mode, ok = addressed["probe"].(string); !ok {
+			return HandlerConfig{}, NewErr{Code: ErrConfigLoadValue, value: "probe"}
+		}
+	}
+	if _, ok = addressed["probeTimeout"]; ok {
+		seconds, ok := addressed["probeTimeout"].(int)
+		if !ok {
+			return HandlerConfig{}, NewErr{Code: ErrConfigLoadValue, value: "probeTimeout"}
+		}
+		h.probe.timeout = time.Duration(seconds) * time.Second
+	}
+
+	if _, ok = addressed["async"]; ok {
+		if h.async, ok = addressed["async"].(bool); !ok {
+			return HandlerConfig{}, NewErr{
+				Code:  ErrConfigLoadValue,
+				value: "async",
+			}
+		}
+	}
+
+	if _, ok = addressed["jobRetention"]; ok {
+		if seconds, ok := addressed["jobRetention"].(int); !ok {
+			return HandlerConfig{}, NewErr{
+				Code:  ErrConfigLoadValue,
+				value: "jobRetention",
+			}
+		} else {
+			h.jobRetention = time.Duration(seconds) * time.Second
+		}
+	}
+
+	if _, ok = addressed["minFreeSpace"]; ok {
+		if megabytes, ok := addressed["minFreeSpace"].(int); !ok {
+			return HandlerConfig{}, NewErr{
+				Code:  ErrConfigLoadValue,
+				value: "minFreeSpace",
+			}
+		} else {
+			h.minFreeSpace = uint64(megabytes) << 20
+		}
+	}
+
+	if _, ok = addressed["nginxTest"]; ok {
+		if command, ok := addressed["nginxTest"].(string); !ok {
+			return HandlerConfig{}, NewErr{
+				Code:  ErrConfigLoadValue,
+				value: "nginxTest",
+			}
+		} else {
+			h.nginxTest = strings.Fields(command)
+		}
+	}
+
+	if _, ok = addressed["identityHeader"]; ok {
+		if h.identityHeader, ok = addressed["identityHeader"].(string); !ok {
+			return HandlerConfig{}, NewErr{
+				Code:  ErrConfigLoadValue,
+				value: "identityHeader",
+			}
+		}
+	}
+
+	if _, ok = addressed["messageDir"]; ok {
+		if h.messageDir, ok = addressed["messageDir"].(string); !ok {
+			return HandlerConfig{}, NewErr{
+				Code:  ErrConfigLoadValue,
+				value: "messageDir",
+			}
+		}
+		if h.messageDir != "" {
+			var msgErr Err
+			if h.messages, msgErr = loadMessages(h.messageDir); msgErr != nil {
+				return HandlerConfig{}, msgErr
+			}
+		}
+	}
+
+	// only handlers that create proxies need the templates and ip list
+	templated := h.handlerType == "form" || h.handlerType == "json"
+
+	if _, ok = addressed["auditLog"]; ok {
+		if h.auditLog, ok = addressed["auditLog"].(string); !ok {
+			return HandlerConfig{}, NewErr{
+				Code:  ErrConfigLoadValue,
+				value: "auditLog",
+			}
+		}
+		if h.auditLog != "" && templated {
+			var auditErr Err
+			if h.audit, auditErr = openAuditLog(h.auditLog); auditErr != nil {
+				return HandlerConfig{}, auditErr
+			}
+		}
+	}
+	if h.handlerType == "audit" && h.auditLog == "" {
+		return HandlerConfig{}, NewErr{
+			Code:  ErrConfigLoadValue,
+			value: "auditLog",
+		}
+	}
+
+	if _, ok = addressed["auditToken"]; ok {
+		if h.auditToken, ok = addressed["auditToken"].(string); !ok {
+			return HandlerConfig{}, NewErr{
+				Code:  ErrConfigLoadValue,
+				value: "auditToken",
+			}
+		}
+	}
+	if h.handlerType == "audit" && h.auditToken == "" {
+		return HandlerConfig{}, NewErr{
+			Code:  ErrConfigLoadValue,
+			value: "auditToken",
+		}
+	}
+
 	var err error
 	if _, ok = addressed["confFile"]; ok {
 		if workFile, ok := addressed["confFile"].(string); !ok {
@@ -443,8 +1282,9 @@ func decodeHandler(dirtyHandler interface{}) (HandlerConfig, Err) {
 				value:   "confFile",
 				deepErr: fmt.Errorf("%#v", addressed["confFile"]),
 			}
-		} else if addressed["handlerType"] != "static" {
-			h.confTempl, err = template.ParseFiles(workFile)
+		} else if templated && workFile != "" {
+			h.confFile = workFile
+			h.confTempl, err = parseTemplate(workFile)
 			if err != nil {
 				return HandlerConfig{}, NewErr{
 					Code:    ErrConfigLoadTemplate,
@@ -454,14 +1294,21 @@ func decodeHandler(dirtyHandler interface{}) (HandlerConfig, Err) {
 			}
 		}
 	}
+	if _, ok = addressed["outputs"]; ok && templated {
+		var outErr Err
+		if h.outputs, outErr = decodeOutputs(addressed["outputs"]); outErr != nil {
+			return HandlerConfig{}, outErr
+		}
+	}
+
 	if _, ok = addressed["resFile"]; ok {
 		if workFile, ok := addressed["resFile"].(string); !ok {
 			return HandlerConfig{}, NewErr{
 				Code:  ErrConfigLoadStructure,
 				value: "resFile " + workFile,
 			}
-		} else if addressed["handlerType"] != "static" {
-			h.resTempl, err = template.ParseFiles(workFile)
+		} else if templated && workFile != "" {
+			h.resTempl, err = parseTemplate(workFile)
 			if err != nil {
 				return HandlerConfig{}, NewErr{
 					Code:    ErrConfigLoadTemplate,
@@ -469,11 +1316,47 @@ func decodeHandler(dirtyHandler interface{}) (HandlerConfig, Err) {
 					deepErr: err,
 				}
 			}
-		} else {
+		} else if h.handlerType == "static" {
 			h.resFile = workFile
 		}
 	}
 
+	// anything not given falls back to the templates built into moxxi
+	if templated && h.confTempl == nil && len(h.outputs) < 1 {
+		if h.confTempl, err = parseDefaultTemplate(DefaultConfFile); err != nil {
+			return HandlerConfig{}, NewErr{
+				Code:    ErrConfigLoadTemplate,
+				value:   "confFile",
+				deepErr: err,
+			}
+		}
+	}
+	if templated {
+		h.noBasicAuth = basicAuthUnsupported(h.confOutputs())
+	}
+	if templated && h.resTempl == nil {
+		resFile := DefaultFormResFile
+		if h.handlerType == "json" {
+			resFile = DefaultJSONResFile
+		}
+		if h.resTempl, err = parseDefaultTemplate(resFile); err != nil {
+			return HandlerConfig{}, NewErr{
+				Code:    ErrConfigLoadTemplate,
+				value:   "resFile",
+				deepErr: err,
+			}
+		}
+	}
+	if h.handlerType == "json" {
+		if tStart, tBody, tEnd := splitResTempl(h.resTempl); tStart == nil || tBody == nil || tEnd == nil {
+			return HandlerConfig{}, NewErr{
+				Code:    ErrConfigLoadTemplate,
+				value:   "resFile",
+				deepErr: fmt.Errorf("json handlers need start, body and end templates"),
+			}
+		}
+	}
+
 	if _, ok = addressed["ipFile"]; ok {
 		if workFile, ok := addressed["ipFile"].(string); !ok {
 			return HandlerConfig{}, NewErr{
@@ -481,8 +1364,9 @@ func decodeHandler(dirtyHandler interface{}) (HandlerConfig, Err) {
 				value: "ipFile " + workFile,
 			}
 		} else if addressed["ipFile"].(string) == "" {
-		} else if addressed["handlerType"] != "static" {
+		} else if templated {
 			// #TODO# fix this call?
+			h.ipFile = workFile
 			h.ipList, err = parseIPList(workFile)
 			if err != nil {
 				return HandlerConfig{}, NewErr{
@@ -494,5 +1378,202 @@ func decodeHandler(dirtyHandler interface{}) (HandlerConfig, Err) {
 		}
 	}
 
+	if templated {
+		var upstreamErr Err
+		if h.upstream, upstreamErr = decodeUpstream(addressed); upstreamErr != nil {
+			return HandlerConfig{}, upstreamErr
+		}
+	}
+
+	h.substitute = decodeSubstitutions(addressed)
+
+	if _, ok = addressed["acme"]; ok && templated {
+		var certErr Err
+		if h.certs, certErr = decodeACME(addressed["acme"], h.baseURL); certErr != nil {
+			return HandlerConfig{}, certErr
+		}
+	}
+
 	return h, nil
 }
+
+// decodeOutputs loads the template for each validated output
+func decodeOutputs(raw interface{}) ([]confOutput, Err) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, NewErr{Code: ErrConfigLoadStructure, value: "outputs"}
+	}
+
+	var outputs []confOutput
+	for _, each := range list {
+		parts, ok := each.(map[string]interface{})
+		if !ok {
+			return nil, NewErr{Code: ErrConfigLoadStructure, value: "outputs"}
+		}
+
+		var out confOutput
+		out.name, _ = parts["name"].(string)
+		out.confPath, _ = parts["confPath"].(string)
+		out.confExt, _ = parts["confExt"].(string)
+		out.confFile, _ = parts["confFile"].(string)
+
+		var err error
+		if out.confTempl, err = parseTemplate(out.confFile); err != nil {
+			return nil, NewErr{
+				Code:    ErrConfigLoadTemplate,
+				value:   "outputs " + out.name + " " + out.confFile,
+				deepErr: err,
+			}
+		}
+		outputs = append(outputs, out)
+	}
+	return outputs, nil
+}
+
+// decodeTracePolicy picks out how the handler traces redirects
+// anything not given is left empty, and the defaults are used when tracing
+func decodeTracePolicy(addressed map[string]interface{}) (tracePolicy, Err) {
+	var policy tracePolicy
+	var ok bool
+
+	if _, ok = addressed["traceTimeout"]; ok {
+		seconds, ok := addressed["traceTimeout"].(int)
+		if !ok {
+			return tracePolicy{}, NewErr{Code: ErrConfigLoadValue, value: "traceTimeout"}
+		}
+		policy.timeout = time.Duration(seconds) * time.Second
+	}
+	if _, ok = addressed["traceMaxHops"]; ok {
+		if policy.maxHops, ok = addressed["traceMaxHops"].(int); !ok {
+			return tracePolicy{}, NewErr{Code: ErrConfigLoadValue, value: "traceMaxHops"}
+		}
+	}
+	if _, ok = addressed["traceUserAgent"]; ok {
+		if policy.userAgent, ok = addressed["traceUserAgent"].(string); !ok {
+			return tracePolicy{}, NewErr{Code: ErrConfigLoadValue, value: "traceUserAgent"}
+		}
+	}
+
+	for part, value := range map[string]*bool{
+		"traceGetFallback": &policy.getFallback,
+		"traceCrossDomain": &policy.crossDomain,
+		"traceVerifyTLS":   &policy.verifyTLS,
+	} {
+		if _, ok = addressed[part]; ok {
+			if *value, ok = addressed[part].(bool); !ok {
+				return tracePolicy{}, NewErr{Code: ErrConfigLoadValue, value: part}
+			}
+		}
+	}
+	return policy, nil
+}
+
+// decodeACME sets up the certificates for a handler from validated settings
+func decodeACME(raw interface{}, baseURL string) (*certManager, Err) {
+	a, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, NewErr{Code: ErrConfigLoadStructure, value: "acme"}
+	}
+	directory, _ := a["directory"].(string)
+	email, _ := a["email"].(string)
+	accountKey, _ := a["accountKey"].(string)
+	certDir, _ := a["certDir"].(string)
+	challenge, _ := a["challenge"].(string)
+	wildcard, _ := a["wildcard"].(bool)
+	renewDays, _ := a["renewBefore"].(int)
+
+	key, err := loadAccountKey(accountKey)
+	if err != nil {
+		return nil, NewErr{Code: ErrConfigBadACME, value: "accountKey " + accountKey, deepErr: err}
+	}
+	if err = os.MkdirAll(certDir, 0755); err != nil {
+		return nil, NewErr{Code: ErrConfigBadACME, value: "certDir " + certDir, deepErr: err}
+	}
+
+	m := &certManager{
+		client: &acmeClient{
+			directoryURL: directory,
+			email:        email,
+			key:          key,
+			client:       &http.Client{Timeout: ConnTimeout},
+			pollInterval: ACMEPollInterval,
+			pollTimeout:  ACMEPollTimeout,
+		},
+		baseURL:     baseURL,
+		certDir:     certDir,
+		challenge:   challenge,
+		solver:      httpSolver{},
+		wildcard:    wildcard,
+		renewBefore: DefaultRenewBefore,
+	}
+	if renewDays > 0 {
+		m.renewBefore = time.Duration(renewDays) * 24 * time.Hour
+	}
+
+	if challenge == ChallengeDNS {
+		name, _ := a["dnsProvider"].(string)
+		settings, _ := a["dnsSettings"].(map[string]interface{})
+		wait, _ := a["dnsWait"].(int)
+		factory, ok := dnsProviders[name]
+		if !ok {
+			return nil, NewErr{Code: ErrConfigBadACME, value: "dnsProvider", deepErr: fmt.Errorf("no DNS provider called %q", name)}
+		}
+		provider, err := factory(settings)
+		if err != nil {
+			return nil, NewErr{Code: ErrConfigBadACME, value: "dnsProvider " + name, deepErr: err}
+		}
+		m.solver = dnsSolver{provider: provider, wait: time.Duration(wait) * time.Second}
+	}
+	return sharedCertManager(m)
+}
+
+// decodeUpstream picks out the validated CA bundles and client certificates,
+// making sure every file they name is there
+func decodeUpstream(addressed map[string]interface{}) (upstreamTLS, Err) {
+	upstream := upstreamTLS{
+		caBundles:   make(map[string]string),
+		clientCerts: make(map[string]clientCert),
+	}
+
+	bundles, _ := addressed["caBundles"].(map[string]interface{})
+	for name, file := range bundles {
+		file, _ := file.(string)
+		if _, err := os.Stat(file); err != nil {
+			return upstreamTLS{}, NewErr{Code: ErrConfigBadValue, value: "caBundles " + name, deepErr: err}
+		}
+		upstream.caBundles[name] = file
+	}
+
+	certs, _ := addressed["clientCerts"].(map[string]interface{})
+	for name, raw := range certs {
+		cert, _ := raw.(map[string]interface{})
+		certFile, _ := cert["certFile"].(string)
+		keyFile, _ := cert["keyFile"].(string)
+		for _, file := range []string{certFile, keyFile} {
+			if _, err := os.Stat(file); err != nil {
+				return upstreamTLS{}, NewErr{Code: ErrConfigBadValue, value: "clientCerts " + name, deepErr: err}
+			}
+		}
+		upstream.clientCerts[name] = clientCert{certFile: certFile, keyFile: keyFile}
+	}
+	return upstream, nil
+}
+
+// decodeSubstitutions picks out the validated substitutions and MIME types
+func decodeSubstitutions(addressed map[string]interface{}) substituteDefaults {
+	var defaults substituteDefaults
+	rules, _ := addressed["substitutions"].([]interface{})
+	for _, each := range rules {
+		in, _ := each.(map[string]interface{})
+		from, _ := in["from"].(string)
+		to, _ := in["to"].(string)
+		defaults.rules = append(defaults.rules, substitution{From: from, To: to})
+	}
+	types, _ := addressed["substituteTypes"].([]interface{})
+	for _, each := range types {
+		mimeType, _ := each.(string)
+		mimeType, _ = checkSubstituteType(mimeType)
+		defaults.types = append(defaults.types, mimeType)
+	}
+	return defaults
+}
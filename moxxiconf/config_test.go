@@ -0,0 +1,269 @@
+package moxxiConf
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfigListen(t *testing.T) {
+	var testData = []struct {
+		listen  interface{}
+		top     map[string]interface{}
+		out     ListenConfig
+		errCode ErrCode
+	}{
+		{
+			listen: "localhost:8080",
+			out: ListenConfig{
+				Addr:            "localhost:8080",
+				ReadTimeout:     ConnTimeout,
+				WriteTimeout:    ConnTimeout,
+				ShutdownTimeout: DefaultShutdownTimeout,
+			},
+		}, {
+			listen: map[string]interface{}{
+				"address":     ":8443",
+				"certFile":    "/etc/moxxi/cert.pem",
+				"keyFile":     "/etc/moxxi/key.pem",
+				"readTimeout": float64(5),
+				"idleTimeout": float64(120),
+			},
+			top: map[string]interface{}{"writeTimeout": float64(60)},
+			out: ListenConfig{
+				Addr:            ":8443",
+				CertFile:        "/etc/moxxi/cert.pem",
+				KeyFile:         "/etc/moxxi/key.pem",
+				ReadTimeout:     5 * time.Second,
+				WriteTimeout:    60 * time.Second,
+				IdleTimeout:     120 * time.Second,
+				ShutdownTimeout: DefaultShutdownTimeout,
+			},
+		}, {
+			listen: map[string]interface{}{
+				"address":  ":8443",
+				"certFile": "/etc/moxxi/cert.pem",
+			},
+			errCode: ErrConfigBadValue,
+		}, {
+			listen: map[string]interface{}{
+				"address":     ":8080",
+				"readTimeout": "soon",
+			},
+			errCode: ErrConfigBadStructure,
+		}, {
+			listen: map[string]interface{}{
+				"address":    "unix:/run/moxxi.sock",
+				"socketMode": "0666",
+			},
+			out: ListenConfig{
+				Addr:            "unix:/run/moxxi.sock",
+				SocketMode:      0666,
+				ReadTimeout:     ConnTimeout,
+				WriteTimeout:    ConnTimeout,
+				ShutdownTimeout: DefaultShutdownTimeout,
+			},
+		}, {
+			listen: map[string]interface{}{
+				"address":    "unix:/run/moxxi.sock",
+				"socketMode": "rw-rw----",
+			},
+			errCode: ErrConfigBadValue,
+		}, {
+			listen:  float64(8080),
+			errCode: ErrConfigBadStructure,
+		},
+	}
+
+	for id, test := range testData {
+		c := map[string]interface{}{}
+		for k, v := range test.top {
+			c[k] = v
+		}
+		c["listen"] = []interface{}{test.listen}
+		c["handler"] = []interface{}{}
+
+		err := validateConfig(&c)
+		if test.errCode != 0 {
+			if assert.NotNil(t, err, "test %d - should have gotten an error", id) {
+				assert.Equal(t, test.errCode, err.GetCode(),
+					"test %d - got the wrong error - %v", id, err)
+			}
+			continue
+		}
+		assert.Nil(t, err, "test %d - got an error validating - %v", id, err)
+
+		out, err := decodeListen(c["listen"].([]interface{})[0])
+		assert.Nil(t, err, "test %d - got an error decoding the listen - %v", id, err)
+		assert.Equal(t, test.out, out, "test %d - got the wrong listen config", id)
+	}
+}
+
+func TestValidateConfigOutputs(t *testing.T) {
+	var testData = []struct {
+		outputs interface{}
+		out     []interface{}
+		errCode ErrCode
+	}{
+		{
+			outputs: []interface{}{
+				map[string]interface{}{
+					"name":     "nginx",
+					"confFile": "/etc/moxxi/proxy.template",
+				},
+				map[string]interface{}{
+					"confPath": "/etc/haproxy/moxxi.d",
+					"confExt":  "cfg",
+					"confFile": "/etc/moxxi/proxy.haproxy.template",
+				},
+			},
+			out: []interface{}{
+				map[string]interface{}{
+					"name":     "nginx",
+					"confPath": "/etc/nginx/proxy.d",
+					"confExt":  "conf",
+					"confFile": "/etc/moxxi/proxy.template",
+				},
+				map[string]interface{}{
+					"name":     "1",
+					"confPath": "/etc/haproxy/moxxi.d",
+					"confExt":  "cfg",
+					"confFile": "/etc/moxxi/proxy.haproxy.template",
+				},
+			},
+		}, {
+			outputs: map[string]interface{}{"confFile": "/etc/moxxi/proxy.template"},
+			errCode: ErrConfigBadStructure,
+		}, {
+			outputs: []interface{}{"/etc/moxxi/proxy.template"},
+			errCode: ErrConfigBadOutput,
+		}, {
+			outputs: []interface{}{map[string]interface{}{"name": "nginx"}},
+			errCode: ErrConfigBadOutput,
+		}, {
+			outputs: []interface{}{map[string]interface{}{"confFile": 5}},
+			errCode: ErrConfigBadOutput,
+		},
+	}
+
+	for id, test := range testData {
+		h := map[string]interface{}{
+			"confPath": "/etc/nginx/proxy.d",
+			"confExt":  "conf",
+			"outputs":  test.outputs,
+		}
+		locErr := validateConfigOutputs(h)
+		if test.errCode != 0 {
+			assert.ErrorIs(t, locErr, test.errCode, "test %d - wrong error", id)
+			continue
+		}
+		assert.Nil(t, locErr, "test %d - unexpected error - %v", id, locErr)
+		assert.Equal(t, test.out, h["outputs"], "test %d - wrong outputs", id)
+	}
+}
+
+func TestLoadConfig_defaults(t *testing.T) {
+	DefaultTemplates = os.DirFS("..")
+	defer func() { DefaultTemplates = nil }()
+
+	dir, err := ioutil.TempDir(os.TempDir(), "moxxi_test_")
+	assert.Nil(t, err, "could not make temp dir - %v", err)
+	defer os.RemoveAll(dir)
+
+	c := map[string]interface{}{
+		"baseURL":  "proxy.com",
+		"confPath": dir,
+		"confExt":  "conf",
+		"listen":   []interface{}{"localhost:8080"},
+		"handler":  defaultHandlers(),
+	}
+	locErr := validateConfig(&c)
+	assert.Nil(t, locErr, "minimal config should be valid - %v", locErr)
+	server, locErr := loadConfig(&c)
+	assert.Nil(t, locErr, "minimal config should load - %v", locErr)
+	if !assert.Len(t, server.Handlers, 3, "should get the default handlers") {
+		return
+	}
+	for _, h := range server.Handlers[1:] {
+		assert.NotNil(t, h.confTempl, "%s should have the built in confFile", h.handlerType)
+		assert.NotNil(t, h.resTempl, "%s should have the built in resFile", h.handlerType)
+	}
+
+	mux := CreateMux(context.Background(), server.Handlers, slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "form should be served")
+	assert.Contains(t, w.Body.String(), `action="/submit/"`, "should get the built in form")
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/submit/?host=domain.com&ip=10.0.0.1", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "proxy should be created - %s", w.Body.String())
+	files, _ := ioutil.ReadDir(dir)
+	if assert.Len(t, files, 1, "should write one config") {
+		contents, _ := ioutil.ReadFile(filepath.Join(dir, files[0].Name()))
+		assert.Contains(t, string(contents), "proxy_pass http://10.0.0.1:80;",
+			"should use the built in proxy.template")
+	}
+
+	// without any built in templates, the handlers cannot load
+	DefaultTemplates = nil
+	c = map[string]interface{}{
+		"baseURL":  "proxy.com",
+		"confPath": dir,
+		"listen":   []interface{}{"localhost:8080"},
+		"handler":  defaultHandlers(),
+	}
+	assert.Nil(t, validateConfig(&c), "minimal config should be valid")
+	_, locErr = loadConfig(&c)
+	assert.ErrorIs(t, locErr, ErrConfigLoadTemplate, "should fail without templates")
+}
+
+func TestLoadConfig_tracePolicy(t *testing.T) {
+	DefaultTemplates = os.DirFS("..")
+	defer func() { DefaultTemplates = nil }()
+
+	config := func(handler map[string]interface{}) map[string]interface{} {
+		handler["handlerType"] = "json"
+		handler["handlerRoute"] = "/json/"
+		return map[string]interface{}{
+			"baseURL":          "proxy.com",
+			"confPath":         os.TempDir(),
+			"listen":           []interface{}{"localhost:8080"},
+			"traceTimeout":     float64(5),
+			"traceUserAgent":   "tester/1.0",
+			"traceGetFallback": true,
+			"handler":          []interface{}{handler},
+		}
+	}
+
+	c := config(map[string]interface{}{
+		"traceMaxHops":   float64(3),
+		"traceVerifyTLS": true,
+	})
+	assert.Nil(t, validateConfig(&c), "trace options should be valid")
+	server, locErr := loadConfig(&c)
+	if assert.Nil(t, locErr, "trace options should load - %v", locErr) {
+		assert.Equal(t, tracePolicy{
+			timeout:     5 * time.Second,
+			maxHops:     3,
+			userAgent:   "tester/1.0",
+			getFallback: true,
+			verifyTLS:   true,
+		}, server.Handlers[0].trace, "should mix the top level and handler options")
+	}
+
+	c = config(map[string]interface{}{"traceMaxHops": float64(-1)})
+	assert.ErrorIs(t, validateConfig(&c), ErrConfigBadValue, "negative hops should fail")
+
+	c = config(map[string]interface{}{"traceCrossDomain": "yes"})
+	assert.ErrorIs(t, validateConfig(&c), ErrConfigBadStructure, "a string should not be a bool")
+}
@@ -0,0 +1,87 @@
+package moxxiConf
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DNSProvider publishes the TXT records that DNS-01 challenges are checked
+// against. fqdn is the full name of the record, like
+// _acme-challenge.proxy.com, and value is what the record should hold.
+type DNSProvider interface {
+	Present(fqdn, value string) error
+	CleanUp(fqdn, value string) error
+}
+
+// DNSProviderFactory makes a DNSProvider from the dnsSettings in the config
+type DNSProviderFactory func(settings map[string]interface{}) (DNSProvider, error)
+
+// dnsProviders are the DNS providers that can be named as dnsProvider
+var dnsProviders = map[string]DNSProviderFactory{
+	"exec": newExecDNSProvider,
+}
+
+// RegisterDNSProvider makes a DNS provider available to the config by name
+// it must be called before the config is loaded
+func RegisterDNSProvider(name string, factory DNSProviderFactory) {
+	dnsProviders[name] = factory
+}
+
+// execDNSProvider runs a command to change the TXT records
+// the command is run with "present" or "cleanup", then the fqdn and value
+type execDNSProvider struct {
+	command string
+}
+
+func newExecDNSProvider(settings map[string]interface{}) (DNSProvider, error) {
+	command, _ := settings["command"].(string)
+	if command == "" {
+		return nil, fmt.Errorf("the exec provider needs a command")
+	}
+	return execDNSProvider{command: command}, nil
+}
+
+func (p execDNSProvider) Present(fqdn, value string) error {
+	return p.run("present", fqdn, value)
+}
+
+func (p execDNSProvider) CleanUp(fqdn, value string) error {
+	return p.run("cleanup", fqdn, value)
+}
+
+func (p execDNSProvider) run(action, fqdn, value string) error {
+	out, err := exec.Command(p.command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed - %v - %s", p.command, action, err,
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// dnsSolver solves DNS-01 challenges through a DNSProvider
+type dnsSolver struct {
+	provider DNSProvider
+	// wait is how long to give the record to show up everywhere
+	wait time.Duration
+}
+
+// dnsRecord gives the name and value of the TXT record for a challenge
+func dnsRecord(domain, keyAuth string) (fqdn, value string) {
+	sum := sha256.Sum256([]byte(keyAuth))
+	return "_acme-challenge." + strings.TrimPrefix(domain, "*."), b64(sum[:])
+}
+
+func (s dnsSolver) present(domain, token, keyAuth string) error {
+	if err := s.provider.Present(dnsRecord(domain, keyAuth)); err != nil {
+		return err
+	}
+	time.Sleep(s.wait)
+	return nil
+}
+
+func (s dnsSolver) cleanUp(domain, token, keyAuth string) error {
+	return s.provider.CleanUp(dnsRecord(domain, keyAuth))
+}
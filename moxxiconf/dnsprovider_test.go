@@ -0,0 +1,44 @@
+package moxxiConf
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSRecord(t *testing.T) {
+	fqdn, value := dnsRecord("*.proxy.com", "token.thumbprint")
+	assert.Equal(t, "_acme-challenge.proxy.com", fqdn, "wildcards share the record of the domain")
+	// sha256 of token.thumbprint, base64 encoded
+	assert.Equal(t, "61rBZ_4knHblO0MNoxFsXZ_eTFUHum0B6IVRbhvUn5I", value, "wrong record value")
+}
+
+func TestExecDNSProvider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell")
+	}
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "calls")
+	hook := filepath.Join(dir, "hook")
+	assert.Nil(t, ioutil.WriteFile(hook,
+		[]byte("#!/bin/sh\necho \"$@\" >> "+logFile+"\n[ \"$3\" != fail ]\n"), 0755))
+
+	_, err := newExecDNSProvider(map[string]interface{}{})
+	assert.Error(t, err, "should need a command")
+
+	provider, err := newExecDNSProvider(map[string]interface{}{"command": hook})
+	if !assert.NoError(t, err, "should make the provider") {
+		return
+	}
+	assert.NoError(t, provider.Present("_acme-challenge.proxy.com", "abc"), "present should work")
+	assert.NoError(t, provider.CleanUp("_acme-challenge.proxy.com", "abc"), "cleanup should work")
+	assert.Error(t, provider.Present("_acme-challenge.proxy.com", "fail"), "a failed command should fail")
+
+	calls, _ := ioutil.ReadFile(logFile)
+	assert.Equal(t, "present _acme-challenge.proxy.com abc\n"+
+		"cleanup _acme-challenge.proxy.com abc\n"+
+		"present _acme-challenge.proxy.com fail\n", string(calls), "wrong calls")
+}
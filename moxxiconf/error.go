@@ -1,77 +1,153 @@
 package moxxiConf
 
-import "fmt"
-import "time"
-import "net/http"
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
 
 // standard merror methods within my application
 type Err interface {
 	error
-	LogError(*http.Request) string
-	GetCode() int
+	slog.LogValuer
+	GetCode() ErrCode
+	HTTPStatus() int
+	Localize(map[ErrCode]string) string
+}
+
+// ErrCode - identifies each kind of error
+// each code is also an error itself, so it can be used as the target of
+// errors.Is to check what kind of error came back
+type ErrCode int
+
+func (c ErrCode) Error() string {
+	return fmt.Sprintf("moxxi error %d", int(c))
+}
+
+// ID - the stable string identifier for the code, for clients and translations
+func (c ErrCode) ID() string {
+	if id, ok := errID[c]; ok {
+		return id
+	}
+	return "unknown"
 }
 
 // Err - the type used within my application for error handling
 type NewErr struct {
-	Code    int
-	value   string
-	deepErr error
+	Code      ErrCode
+	value     string
+	deepErr   error
+	requestID string
 }
 
+// UpgradeError - wraps any error as an Err, keeping it as is if it already is one
 func UpgradeError(e error) Err {
+	var pkgErr Err
+	if errors.As(e, &pkgErr) {
+		return pkgErr
+	}
 	return NewErr{Code: ErrUpgradedError, deepErr: e}
 }
 
 // the function `Error` to make my custom errors work
 func (e NewErr) Error() string {
+	return e.format(errMsg[e.Code])
+}
+
+// format fills the value and underlying error of the error into msg
+func (e NewErr) format(msg string) string {
 	switch {
 	case e.Code == ErrUpgradedError && e.value == "":
 		return e.deepErr.Error()
 	case e.deepErr == nil && e.value == "":
-		return errMsg[e.Code]
+		return msg
 	case e.deepErr == nil && e.value != "":
-		return fmt.Sprintf(errMsg[e.Code], e.value)
+		return fmt.Sprintf(msg, e.value)
 	case e.value == "" && e.deepErr != nil:
-		return fmt.Sprintf(errMsg[e.Code], e.deepErr)
+		return fmt.Sprintf(msg, e.deepErr)
 	default:
-		return fmt.Sprintf(errMsg[e.Code], e.value, e.deepErr)
+		return fmt.Sprintf(msg, e.value, e.deepErr)
 	}
 }
 
-func (e NewErr) GetCode() int {
+// Localize - the error message using the translated messages given, falling
+// back to the English message for anything not translated
+func (e NewErr) Localize(msgs map[ErrCode]string) string {
+	if msg, ok := msgs[e.Code]; ok {
+		return e.format(msg)
+	}
+	return e.Error()
+}
+
+func (e NewErr) GetCode() ErrCode {
 	return e.Code
 }
 
-// the function `LogError` to print error log lines
-func (e NewErr) LogError(r *http.Request) string {
-	ts := time.Now()
-	switch {
-	case e.Code == ErrUpgradedError && e.value == "":
-		return errMsg[e.Code]
-	case e.deepErr == nil && e.value == "":
-		return 	errMsg[e.Code])
-	case e.deepErr == nil && e.value != "":
-		return fmt.Sprintf("%s %s "+errMsg[e.Code],
-			r.RemoteAddr,
-			r.RequestURI,
-			e.value)
-	case e.deepErr != nil && e.value == "":
-		return fmt.Sprintf("%s %s "+errMsg[e.Code],
-			r.RemoteAddr,
-			r.RequestURI,
-			e.deepErr)
+// Unwrap - gives errors.Is and errors.As access to the underlying error
+func (e NewErr) Unwrap() error {
+	return e.deepErr
+}
+
+// Is - matches the ErrCode of the error, or another error with the same code
+func (e NewErr) Is(target error) bool {
+	switch t := target.(type) {
+	case ErrCode:
+		return e.Code == t
+	case NewErr:
+		return e.Code == t.Code
+	case *NewErr:
+		return t != nil && e.Code == t.Code
+	default:
+		return false
+	}
+}
+
+// HTTPStatus - the response code to send back to a client for this error
+func (e NewErr) HTTPStatus() int {
+	if status, ok := errStatus[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// the function `LogValue` to record the parts of the error in structured logs
+func (e NewErr) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.Int("code", int(e.Code)),
+		slog.String("id", e.Code.ID()),
+		slog.String("message", e.Error()),
+	}
+	if e.value != "" {
+		attrs = append(attrs, slog.String("value", e.value))
+	}
+	if e.deepErr != nil {
+		attrs = append(attrs, slog.String("deepError", e.deepErr.Error()))
+	}
+	if e.requestID != "" {
+		attrs = append(attrs, slog.String("requestID", e.requestID))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// tagRequest - marks the error with the ID of the request it happened in
+func tagRequest(err Err, r *http.Request) Err {
+	switch e := err.(type) {
+	case NewErr:
+		e.requestID = RequestID(r)
+		return e
+	case *NewErr:
+		tagged := *e
+		tagged.requestID = RequestID(r)
+		return &tagged
 	default:
-		return fmt.Sprintf("%s %s "+errMsg[e.Code],
-			r.RemoteAddr,
-			r.RequestURI,
-			e.value,
-			e.deepErr)
+		return err
 	}
 }
 
 // assign a unique id to each error
 const (
-	ErrUpgradedError = 1 << iota
+	ErrUpgradedError ErrCode = iota + 1
 	ErrCloseFile
 	ErrRemoveFile
 	ErrFilePerm
@@ -95,10 +171,33 @@ const (
 	ErrConfigLoadTemplate
 	ErrConfigBadIPFile
 	ErrBadHostnameTrace
+	ErrNoJob
+	ErrListen
+	ErrConfigBadAuditLog
+	ErrAuditWrite
+	ErrAuditRead
+	ErrNoAuditQuery
+	ErrConfigBadMessages
+	ErrBadHeader
+	ErrRenderTemplate
+	ErrConfigBadOutput
+	ErrBackendProbe
+	ErrTLSDetect
+	ErrACME
+	ErrConfigBadACME
+	ErrBadUpstreamTLS
+	ErrBadHeaderRule
+	ErrBadSubstitution
+	ErrBadPath
+	ErrBadAccess
+	ErrBadJSON
+	ErrBatchTooLarge
+	ErrTooManyJobs
+	ErrAuditAuth
 )
 
 // specify the error message for each error
-var errMsg = map[int]string{
+var errMsg = map[ErrCode]string{
 	ErrUpgradedError:       "not actually an error message",
 	ErrCloseFile:           "failed to close the file [%s] - %v",
 	ErrRemoveFile:          "failed to remove file [%s] - %v",
@@ -123,4 +222,102 @@ var errMsg = map[int]string{
 	ErrConfigLoadTemplate:  "bad config load at %s - %v",
 	ErrConfigBadIPFile:     "bad ip file - %s - %v",
 	ErrBadHostnameTrace:    "unable to trace out domain %s - %v",
+	ErrNoJob:               "no job found with id [%s]",
+	ErrListen:              "unable to listen on [%s] - %v",
+	ErrConfigBadAuditLog:   "bad audit log - %s - %v",
+	ErrAuditWrite:          "failed to write to the audit log [%s] - %v",
+	ErrAuditRead:           "failed to read the audit log [%s] - %v",
+	ErrNoAuditQuery:        "no extHost or intHost given to search for",
+	ErrConfigBadMessages:   "bad message file - %s - %v",
+	ErrBadHeader:           "bad header name provided [%s]",
+	ErrRenderTemplate:      "failed to render the config [%s] - %v",
+	ErrConfigBadOutput:     "bad config file - output %s - %v",
+	ErrBackendProbe:        "backend [%s] failed the pre-flight check - %v",
+	ErrTLSDetect:           "could not tell if backend [%s] speaks HTTPS - %v",
+	ErrACME:                "failed to get a certificate for [%s] - %v",
+	ErrConfigBadACME:       "bad config file - acme %s - %v",
+	ErrBadUpstreamTLS:      "bad upstream TLS setting [%s] - %v",
+	ErrBadHeaderRule:       "bad header rule provided [%s] - %v",
+	ErrBadSubstitution:     "bad substitution provided [%s] - %v",
+	ErrBadPath:             "bad path provided [%s] - %v",
+	ErrBadAccess:           "bad access protection provided [%s] - %v",
+	ErrBadJSON:             "bad JSON in the request - %v",
+	ErrBatchTooLarge:       "batch has more than %s sites",
+	ErrTooManyJobs:         "too many jobs running - try again later",
+	ErrAuditAuth:           "the audit log needs the audit token",
+}
+
+// the stable identifier for each error - these never change once released
+var errID = map[ErrCode]string{
+	ErrUpgradedError:       "upgraded_error",
+	ErrCloseFile:           "close_file",
+	ErrRemoveFile:          "remove_file",
+	ErrFilePerm:            "file_permission",
+	ErrFileUnexpect:        "file_unexpected",
+	ErrBadHost:             "bad_host",
+	ErrBadIP:               "bad_ip",
+	ErrBlockedIP:           "blocked_ip",
+	ErrNoRandom:            "no_random",
+	ErrNoHostname:          "no_hostname",
+	ErrNoIP:                "no_ip",
+	ErrConfigBadHost:       "config_bad_host",
+	ErrConfigBadRead:       "config_bad_read",
+	ErrConfigBadExtract:    "config_bad_extract",
+	ErrConfigBadStructure:  "config_bad_structure",
+	ErrConfigBadType:       "config_bad_type",
+	ErrConfigBadValue:      "config_bad_value",
+	ErrConfigBadTemplate:   "config_bad_template",
+	ErrConfigLoadStructure: "config_load_structure",
+	ErrConfigLoadType:      "config_load_type",
+	ErrConfigLoadValue:     "config_load_value",
+	ErrConfigLoadTemplate:  "config_load_template",
+	ErrConfigBadIPFile:     "config_bad_ip_file",
+	ErrBadHostnameTrace:    "bad_hostname_trace",
+	ErrNoJob:               "no_job",
+	ErrListen:              "listen",
+	ErrConfigBadAuditLog:   "config_bad_audit_log",
+	ErrAuditWrite:          "audit_write",
+	ErrAuditRead:           "audit_read",
+	ErrNoAuditQuery:        "no_audit_query",
+	ErrConfigBadMessages:   "config_bad_messages",
+	ErrBadHeader:           "bad_header",
+	ErrRenderTemplate:      "render_template",
+	ErrConfigBadOutput:     "config_bad_output",
+	ErrBackendProbe:        "backend_probe",
+	ErrTLSDetect:           "tls_detect",
+	ErrACME:                "acme",
+	ErrConfigBadACME:       "config_bad_acme",
+	ErrBadUpstreamTLS:      "bad_upstream_tls",
+	ErrBadHeaderRule:       "bad_header_rule",
+	ErrBadSubstitution:     "bad_substitution",
+	ErrBadPath:             "bad_path",
+	ErrBadAccess:           "bad_access",
+	ErrBadJSON:             "bad_json",
+	ErrBatchTooLarge:       "batch_too_large",
+	ErrTooManyJobs:         "too_many_jobs",
+	ErrAuditAuth:           "audit_unauthorized",
+}
+
+// the response code for errors caused by the request - anything else is a 500
+var errStatus = map[ErrCode]int{
+	ErrBadHost:          http.StatusPreconditionFailed,
+	ErrBadIP:            http.StatusPreconditionFailed,
+	ErrBlockedIP:        http.StatusPreconditionFailed,
+	ErrNoHostname:       http.StatusPreconditionFailed,
+	ErrNoIP:             http.StatusPreconditionFailed,
+	ErrBadHostnameTrace: http.StatusPreconditionFailed,
+	ErrBadHeader:        http.StatusPreconditionFailed,
+	ErrBackendProbe:     http.StatusPreconditionFailed,
+	ErrTLSDetect:        http.StatusPreconditionFailed,
+	ErrBadUpstreamTLS:   http.StatusPreconditionFailed,
+	ErrBadHeaderRule:    http.StatusPreconditionFailed,
+	ErrBadSubstitution:  http.StatusPreconditionFailed,
+	ErrBadPath:          http.StatusPreconditionFailed,
+	ErrBadAccess:        http.StatusPreconditionFailed,
+	ErrNoJob:            http.StatusNotFound,
+	ErrNoAuditQuery:     http.StatusBadRequest,
+	ErrBadJSON:          http.StatusBadRequest,
+	ErrBatchTooLarge:    http.StatusRequestEntityTooLarge,
+	ErrTooManyJobs:      http.StatusTooManyRequests,
+	ErrAuditAuth:        http.StatusUnauthorized,
 }
@@ -1,11 +1,13 @@
 package moxxiConf
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
-	"log"
+	"log/slog"
 	"net/http"
-	"strings"
 	"testing"
 )
 
@@ -16,25 +18,25 @@ func TestErr_Error(t *testing.T) {
 		out string
 	}{
 		{
-			NewErr{ErrCloseFile, "/tmp/testfile", fakeError},
+			NewErr{Code: ErrCloseFile, value: "/tmp/testfile", deepErr: fakeError},
 			"failed to close the file [/tmp/testfile] - fake error",
 		}, {
-			NewErr{ErrRemoveFile, "/tmp/testfile", fakeError},
+			NewErr{Code: ErrRemoveFile, value: "/tmp/testfile", deepErr: fakeError},
 			"failed to remove file [/tmp/testfile] - fake error",
 		}, {
-			NewErr{ErrFilePerm, "/tmp/testfile", fakeError},
+			NewErr{Code: ErrFilePerm, value: "/tmp/testfile", deepErr: fakeError},
 			"permission denied to create file [/tmp/testfile] - fake error",
 		}, {
-			NewErr{ErrFileUnexpect, "/tmp/testfile", fakeError},
+			NewErr{Code: ErrFileUnexpect, value: "/tmp/testfile", deepErr: fakeError},
 			"unknown error with file [/tmp/testfile] - fake error",
 		}, {
-			NewErr{ErrBadHost, "/tmp/testfile", nil},
+			NewErr{Code: ErrBadHost, value: "/tmp/testfile", deepErr: nil},
 			"bad hostname provided [/tmp/testfile]",
 		}, {
-			NewErr{ErrBadIP, "/tmp/testfile", nil},
+			NewErr{Code: ErrBadIP, value: "/tmp/testfile", deepErr: nil},
 			"bad IP provided [/tmp/testfile]",
 		}, {
-			NewErr{ErrNoRandom, "", nil},
+			NewErr{Code: ErrNoRandom, value: "", deepErr: nil},
 			"was not given a new random domain - shutting down",
 		},
 	}
@@ -44,43 +46,47 @@ func TestErr_Error(t *testing.T) {
 	}
 }
 
-func TestErr_Log(t *testing.T) {
+func TestErr_LogValue(t *testing.T) {
 	fakeError := errors.New("fake error")
-	fakeReq, _ := http.NewRequest("GET", "http://example.com", nil)
 	var testData = []struct {
 		in  Err
-		out string
+		out map[string]interface{}
 	}{
 		{
-			NewErr{ErrCloseFile, "/tmp/testfile", fakeError},
-			"failed to close the file [/tmp/testfile] - fake error",
-		}, {
-			NewErr{ErrRemoveFile, "/tmp/testfile", fakeError},
-			"failed to remove file [/tmp/testfile] - fake error",
-		}, {
-			NewErr{ErrFilePerm, "/tmp/testfile", fakeError},
-			"permission denied to create file [/tmp/testfile] - fake error",
+			NewErr{Code: ErrCloseFile, value: "/tmp/testfile", deepErr: fakeError},
+			map[string]interface{}{
+				"code":      float64(ErrCloseFile),
+				"id":        "close_file",
+				"message":   "failed to close the file [/tmp/testfile] - fake error",
+				"value":     "/tmp/testfile",
+				"deepError": "fake error",
+			},
 		}, {
-			NewErr{ErrFileUnexpect, "/tmp/testfile", fakeError},
-			"unknown error with file [/tmp/testfile] - fake error",
-		}, {
-			NewErr{ErrBadHost, "/tmp/testfile", nil},
-			"bad hostname provided [/tmp/testfile]",
-		}, {
-			NewErr{ErrBadIP, "/tmp/testfile", nil},
-			"bad IP provided [/tmp/testfile]",
+			NewErr{Code: ErrBadHost, value: "/tmp/testfile", deepErr: nil},
+			map[string]interface{}{
+				"code":    float64(ErrBadHost),
+				"id":      "bad_host",
+				"message": "bad hostname provided [/tmp/testfile]",
+				"value":   "/tmp/testfile",
+			},
 		}, {
-			NewErr{ErrNoRandom, "", nil},
-			"was not given a new random domain - shutting down",
+			NewErr{Code: ErrNoRandom, value: "", deepErr: nil},
+			map[string]interface{}{
+				"code":    float64(ErrNoRandom),
+				"id":      "no_random",
+				"message": "was not given a new random domain - shutting down",
+			},
 		},
 	}
-	for _, test := range testData {
-		testOut := test.in.LogError(fakeReq)
-		if !strings.HasSuffix(testOut, test.out) {
-			t.Fail()
-			log.Printf("results did not match:\nexpected %#v\nactual %#v\n",
-				test.out, testOut)
-		}
+	for id, test := range testData {
+		var out bytes.Buffer
+		l := slog.New(slog.NewJSONHandler(&out, nil))
+		l.Error("testing", "error", test.in)
+
+		var record map[string]interface{}
+		err := json.Unmarshal(out.Bytes(), &record)
+		assert.NoError(t, err, "test %d - could not decode log record", id)
+		assert.Equal(t, test.out, record["error"], "test %d - logged error did not match", id)
 	}
 }
 
@@ -94,3 +100,77 @@ func TestUpgradeError(t *testing.T) {
 	betterErr := UpgradeError(fakeError)
 	assert.Equal(t, ErrUpgradedError, betterErr.GetCode(), "mismatched errors")
 }
+
+func TestErr_IsAs(t *testing.T) {
+	fakeError := errors.New("fake error")
+	var err error = &NewErr{Code: ErrFilePerm, value: "/tmp/testfile", deepErr: fakeError}
+
+	assert.True(t, errors.Is(err, ErrFilePerm), "should match its own code")
+	assert.False(t, errors.Is(err, ErrFileUnexpect), "should not match another code")
+	assert.True(t, errors.Is(err, NewErr{Code: ErrFilePerm}), "should match an error with the same code")
+	assert.True(t, errors.Is(err, fakeError), "should match the wrapped error")
+
+	wrapped := fmt.Errorf("while testing - %w", err)
+	assert.True(t, errors.Is(wrapped, ErrFilePerm), "should match through wrapping")
+
+	var pkgErr Err
+	if assert.True(t, errors.As(wrapped, &pkgErr), "should find the Err through wrapping") {
+		assert.Equal(t, ErrFilePerm, pkgErr.GetCode(), "found the wrong error")
+	}
+	assert.Equal(t, pkgErr, UpgradeError(wrapped), "upgrading should keep the original Err")
+}
+
+func TestErr_HTTPStatus(t *testing.T) {
+	var testData = []struct {
+		code   ErrCode
+		status int
+	}{
+		{ErrBadHost, http.StatusPreconditionFailed},
+		{ErrNoIP, http.StatusPreconditionFailed},
+		{ErrNoJob, http.StatusNotFound},
+		{ErrNoAuditQuery, http.StatusBadRequest},
+		{ErrFilePerm, http.StatusInternalServerError},
+		{ErrUpgradedError, http.StatusInternalServerError},
+	}
+	for id, test := range testData {
+		assert.Equal(t, test.status, NewErr{Code: test.code}.HTTPStatus(),
+			"test %d - wrong status for code %d", id, test.code)
+	}
+}
+
+func TestErrCode_ID(t *testing.T) {
+	seen := make(map[string]ErrCode)
+	for code := range errMsg {
+		id := code.ID()
+		assert.NotEqual(t, "unknown", id, "code %d has no ID", code)
+		if other, ok := seen[id]; ok {
+			t.Errorf("codes %d and %d share the ID %s", code, other, id)
+		}
+		seen[id] = code
+	}
+	assert.Len(t, errID, len(errMsg), "every ID should have a message")
+	assert.Equal(t, "blocked_ip", ErrBlockedIP.ID(), "IDs must not change")
+	assert.Equal(t, "unknown", ErrCode(0).ID(), "bad code should be unknown")
+}
+
+func TestErr_Localize(t *testing.T) {
+	fakeError := errors.New("fake error")
+	msgs := map[ErrCode]string{
+		ErrBlockedIP: "IP-Adresse [%s] ist nicht erlaubt",
+		ErrFilePerm:  "keine Berechtigung für [%s] - %v",
+	}
+	var testData = []struct {
+		in  Err
+		out string
+	}{
+		{NewErr{Code: ErrBlockedIP, value: "10.0.0.1"}, "IP-Adresse [10.0.0.1] ist nicht erlaubt"},
+		{&NewErr{Code: ErrFilePerm, value: "/tmp/x", deepErr: fakeError},
+			"keine Berechtigung für [/tmp/x] - fake error"},
+		{NewErr{Code: ErrBadIP, value: "127.1"}, "bad IP provided [127.1]"},
+	}
+	for id, test := range testData {
+		assert.Equal(t, test.out, test.in.Localize(msgs), "test %d - wrong message", id)
+		assert.Equal(t, test.in.Error(), test.in.Localize(nil),
+			"test %d - no translation should be English", id)
+	}
+}
@@ -1,31 +1,64 @@
 package moxxiConf
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
 	"text/template"
 )
 
-func CreateMux(handlers []HandlerConfig, l *log.Logger) *http.ServeMux {
+// CreateMux - sets up every handler on its route
+// background work the handlers need, like renewing certificates and tidying
+// up after removed proxies, runs until ctx is done
+func CreateMux(ctx context.Context, handlers []HandlerConfig, l *slog.Logger) *http.ServeMux {
+	startSweep(ctx, handlers, l)
+
+	// handlers sharing a certDir share a certManager, so it renews for all of them
+	outputs := allOutputs(proxyHandlers(handlers))
 	mux := http.NewServeMux()
 	for _, handler := range handlers {
+		if handler.certs != nil {
+			handler.certs.start(ctx, outputs, l)
+		}
+
+		var h http.HandlerFunc
 		switch handler.handlerType {
 		case "json":
-			mux.HandleFunc(handler.handlerRoute, JSONHandler(handler, l))
+			if handler.async {
+				h = JSONJobHandler(handler, l)
+			} else {
+				h = JSONHandler(handler, l)
+			}
 		case "form":
-			mux.HandleFunc(handler.handlerRoute, FormHandler(handler, l))
+			h = FormHandler(handler, l)
 		case "static":
-			mux.HandleFunc(handler.handlerRoute, StaticHandler(handler, l))
+			h = StaticHandler(handler, l)
+		case "metrics":
+			h = MetricsHandler(handlers)
+		case "health":
+			h = HealthHandler(handler, handlers)
+		case "audit":
+			h = AuditHandler(handler)
+		case "errors":
+			h = ErrorCatalogueHandler(handler)
+		case "acme":
+			h = ChallengeHandler(handler)
+		default:
+			continue
 		}
+		mux.HandleFunc(handler.handlerRoute, instrument(handler.handlerRoute, h))
 	}
 	return mux
 }
 
 // FormHandler - creates and returns a Handler for both Query and Form requests
-func FormHandler(config HandlerConfig, l *log.Logger) http.HandlerFunc {
+func FormHandler(config HandlerConfig, l *slog.Logger) http.HandlerFunc {
 	confWriter := confWrite(config)
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -35,52 +68,96 @@ func FormHandler(config HandlerConfig, l *log.Logger) http.HandlerFunc {
 			return
 		}
 
-		if r.Form.Get("host") == "" {
-			pkgErr := &NewErr{Code: ErrNoHostname}
-			http.Error(w, pkgErr.Error(), http.StatusPreconditionFailed)
-			l.Println(pkgErr.LogError(r))
-			return
-		}
-		host := r.Form.Get("host")
-
-		if r.Form.Get("ip") == "" {
-			pkgErr := &NewErr{Code: ErrNoIP}
-			http.Error(w, pkgErr.Error(), http.StatusPreconditionFailed)
-			l.Println(pkgErr.LogError(r))
-			return
-		}
-
 		tls := parseCheckbox(r.Form.Get("tls"))
+		detectTLS := r.Form.Get("tls") == TLSAuto
 
+		// when working out TLS, no port means trying the usual ones
 		port, err := strconv.Atoi(r.Form.Get("port"))
-		if err != nil {
+		if err != nil && !detectTLS {
 			port = 80
 		}
 
-		vhost := siteParams{
-			IntHost:      host,
+		request := siteParams{
+			IntHost:      r.Form.Get("host"),
 			IntIP:        r.Form.Get("ip"),
 			Encrypted:    tls,
 			IntPort:      port,
 			StripHeaders: r.Form["header"],
+			detectTLS:    detectTLS,
+
+			UpstreamSNI:    r.Form.Get("sni"),
+			UpstreamVerify: parseCheckbox(r.Form.Get("verify")),
+			UpstreamCA:     r.Form.Get("ca"),
+			ClientCert:     r.Form.Get("clientCert"),
+
+			RewriteCookieDomain: parseCheckbox(r.Form.Get("cookieDomain")),
+		}
+		for _, rule := range r.Form["reqHeader"] {
+			request.RequestHeaders = append(request.RequestHeaders, parseHeaderRule(rule))
+		}
+		for _, rule := range r.Form["resHeader"] {
+			request.ResponseHeaders = append(request.ResponseHeaders, parseHeaderRule(rule))
+		}
+		// substitutions come as matching lists of what to replace and with what
+		subTo := r.Form["subTo"]
+		for id, from := range r.Form["subFrom"] {
+			rule := substitution{From: from}
+			if id < len(subTo) {
+				rule.To = subTo[id]
+			}
+			if rule.From != "" {
+				request.Substitutions = append(request.Substitutions, rule)
+			}
+		}
+		request.SubstituteTypes = r.Form["subType"]
+		request.PathPrefix = r.Form.Get("path")
+		request.AllowPaths = r.Form["allow"]
+		request.BlockPaths = r.Form["block"]
+		request.BasicAuth = parseCheckbox(r.Form.Get("auth"))
+		request.AllowFrom = r.Form["allowFrom"]
+
+		if request.IntHost == "" {
+			pkgErr := &NewErr{Code: ErrNoHostname}
+			sendErr(w, r, config, pkgErr)
+			logResult(l, r, config, request, pkgErr)
+			recordResult(config, pkgErr)
+			return
+		}
+
+		if request.IntIP == "" {
+			pkgErr := &NewErr{Code: ErrNoIP}
+			sendErr(w, r, config, pkgErr)
+			logResult(l, r, config, request, pkgErr)
+			recordResult(config, pkgErr)
+			return
 		}
 
-		vhost, pkgErr := confCheck(vhost, config)
+		vhost, pkgErr := confCheck(request, config)
 		if pkgErr != nil {
-			http.Error(w, pkgErr.Error(), http.StatusPreconditionFailed)
-			l.Println(pkgErr.LogError(r))
+			sendErr(w, r, config, pkgErr)
+			logResult(l, r, config, request, pkgErr)
+			recordResult(config, pkgErr)
 			return
 		}
 
-		if vhost, pkgErr = confWriter(vhost); pkgErr != nil {
-			http.Error(w, pkgErr.Error(), http.StatusInternalServerError)
-			l.Println(pkgErr.LogError(r))
+		vhost.RequestID = RequestID(r)
+		vhost, pkgErr = confWriter(vhost)
+		recordResult(config, pkgErr)
+		if pkgErr != nil {
+			sendErr(w, r, config, pkgErr)
+			request.ExtHost = vhost.ExtHost
+			logResult(l, r, config, request, pkgErr)
 			return
 		}
+		logResult(l, r, config, vhost, nil)
+		if pkgErr = auditCreate(config, r, request, vhost); pkgErr != nil {
+			logResult(l, r, config, vhost, pkgErr)
+		}
 
 		if extErr := config.resTempl.Execute(w, []siteParams{vhost}); extErr != nil {
 			http.Error(w, extErr.Error(), http.StatusInternalServerError)
-			l.Println(extErr.Error())
+			l.Error("failed to render response", "requestID", RequestID(r),
+				"route", config.handlerRoute, "error", extErr)
 			return
 		}
 		return
@@ -88,21 +165,9 @@ func FormHandler(config HandlerConfig, l *log.Logger) http.HandlerFunc {
 }
 
 // JSONHandler - creates and returns a Handler for JSON body requests
-func JSONHandler(config HandlerConfig, l *log.Logger) http.HandlerFunc {
-
-	var tStart, tEnd, tBody *template.Template
-
-	for _, each := range config.resTempl.Templates() {
-		switch each.Name() {
-		case "start":
-			tStart = each
-		case "end":
-			tEnd = each
-		case "body":
-			tBody = each
-		}
-	}
+func JSONHandler(config HandlerConfig, l *slog.Logger) http.HandlerFunc {
 
+	tStart, tBody, tEnd := splitResTempl(config.resTempl)
 	if tStart == nil || tEnd == nil || tBody == nil {
 		return InvalidHandler("bad template", http.StatusInternalServerError)
 	}
@@ -111,64 +176,108 @@ func JSONHandler(config HandlerConfig, l *log.Logger) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		var emptyInterface interface{}
-		type locSiteParams struct {
-			ExtHost      string
-			IntHost      string
-			IntIP        string
-			IntPort      int
-			Encrypted    bool
-			StripHeaders []string
-			ErrorString  string
-			Error        Err
+		msgs := config.messages.forRequest(r)
+		sites, pkgErr := decodeSites(r.Body)
+		if pkgErr != nil {
+			sendErr(w, r, config, pkgErr)
+			return
 		}
 
+		var emptyInterface interface{}
+
 		tStart.Execute(w, emptyInterface)
 
-		decoder := json.NewDecoder(r.Body)
+		for _, v := range sites {
+			v = batchSite(v, config, confWriter, l, r, msgs)
 
-		for decoder.More() {
-			var v siteParams
-			if err := decoder.Decode(&v); err != nil {
-				continue
+			if err := tBody.Execute(w, v); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				l.Error("failed to render response", "requestID", RequestID(r),
+					"route", config.handlerRoute, "error", err)
+				return
 			}
+		}
+		tEnd.Execute(w, emptyInterface)
+	}
+}
 
-			v, err := confCheck(v, config)
-			if err == nil {
-				v, err = confWriter(v)
-			} else if err.GetCode() == ErrBadHostnameTrace {
-				var newErr Error
-				v, newErr = confWriter(v)
-				if newErr != nil {
-					err = newErr
-				}
+// JSONJobHandler - creates and returns a Handler for JSON body requests that
+// are processed in the background
+// POSTing a batch returns the job status immediately, and a GET to the
+// handlerRoute followed by the job ID returns progress. Once complete, the
+// results are rendered with the same templates as JSONHandler - or as JSON
+// if format=json is given.
+func JSONJobHandler(config HandlerConfig, l *slog.Logger) http.HandlerFunc {
+
+	tStart, tBody, tEnd := splitResTempl(config.resTempl)
+	if tStart == nil || tEnd == nil || tBody == nil {
+		return InvalidHandler("bad template", http.StatusInternalServerError)
+	}
+
+	confWriter := confWrite(config)
+	jobs := newJobStore(config.jobRetention)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method == http.MethodPost {
+			msgs := config.messages.forRequest(r)
+			sites, pkgErr := decodeSites(r.Body)
+			if pkgErr != nil {
+				sendErr(w, r, config, pkgErr)
+				return
 			}
 
-			var vPlus = struct {
-				ExtHost      string
-				IntHost      string
-				IntIP        string
-				IntPort      int
-				Encrypted    bool
-				StripHeaders []string
-				Error        string
-			}{
-				ExtHost:      v.ExtHost,
-				IntHost:      v.IntHost,
-				IntIP:        v.IntIP,
-				IntPort:      v.IntPort,
-				Encrypted:    v.Encrypted,
-				StripHeaders: v.StripHeaders,
+			j, pkgErr := jobs.add(len(sites))
+			if pkgErr != nil {
+				sendErr(w, r, config, pkgErr)
+				return
 			}
 
-			if err != nil {
-				l.Println(err.LogError(r))
-				vPlus.Error = err.Error()
+			// the job outlives the request, so it works from a copy that is
+			// not cancelled and has nothing left to read once this returns
+			detached := r.Clone(context.WithoutCancel(r.Context()))
+			detached.Body = http.NoBody
+			go func() {
+				for id, v := range sites {
+					j.record(id, batchSite(v, config, confWriter, l, detached, msgs))
+				}
+			}()
+
+			w.Header().Set("Location", config.handlerRoute+j.id)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			if err := json.NewEncoder(w).Encode(j.status()); err != nil {
+				l.Error("failed to write job status", "requestID", RequestID(r),
+					"job", j.id, "error", err)
 			}
+			return
+		}
 
-			if err := tBody.Execute(w, vPlus); err != nil {
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, config.handlerRoute), PathSep)
+		j := jobs.get(id)
+		if j == nil {
+			pkgErr := &NewErr{Code: ErrNoJob, value: id}
+			sendErr(w, r, config, pkgErr)
+			return
+		}
+		status := j.status()
+
+		if !status.Complete || r.FormValue("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(status); err != nil {
+				l.Error("failed to write job status", "requestID", RequestID(r),
+					"job", id, "error", err)
+			}
+			return
+		}
+
+		var emptyInterface interface{}
+		tStart.Execute(w, emptyInterface)
+		for _, v := range status.Results {
+			if err := tBody.Execute(w, v); err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
-				l.Println(err.Error())
+				l.Error("failed to render response", "requestID", RequestID(r),
+					"route", config.handlerRoute, "error", err)
 				return
 			}
 		}
@@ -176,11 +285,98 @@ func JSONHandler(config HandlerConfig, l *log.Logger) http.HandlerFunc {
 	}
 }
 
+// decodeSites - reads every site in a batch request before any are worked on
+// the first bad site fails the whole batch, as nothing after it can be read
+func decodeSites(body io.Reader) ([]siteParams, Err) {
+	var sites []siteParams
+	decoder := json.NewDecoder(body)
+	for decoder.More() {
+		if len(sites) >= MaxBatchSites {
+			return nil, &NewErr{Code: ErrBatchTooLarge, value: strconv.Itoa(MaxBatchSites)}
+		}
+		var v siteParams
+		if err := decoder.Decode(&v); err != nil {
+			return nil, &NewErr{Code: ErrBadJSON, deepErr: err}
+		}
+		sites = append(sites, v)
+	}
+	return sites, nil
+}
+
+// splitResTempl - pulls the start, body, and end templates used for batches
+func splitResTempl(t *template.Template) (tStart, tBody, tEnd *template.Template) {
+	if t == nil {
+		return nil, nil, nil
+	}
+	for _, each := range t.Templates() {
+		switch each.Name() {
+		case "start":
+			tStart = each
+		case "end":
+			tEnd = each
+		case "body":
+			tBody = each
+		}
+	}
+	return tStart, tBody, tEnd
+}
+
+// batchSite - checks and writes out a single site from a batch request
+// a failed redirect trace still writes out the site as it was given, with the
+// trace error as a warning - errors are given in the messages picked for the
+// request before it was read
+func batchSite(v siteParams, config HandlerConfig,
+	confWriter func(siteParams) (siteParams, Err),
+	l *slog.Logger, r *http.Request, msgs map[ErrCode]string) siteParams {
+
+	request := v
+	v, err := confCheck(v, config)
+	v.RequestID = RequestID(r)
+	var warning Err
+	if errors.Is(err, ErrBadHostnameTrace) {
+		warning, err = err, nil
+	}
+	if err == nil {
+		v, err = confWriter(v)
+	}
+
+	// a site written after a failed trace counts as created, not failed
+	recordResult(config, err)
+
+	v.Error = ""
+	v.ErrorID = ""
+	v.Warning = ""
+	v.WarningID = ""
+	if err != nil {
+		request.ExtHost = v.ExtHost
+		logResult(l, r, config, request, err)
+		v.Error = err.Localize(msgs)
+		v.ErrorID = err.GetCode().ID()
+		return v
+	}
+
+	if warning != nil {
+		v.Warning = warning.Localize(msgs)
+		v.WarningID = warning.GetCode().ID()
+	}
+	logWarning(l, r, config, v, warning)
+	if err = auditCreate(config, r, request, v); err != nil {
+		logResult(l, r, config, v, err)
+	}
+	return v
+}
+
 // StaticHandler - creates and returns a Handler to simply respond with a static response to every request
-func StaticHandler(config HandlerConfig, l *log.Logger) http.HandlerFunc {
-	res, err := ioutil.ReadFile(config.resFile)
+func StaticHandler(config HandlerConfig, l *slog.Logger) http.HandlerFunc {
+	var res []byte
+	var err error
+	if config.resFile != "" {
+		res, err = ioutil.ReadFile(config.resFile)
+	} else {
+		res, err = readDefaultFile(DefaultStaticResFile)
+	}
 	if err != nil {
-		l.Printf("bad static response file %s - %v", config.resFile, err)
+		l.Error("bad static response file", "file", config.resFile, "error", err)
 		return InvalidHandler("no data", http.StatusInternalServerError)
 	}
 
@@ -3,17 +3,22 @@ package moxxiConf
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"text/template"
+	"time"
 
+	"github.com/dchest/uniuri"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,7 +33,7 @@ func TestStaticHandler(t *testing.T) {
 	assert.Nil(t, err, "could no open temp file for writing - %v", err)
 
 	server := httptest.NewServer(StaticHandler(HandlerConfig{resFile: file.Name()},
-		log.New(ioutil.Discard, "", log.LstdFlags)))
+		slog.New(slog.NewTextHandler(ioutil.Discard, nil))))
 	defer server.Close()
 
 	for i := 0; i < 10; i++ {
@@ -62,7 +67,7 @@ func TestFormHandler_POST(t *testing.T) {
 	testConfig.resTempl = template.Must(template.New("testing").Parse(resTemplVal))
 
 	server := httptest.NewServer(FormHandler(testConfig,
-		log.New(ioutil.Discard, "", log.LstdFlags)))
+		slog.New(slog.NewTextHandler(ioutil.Discard, nil))))
 	defer server.Close()
 
 	var testData = []struct {
@@ -175,7 +180,7 @@ func TestJSONHandler_POST(t *testing.T) {
 	testConfig.resTempl = template.Must(template.New("testing").Parse(resTemplVal))
 
 	server := httptest.NewServer(JSONHandler(testConfig,
-		log.New(ioutil.Discard, "", log.LstdFlags)))
+		slog.New(slog.NewTextHandler(ioutil.Discard, nil))))
 	defer server.Close()
 
 	var testData = []struct {
@@ -247,3 +252,265 @@ func TestJSONHandler_POST(t *testing.T) {
 		resp.Body.Close()
 	}
 }
+
+func TestJSONJobHandler_POST(t *testing.T) {
+
+	// test setup
+	testConfig := HandlerConfig{
+		baseURL:      "test.com",
+		confPath:     os.TempDir(),
+		confExt:      ".testout",
+		exclude:      []string{"a", "b", "c"},
+		subdomainLen: 8,
+		async:        true,
+	}
+
+	confTemplVal := "{{.IntHost}} {{.IntIP}} {{.IntPort}} {{.Encrypted}}"
+	testConfig.confTempl = template.Must(template.New("testing").Parse(confTemplVal))
+
+	resTemplVal := `{{ define "start" }}{{ end }}
+	{{define "body" }}{{ .IntHost }} {{ .Error }}
+	{{ end }}
+	{{ define "end" }}{{ end }}"`
+	testConfig.resTempl = template.Must(template.New("testing").Parse(resTemplVal))
+
+	server := httptest.NewServer(JSONJobHandler(testConfig,
+		slog.New(slog.NewTextHandler(ioutil.Discard, nil))))
+	defer server.Close()
+
+	reqBody := `{ "IntHost": "proxied.com", "IntIP": "10.10.10.10", "IntPort": 80 }
+		{ "IntHost": "com", "IntIP": "10.10.10.10", "IntPort": 80 }`
+
+	resp, err := http.Post(server.URL, "application/json", strings.NewReader(reqBody))
+	assert.NoError(t, err, "got an error I should not have when submitting the job")
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode, "got the wrong response code")
+
+	var submitted jobStatus
+	err = json.NewDecoder(resp.Body).Decode(&submitted)
+	resp.Body.Close()
+	assert.NoError(t, err, "could not decode the job status")
+	assert.Equal(t, 2, submitted.Total, "job had the wrong number of sites")
+	assert.Equal(t, submitted.ID, resp.Header.Get("Location"), "bad Location header")
+
+	var status jobStatus
+	for i := 0; i < 50 && !status.Complete; i++ {
+		resp, err = http.Get(server.URL + "/" + submitted.ID + "?format=json")
+		assert.NoError(t, err, "got an error I should not have when polling the job")
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		assert.NoError(t, err, "could not decode the job status")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.True(t, status.Complete, "job never completed")
+	if assert.Len(t, status.Results, 2, "wrong number of results") {
+		assert.Equal(t, "proxied.com", status.Results[0].IntHost, "wrong first result")
+		assert.Equal(t, "", status.Results[0].Error, "first result should have worked")
+		assert.Equal(t, "bad hostname provided [com]", status.Results[1].Error,
+			"second result should have failed")
+	}
+
+	resp, err = http.Get(server.URL + "/" + submitted.ID)
+	assert.NoError(t, err, "got an error I should not have when getting the results")
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err, "problem reading response - %v", err)
+	assert.Contains(t, string(body), "proxied.com", "templated results were missing the site")
+	assert.Contains(t, string(body), "bad hostname provided [com]",
+		"templated results were missing the error")
+
+	resp, err = http.Get(server.URL + "/notarealjob")
+	assert.NoError(t, err, "got an error I should not have when getting a bad job")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "got the wrong response code")
+	resp.Body.Close()
+}
+
+func TestFormHandler_requestID(t *testing.T) {
+	testConfig := HandlerConfig{
+		baseURL:      "test.com",
+		confPath:     os.TempDir(),
+		confExt:      ".testout",
+		subdomainLen: 8,
+	}
+	testConfig.confTempl = template.Must(template.New("testing").Parse("# {{ .RequestID }}"))
+	testConfig.resTempl = template.Must(template.New("testing").Parse("{{range .}}{{ .ExtHost }}{{ end }}"))
+
+	server := httptest.NewServer(RequestIDHandler(FormHandler(testConfig,
+		slog.New(slog.NewTextHandler(ioutil.Discard, nil)))))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL, strings.NewReader(url.Values{
+		"host": []string{"proxied.com"},
+		"ip":   []string{"10.10.10.10"},
+	}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(RequestIDHeader, "trace-me")
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err, "got an error I should not have when running the request")
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err, "problem reading response - %v", err)
+	assert.Equal(t, "trace-me", resp.Header.Get(RequestIDHeader), "request ID was not returned")
+
+	proxyOut, err := ioutil.ReadFile(fmt.Sprintf("%s/%s%s",
+		testConfig.confPath, bytes.TrimSpace(body), testConfig.confExt))
+	assert.NoError(t, err, "problem reading file - %v", err)
+	assert.Equal(t, "# trace-me", string(proxyOut), "request ID was not written to the config")
+}
+
+func TestDecodeSites(t *testing.T) {
+	var testData = []struct {
+		in      string
+		out     []siteParams
+		errCode ErrCode
+	}{
+		{in: ""},
+		{
+			in:  `{ "IntHost": "one.com" } { "IntHost": "two.com" }`,
+			out: []siteParams{{IntHost: "one.com"}, {IntHost: "two.com"}},
+		}, {
+			in:      `{ "IntHost": "one.com" } { "IntHost": 5 } { "IntHost": "three.com" }`,
+			errCode: ErrBadJSON,
+		}, {
+			in:      `{ "IntHost": "one.com" } not json`,
+			errCode: ErrBadJSON,
+		}, {
+			in:      strings.Repeat(`{ "IntHost": "one.com" }`, MaxBatchSites+1),
+			errCode: ErrBatchTooLarge,
+		},
+	}
+
+	for id, test := range testData {
+		out, locErr := decodeSites(strings.NewReader(test.in))
+		if test.errCode != 0 {
+			assert.ErrorIs(t, locErr, test.errCode, "test %d - wrong error", id)
+			continue
+		}
+		assert.Nil(t, locErr, "test %d - unexpected error - %v", id, locErr)
+		assert.Equal(t, test.out, out, "test %d - wrong sites", id)
+	}
+}
+
+func TestJSONHandlers_badJSON(t *testing.T) {
+	testConfig := HandlerConfig{
+		baseURL:      "test.com",
+		confPath:     t.TempDir(),
+		confExt:      ".testout",
+		subdomainLen: 8,
+	}
+	testConfig.confTempl = template.Must(template.New("testing").Parse("{{.IntHost}}"))
+	testConfig.resTempl = template.Must(template.New("testing").Parse(
+		`{{ define "start" }}{{ end }}{{ define "body" }}{{ .ExtHost }}{{ end }}{{ define "end" }}{{ end }}`))
+	l := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, h := range []http.HandlerFunc{JSONHandler(testConfig, l), JSONJobHandler(testConfig, l)} {
+		server := httptest.NewServer(h)
+		resp, err := client.Post(server.URL, "application/json",
+			strings.NewReader(`{ "IntHost": "proxied.com", "IntIP": "10.10.10.10" } {"IntHost": `))
+		server.Close()
+		if !assert.NoError(t, err, "the request should not hang") {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "got the wrong response code")
+		assert.Equal(t, "bad_json", resp.Header.Get(ErrorIDHeader), "got the wrong error")
+	}
+	files, _ := ioutil.ReadDir(testConfig.confPath)
+	assert.Empty(t, files, "nothing should be written for a bad batch")
+}
+
+func TestJSONJobHandler_requestID(t *testing.T) {
+	testConfig := HandlerConfig{
+		baseURL:      "test.com",
+		confPath:     t.TempDir(),
+		confExt:      ".testout",
+		subdomainLen: 8,
+		async:        true,
+	}
+	testConfig.confTempl = template.Must(template.New("testing").Parse("# {{ .RequestID }}"))
+	testConfig.resTempl = template.Must(template.New("testing").Parse(
+		`{{ define "start" }}{{ end }}{{ define "body" }}{{ .ExtHost }}{{ end }}{{ define "end" }}{{ end }}`))
+
+	server := httptest.NewServer(RequestIDHandler(JSONJobHandler(testConfig,
+		slog.New(slog.NewTextHandler(ioutil.Discard, nil)))))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL,
+		strings.NewReader(`{ "IntHost": "proxied.com", "IntIP": "10.10.10.10" }`))
+	req.Header.Set(RequestIDHeader, "trace-me")
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "got an error I should not have when submitting the job") {
+		return
+	}
+	var status jobStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+
+	for i := 0; i < 50 && !status.Complete; i++ {
+		time.Sleep(10 * time.Millisecond)
+		resp, err = http.Get(server.URL + "/" + status.ID + "?format=json")
+		if !assert.NoError(t, err, "got an error I should not have when polling the job") {
+			return
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+	}
+	if assert.Len(t, status.Results, 1, "wrong number of results") {
+		assert.Equal(t, "trace-me", status.Results[0].RequestID,
+			"the job should keep the ID of the request that made it")
+	}
+}
+
+func TestBatchSite_traceWarning(t *testing.T) {
+	// nothing listens on a port that was just closed, so the trace fails
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err, "could not find a free port") {
+		return
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	dir := t.TempDir()
+	audit, locErr := openAuditLog(filepath.Join(dir, "audit.jsonl"))
+	if !assert.Nil(t, locErr, "could not open the audit log - %v", locErr) {
+		return
+	}
+	// the metrics are shared, so every run counts under its own route
+	route := "/traced/" + uniuri.New() + "/"
+	testConfig := HandlerConfig{
+		handlerRoute:    route,
+		baseURL:         "test.com",
+		confPath:        dir,
+		confExt:         ".conf",
+		subdomainLen:    8,
+		confTempl:       template.Must(template.New("testing").Parse("{{ .IntHost }}")),
+		redirectTracing: true,
+		trace:           tracePolicy{timeout: time.Second},
+		audit:           audit,
+	}
+	l := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	r := httptest.NewRequest("POST", route, nil)
+
+	out := batchSite(siteParams{IntHost: "traced.com", IntIP: "127.0.0.1", IntPort: port},
+		testConfig, confWrite(testConfig), l, r, nil)
+	assert.Empty(t, out.Error, "the proxy should have been written")
+	assert.Equal(t, ErrBadHostnameTrace.ID(), out.WarningID, "the trace should be a warning")
+	assert.NotEmpty(t, out.Warning, "the warning should have a message")
+	if !assert.NotEmpty(t, out.ExtHost, "should have been given a name") {
+		return
+	}
+
+	records, locErr := searchAuditLog(audit.path, out.ExtHost, "")
+	assert.Nil(t, locErr, "could not read the audit log - %v", locErr)
+	assert.Len(t, records, 1, "the written proxy should be audited")
+
+	var metrics bytes.Buffer
+	metricProxiesCreated.write(&metrics)
+	metricProxyFailures.write(&metrics)
+	assert.Contains(t, metrics.String(), `moxxi_proxies_created_total{handler="`+route+`"} 1`,
+		"the written proxy should be counted as created")
+	assert.NotContains(t, metrics.String(), `handler="`+route+`",error=`,
+		"the written proxy should not be counted as failed")
+}
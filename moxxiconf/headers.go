@@ -0,0 +1,90 @@
+package moxxiConf
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// the actions a header rule can take
+const (
+	HeaderAdd    = "add"
+	HeaderSet    = "set"
+	HeaderRemove = "remove"
+)
+
+// HeaderRuleSep separates the action, name and value of a header rule in a form
+const HeaderRuleSep = ":"
+
+// headerValueExpands are what would make a value more than plain text in one
+// of the config formats - nginx variables ($host), HAProxy fetches and log
+// formats (%[env(X)], %ci), Apache formats (%{X}e) and Caddy placeholders ({env.X})
+const headerValueExpands = "$%{"
+
+// headerRule - adds, sets or removes one header on the way to or from the backend
+type headerRule struct {
+	Action string
+	Name   string
+	Value  string `json:",omitempty"`
+}
+
+// parseHeaderRule reads a header rule from a form, as action:name:value -
+// anything malformed is left for checkHeaderRules to turn away
+func parseHeaderRule(s string) headerRule {
+	parts := strings.SplitN(s, HeaderRuleSep, 3)
+	if len(parts) < 2 {
+		return headerRule{Action: s}
+	}
+	rule := headerRule{Action: parts[0], Name: parts[1]}
+	if len(parts) > 2 {
+		rule.Value = parts[2]
+	}
+	return rule
+}
+
+// checkHeaderRule validates one header rule, giving it back cleaned up
+func checkHeaderRule(rule headerRule) (headerRule, error) {
+	rule.Action = strings.ToLower(rule.Action)
+	switch rule.Action {
+	case HeaderAdd, HeaderSet:
+	case HeaderRemove:
+		rule.Value = ""
+	default:
+		return rule, fmt.Errorf("unknown action %q", rule.Action)
+	}
+	if !validHeader(rule.Name) {
+		return rule, fmt.Errorf("bad header name %q", rule.Name)
+	}
+	if !validValue(rule.Value) {
+		return rule, fmt.Errorf("bad value for %s", rule.Name)
+	}
+	if strings.ContainsAny(rule.Value, headerValueExpands) {
+		return rule, fmt.Errorf("the value for %s cannot hold $, %% or {", rule.Name)
+	}
+	return rule, nil
+}
+
+// checkHeaderRules validates the request and response header rules asked for
+// in proxy, filling them into conf
+// the Host header is always set to the IntHost, so no rule can touch it
+func checkHeaderRules(proxy siteParams, conf *siteParams) Err {
+	for _, in := range proxy.RequestHeaders {
+		rule, err := checkHeaderRule(in)
+		if err == nil && http.CanonicalHeaderKey(rule.Name) == "Host" {
+			err = fmt.Errorf("the Host header is set by moxxi")
+		}
+		if err != nil {
+			return &NewErr{Code: ErrBadHeaderRule, value: in.Action + HeaderRuleSep + in.Name, deepErr: err}
+		}
+		conf.RequestHeaders = append(conf.RequestHeaders, rule)
+	}
+	for _, in := range proxy.ResponseHeaders {
+		rule, err := checkHeaderRule(in)
+		if err != nil {
+			return &NewErr{Code: ErrBadHeaderRule, value: in.Action + HeaderRuleSep + in.Name, deepErr: err}
+		}
+		conf.ResponseHeaders = append(conf.ResponseHeaders, rule)
+	}
+	conf.RewriteCookieDomain = proxy.RewriteCookieDomain
+	return nil
+}
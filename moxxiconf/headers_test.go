@@ -0,0 +1,201 @@
+package moxxiConf
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHeaderRule(t *testing.T) {
+	var testData = []struct {
+		in  string
+		out headerRule
+	}{
+		{"set:X-Frame-Options:DENY", headerRule{Action: HeaderSet, Name: "X-Frame-Options", Value: "DENY"}},
+		{"add:Link:<https://a.com/>; rel=preload", headerRule{Action: HeaderAdd, Name: "Link", Value: "<https://a.com/>; rel=preload"}},
+		{"set:X-Url:http://a.com:8080/", headerRule{Action: HeaderSet, Name: "X-Url", Value: "http://a.com:8080/"}},
+		{"remove:Server", headerRule{Action: HeaderRemove, Name: "Server"}},
+		{"Server", headerRule{Action: "Server"}},
+	}
+	for id, test := range testData {
+		assert.Equal(t, test.out, parseHeaderRule(test.in), "test %d - wrong rule for %q", id, test.in)
+	}
+}
+
+func TestCheckHeaderRules(t *testing.T) {
+	var testData = []struct {
+		in      siteParams
+		out     siteParams
+		errCode ErrCode
+	}{
+		{},
+		{
+			in: siteParams{
+				RequestHeaders: []headerRule{
+					{Action: "ADD", Name: "X-Forwarded-Proto", Value: "https"},
+					{Action: HeaderRemove, Name: "Cookie", Value: "ignored"},
+				},
+				ResponseHeaders: []headerRule{
+					{Action: HeaderSet, Name: "Cache-Control", Value: "no-store"},
+					{Action: HeaderRemove, Name: "Strict-Transport-Security"},
+				},
+				RewriteCookieDomain: true,
+			},
+			out: siteParams{
+				RequestHeaders: []headerRule{
+					{Action: HeaderAdd, Name: "X-Forwarded-Proto", Value: "https"},
+					{Action: HeaderRemove, Name: "Cookie"},
+				},
+				ResponseHeaders: []headerRule{
+					{Action: HeaderSet, Name: "Cache-Control", Value: "no-store"},
+					{Action: HeaderRemove, Name: "Strict-Transport-Security"},
+				},
+				RewriteCookieDomain: true,
+			},
+		}, {
+			in:      siteParams{RequestHeaders: []headerRule{{Action: "append", Name: "X-A", Value: "b"}}},
+			errCode: ErrBadHeaderRule,
+		}, {
+			in:      siteParams{RequestHeaders: []headerRule{{Action: HeaderSet, Name: "X A", Value: "b"}}},
+			errCode: ErrBadHeaderRule,
+		}, {
+			in:      siteParams{RequestHeaders: []headerRule{{Action: HeaderSet, Name: "host", Value: "evil.com"}}},
+			errCode: ErrBadHeaderRule,
+		}, {
+			in:      siteParams{ResponseHeaders: []headerRule{{Action: HeaderSet, Name: "X-A", Value: "b\";\nreturn 200"}}},
+			errCode: ErrBadHeaderRule,
+		}, {
+			in:      siteParams{ResponseHeaders: []headerRule{{Action: HeaderAdd, Name: ""}}},
+			errCode: ErrBadHeaderRule,
+		}, {
+			in:      siteParams{RequestHeaders: []headerRule{{Action: HeaderSet, Name: "X-A", Value: "$remote_addr"}}},
+			errCode: ErrBadHeaderRule,
+		}, {
+			in:      siteParams{RequestHeaders: []headerRule{{Action: HeaderSet, Name: "X-A", Value: "%[env(SECRET)]"}}},
+			errCode: ErrBadHeaderRule,
+		}, {
+			in:      siteParams{RequestHeaders: []headerRule{{Action: HeaderSet, Name: "X-A", Value: "%ci"}}},
+			errCode: ErrBadHeaderRule,
+		}, {
+			in:      siteParams{ResponseHeaders: []headerRule{{Action: HeaderSet, Name: "X-A", Value: "%{SECRET}e"}}},
+			errCode: ErrBadHeaderRule,
+		}, {
+			in:      siteParams{ResponseHeaders: []headerRule{{Action: HeaderSet, Name: "X-A", Value: "{env.SECRET}"}}},
+			errCode: ErrBadHeaderRule,
+		},
+	}
+
+	for id, test := range testData {
+		var out siteParams
+		locErr := checkHeaderRules(test.in, &out)
+		if test.errCode != 0 {
+			assert.ErrorIs(t, locErr, test.errCode, "test %d - wrong error", id)
+			continue
+		}
+		assert.Nil(t, locErr, "test %d - unexpected error - %v", id, locErr)
+		assert.Equal(t, test.out, out, "test %d - wrong rules", id)
+	}
+}
+
+func TestSiteParams_headerRulesJSON(t *testing.T) {
+	var site siteParams
+	err := json.Unmarshal([]byte(`{"IntHost": "domain.com", "IntIP": "10.0.0.1",
+		"RequestHeaders": [{"Action": "set", "Name": "X-A", "Value": "b"}],
+		"ResponseHeaders": [{"Action": "remove", "Name": "X-Frame-Options"}],
+		"RewriteCookieDomain": true}`), &site)
+	assert.NoError(t, err, "should read the header rules")
+	assert.Equal(t, []headerRule{{Action: HeaderSet, Name: "X-A", Value: "b"}}, site.RequestHeaders, "wrong request rules")
+	assert.Equal(t, []headerRule{{Action: HeaderRemove, Name: "X-Frame-Options"}}, site.ResponseHeaders, "wrong response rules")
+	assert.True(t, site.RewriteCookieDomain, "should rewrite cookies")
+}
+
+func TestFormHandler_headerRules(t *testing.T) {
+	testConfig := HandlerConfig{
+		baseURL:      "test.com",
+		confPath:     t.TempDir(),
+		confExt:      "conf",
+		subdomainLen: 8,
+		confTempl: template.Must(template.New("testing").Parse(
+			"{{ range .RequestHeaders }}{{ .Action }} {{ .Name }} {{ .Value }}|{{ end }}" +
+				"{{ range .ResponseHeaders }}{{ .Action }} {{ .Name }} {{ .Value }}|{{ end }}" +
+				"{{ .RewriteCookieDomain }}")),
+		resTempl: template.Must(template.New("testing").Parse("{{ range . }}{{ .ExtHost }}{{ end }}")),
+	}
+	server := httptest.NewServer(FormHandler(testConfig,
+		slog.New(slog.NewTextHandler(ioutil.Discard, nil))))
+	defer server.Close()
+
+	resp, err := http.PostForm(server.URL, url.Values{
+		"host":         {"proxied.com"},
+		"ip":           {"10.10.10.10"},
+		"reqHeader":    {"set:X-Forwarded-Proto:https"},
+		"resHeader":    {"remove:X-Frame-Options", "add:X-Robots-Tag:noindex"},
+		"cookieDomain": {"on"},
+	})
+	if !assert.NoError(t, err, "request should work") {
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "should create the proxy - %s", body)
+	contents, err := ioutil.ReadFile(filepath.Join(testConfig.confPath, strings.TrimSpace(string(body))+".conf"))
+	assert.NoError(t, err, "the config should be written")
+	assert.Equal(t, "set X-Forwarded-Proto https|remove X-Frame-Options |add X-Robots-Tag noindex|true",
+		string(contents), "wrong rules written")
+
+	resp, err = http.PostForm(server.URL, url.Values{
+		"host":      {"proxied.com"},
+		"ip":        {"10.10.10.10"},
+		"resHeader": {"X-Frame-Options"},
+	})
+	if assert.NoError(t, err, "request should work") {
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode, "a malformed rule should be refused")
+	}
+}
+
+func TestHeaderRules_outputs(t *testing.T) {
+	rules := []headerRule{
+		{Action: HeaderSet, Name: "X-A", Value: "$remote_addr"},
+		{Action: HeaderSet, Name: "X-A", Value: "%[env(SECRET)]"},
+		{Action: HeaderSet, Name: "X-A", Value: "%{SECRET}e"},
+		{Action: HeaderSet, Name: "X-A", Value: "{env.SECRET}"},
+	}
+	for _, file := range []string{"proxy.template", "proxy.apache.template",
+		"proxy.haproxy.template", "proxy.caddy.template"} {
+
+		testConfig := HandlerConfig{
+			baseURL:      "proxy.com",
+			confPath:     t.TempDir(),
+			confExt:      "conf",
+			confTempl:    template.Must(parseTemplate(filepath.Join("..", file))),
+			subdomainLen: 8,
+		}
+		for _, rule := range rules {
+			_, locErr := confCheck(siteParams{IntHost: "domain.com", IntIP: "10.0.0.1",
+				RequestHeaders: []headerRule{rule}, ResponseHeaders: []headerRule{rule}}, testConfig)
+			assert.ErrorIs(t, locErr, ErrBadHeaderRule, "%s - %q should never be written", file, rule.Value)
+		}
+
+		site, locErr := confCheck(siteParams{IntHost: "domain.com", IntIP: "10.0.0.1",
+			RequestHeaders:  []headerRule{{Action: HeaderSet, Name: "X-A", Value: "a \"b\" c"}},
+			ResponseHeaders: []headerRule{{Action: HeaderSet, Name: "X-B", Value: "max-age=60; d"}}}, testConfig)
+		if !assert.Nil(t, locErr, "%s - plain values should be taken - %v", file, locErr) {
+			continue
+		}
+		site, locErr = confWrite(testConfig)(site)
+		if !assert.Nil(t, locErr, "%s - should write - %v", file, locErr) {
+			continue
+		}
+		contents, _ := ioutil.ReadFile(testConfig.confOutputs()[0].fileName(site.ExtHost))
+		assert.Contains(t, string(contents), `"a \"b\" c"`, "%s - the request value should be quoted", file)
+		assert.Contains(t, string(contents), `"max-age=60; d"`, "%s - the response value should be quoted", file)
+	}
+}
@@ -0,0 +1,197 @@
+package moxxiConf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheckTimeout is how long an external check (nginx -t) is allowed to run
+const HealthCheckTimeout = 10 * time.Second
+
+// HealthLivePath is the path below a health handler that only checks liveness
+const HealthLivePath = "live"
+
+// HealthCommandTTL is how long the result of an external check is reused
+const HealthCommandTTL = 30 * time.Second
+
+// healthCheck - the result of one readiness check
+type healthCheck struct {
+	Name    string
+	Handler string `json:",omitempty"`
+	OK      bool
+	Error   string `json:",omitempty"`
+}
+
+// healthReport - the full response from a health handler
+type healthReport struct {
+	Status string
+	Checks []healthCheck `json:",omitempty"`
+}
+
+func newHealthCheck(name, handler string, err error) healthCheck {
+	c := healthCheck{Name: name, Handler: handler, OK: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	return c
+}
+
+// checkWritable makes sure dir is a directory we can create files in
+func checkWritable(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	f, err := ioutil.TempFile(dir, ".moxxi-health-")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	if err = f.Close(); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return os.Remove(name)
+}
+
+// checkFreeSpace makes sure at least min bytes are available in dir
+func checkFreeSpace(dir string, min uint64) error {
+	free, err := diskFree(dir)
+	if err != nil {
+		return err
+	}
+	if free < min {
+		return fmt.Errorf("only %d bytes free in %s, want %d", free, dir, min)
+	}
+	return nil
+}
+
+// checkCommand runs an external command and fails if it does not exit cleanly
+func checkCommand(command []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), HealthCheckTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v - %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// commandCheck - an external check that runs at most once per ttl, so a load
+// balancer probing often does not run nginx -t on every probe
+type commandCheck struct {
+	sync.Mutex
+	command []string
+	ttl     time.Duration
+	ran     time.Time
+	err     error
+}
+
+// check gives the last result of the command, running it again if it is stale
+func (c *commandCheck) check() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.ran.IsZero() || time.Since(c.ran) >= c.ttl {
+		c.err = checkCommand(c.command)
+		c.ran = time.Now()
+	}
+	return c.err
+}
+
+// readiness runs every check that applies to the handlers that create proxies
+func readiness(config HandlerConfig, handlers []HandlerConfig, nginx *commandCheck) []healthCheck {
+	var checks []healthCheck
+	seenPaths := make(map[string]bool)
+
+	for _, handler := range handlers {
+		if handler.handlerType != "form" && handler.handlerType != "json" {
+			continue
+		}
+		route := handler.handlerRoute
+
+		outputs := handler.confOutputs()
+
+		var err error
+		if handler.resTempl == nil {
+			err = fmt.Errorf("resFile was not parsed")
+		}
+		for _, out := range outputs {
+			if out.confTempl == nil {
+				err = fmt.Errorf("confFile was not parsed")
+			}
+		}
+		checks = append(checks, newHealthCheck("templates", route, err))
+
+		if handler.ipFile != "" {
+			err = nil
+			if len(handler.ipList) < 1 {
+				err = fmt.Errorf("no ranges loaded from %s", handler.ipFile)
+			}
+			checks = append(checks, newHealthCheck("ipFile", route, err))
+		}
+
+		for _, out := range outputs {
+			if seenPaths[out.confPath] {
+				continue
+			}
+			seenPaths[out.confPath] = true
+
+			checks = append(checks, newHealthCheck("confPath "+out.confPath, route,
+				checkWritable(out.confPath)))
+
+			if config.minFreeSpace > 0 {
+				checks = append(checks, newHealthCheck("freeSpace "+out.confPath, route,
+					checkFreeSpace(out.confPath, config.minFreeSpace)))
+			}
+		}
+	}
+
+	if nginx != nil {
+		checks = append(checks, newHealthCheck("nginx", "", nginx.check()))
+	}
+
+	return checks
+}
+
+// HealthHandler - creates and returns a Handler reporting liveness and readiness
+// the handlerRoute followed by HealthLivePath only reports that moxxi is up,
+// anything else runs every readiness check and responds 503 if any fail
+func HealthHandler(config HandlerConfig, handlers []HandlerConfig) http.HandlerFunc {
+	var nginx *commandCheck
+	if len(config.nginxTest) > 0 {
+		nginx = &commandCheck{command: config.nginxTest, ttl: HealthCommandTTL}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := healthReport{Status: "ok"}
+		code := http.StatusOK
+
+		if strings.Trim(strings.TrimPrefix(r.URL.Path, config.handlerRoute), PathSep) != HealthLivePath {
+			report.Checks = readiness(config, handlers, nginx)
+			for _, each := range report.Checks {
+				if !each.OK {
+					report.Status = "fail"
+					code = http.StatusServiceUnavailable
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(report)
+	}
+}
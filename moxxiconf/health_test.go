@@ -0,0 +1,123 @@
+package moxxiConf
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthHandler(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "moxxi_test_")
+	assert.Nil(t, err, "could not make temp dir - %v", err)
+	defer os.RemoveAll(dir)
+
+	templ := template.Must(template.New("testing").Parse("{{ .ExtHost }}"))
+	good := HandlerConfig{
+		handlerType:  "form",
+		handlerRoute: "/form/",
+		confPath:     dir,
+		confTempl:    templ,
+		resTempl:     templ,
+	}
+	noTemplates := good
+	noTemplates.resTempl = nil
+	badPath := good
+	badPath.confPath = "/bad/directory"
+	noIPs := good
+	noIPs.ipFile = "/etc/moxxi/ips"
+
+	var testData = []struct {
+		health   HandlerConfig
+		handlers []HandlerConfig
+		path     string
+		resCode  int
+		failed   []string
+	}{
+		{
+			handlers: []HandlerConfig{good},
+			resCode:  http.StatusOK,
+		}, {
+			handlers: []HandlerConfig{badPath},
+			path:     HealthLivePath,
+			resCode:  http.StatusOK,
+		}, {
+			handlers: []HandlerConfig{good, badPath},
+			resCode:  http.StatusServiceUnavailable,
+			failed:   []string{"confPath /bad/directory"},
+		}, {
+			handlers: []HandlerConfig{noTemplates, noIPs},
+			resCode:  http.StatusServiceUnavailable,
+			failed:   []string{"templates", "ipFile"},
+		}, {
+			health:   HandlerConfig{minFreeSpace: 1 << 62},
+			handlers: []HandlerConfig{good},
+			resCode:  http.StatusServiceUnavailable,
+			failed:   []string{"freeSpace " + dir},
+		}, {
+			health:   HandlerConfig{nginxTest: []string{"true"}},
+			handlers: []HandlerConfig{good},
+			resCode:  http.StatusOK,
+		}, {
+			health:   HandlerConfig{nginxTest: []string{"false"}},
+			handlers: []HandlerConfig{good},
+			resCode:  http.StatusServiceUnavailable,
+			failed:   []string{"nginx"},
+		},
+	}
+
+	for id, test := range testData {
+		server := httptest.NewServer(HealthHandler(test.health, test.handlers))
+
+		resp, err := http.Get(server.URL + "/" + test.path)
+		assert.NoError(t, err, "test %d - got an error I should not have", id)
+		if err != nil {
+			server.Close()
+			continue
+		}
+
+		var report healthReport
+		err = json.NewDecoder(resp.Body).Decode(&report)
+		resp.Body.Close()
+		server.Close()
+		assert.NoError(t, err, "test %d - could not decode the report", id)
+
+		assert.Equal(t, test.resCode, resp.StatusCode, "test %d - got the wrong response code", id)
+
+		var failed []string
+		for _, each := range report.Checks {
+			if !each.OK {
+				failed = append(failed, each.Name)
+			}
+		}
+		assert.Equal(t, test.failed, failed, "test %d - wrong checks failed", id)
+	}
+}
+
+func TestCommandCheck(t *testing.T) {
+	dir := t.TempDir()
+	count := filepath.Join(dir, "count")
+	c := &commandCheck{command: []string{"sh", "-c", "echo run >> " + count}, ttl: time.Hour}
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, c.check(), "check %d should pass", i)
+	}
+	runs, _ := ioutil.ReadFile(count)
+	assert.Equal(t, "run\n", string(runs), "the command should only run once within the ttl")
+
+	c.ran = time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, c.check(), "a stale check should pass")
+	runs, _ = ioutil.ReadFile(count)
+	assert.Equal(t, "run\nrun\n", string(runs), "a stale result should run the command again")
+
+	c = &commandCheck{command: []string{"false"}, ttl: time.Hour}
+	assert.Error(t, c.check(), "a failing command should fail")
+	assert.Error(t, c.check(), "the failure should be kept")
+}
@@ -0,0 +1,8 @@
+package moxxiConf
+
+import "fmt"
+
+// diskFree is not supported on windows
+func diskFree(path string) (uint64, error) {
+	return 0, fmt.Errorf("free space check is not supported on windows")
+}
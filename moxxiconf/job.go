@@ -0,0 +1,145 @@
+package moxxiConf
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+// JobIDLen is the length of the random ID handed out for each batch job
+const JobIDLen = 16
+
+// job - one asynchronous batch submission and the results collected so far
+type job struct {
+	sync.Mutex
+	id       string
+	created  time.Time
+	finished time.Time
+	total    int
+	done     int
+	results  []siteParams
+}
+
+// jobStatus - a point in time copy of a job, safe to hand to encoders
+type jobStatus struct {
+	ID       string
+	Created  time.Time
+	Finished time.Time `json:",omitempty"`
+	Total    int
+	Done     int
+	Complete bool
+	Results  []siteParams `json:",omitempty"`
+}
+
+// status takes a snapshot of the job - results are only included once done
+func (j *job) status() jobStatus {
+	j.Lock()
+	defer j.Unlock()
+
+	s := jobStatus{
+		ID:       j.id,
+		Created:  j.created,
+		Finished: j.finished,
+		Total:    j.total,
+		Done:     j.done,
+		Complete: j.done >= j.total,
+	}
+	if s.Complete {
+		s.Results = append([]siteParams{}, j.results...)
+		// generated passwords are only handed out the first time
+		for id := range j.results {
+			j.results[id].AuthPassword = ""
+		}
+	}
+	return s
+}
+
+// record stores the result for one site within the job
+func (j *job) record(id int, site siteParams) {
+	j.Lock()
+	defer j.Unlock()
+
+	j.results[id] = site
+	j.done++
+	if j.done >= j.total {
+		j.finished = time.Now()
+	}
+}
+
+// jobStore - keeps track of all jobs for a handler until they expire
+type jobStore struct {
+	sync.Mutex
+	retention time.Duration
+	jobs      map[string]*job
+}
+
+func newJobStore(retention time.Duration) *jobStore {
+	if retention <= 0 {
+		retention = DefaultJobRetention
+	}
+	return &jobStore{
+		retention: retention,
+		jobs:      make(map[string]*job),
+	}
+}
+
+// add creates a new job expecting total results and returns it
+// no more than MaxLiveJobs can be unfinished at once
+func (s *jobStore) add(total int) (*job, Err) {
+	s.Lock()
+	defer s.Unlock()
+	s.expire()
+
+	live := 0
+	for _, j := range s.jobs {
+		j.Lock()
+		if j.finished.IsZero() {
+			live++
+		}
+		j.Unlock()
+	}
+	if live >= MaxLiveJobs {
+		return nil, &NewErr{Code: ErrTooManyJobs}
+	}
+
+	j := &job{
+		created: time.Now(),
+		total:   total,
+		results: make([]siteParams, total),
+	}
+	if total < 1 {
+		j.finished = j.created
+	}
+
+	for {
+		j.id = uniuri.NewLen(JobIDLen)
+		if _, ok := s.jobs[j.id]; !ok {
+			break
+		}
+	}
+	s.jobs[j.id] = j
+	return j, nil
+}
+
+// get returns the job with the given id, or nil if it does not exist
+func (s *jobStore) get(id string) *job {
+	s.Lock()
+	defer s.Unlock()
+	s.expire()
+
+	return s.jobs[id]
+}
+
+// expire removes every finished job older than the retention period
+// must be called with the lock held
+func (s *jobStore) expire() {
+	cutoff := time.Now().Add(-s.retention)
+	for id, j := range s.jobs {
+		j.Lock()
+		if !j.finished.IsZero() && j.finished.Before(cutoff) {
+			delete(s.jobs, id)
+		}
+		j.Unlock()
+	}
+}
@@ -0,0 +1,62 @@
+package moxxiConf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobStore(t *testing.T) {
+	store := newJobStore(time.Minute)
+
+	j, locErr := store.add(2)
+	assert.Nil(t, locErr, "should have made the job - %v", locErr)
+	assert.Len(t, j.id, JobIDLen, "job id was the wrong length")
+	assert.Equal(t, j, store.get(j.id), "did not get the same job back")
+	assert.Nil(t, store.get("notarealjob"), "should not have found a job")
+
+	status := j.status()
+	assert.False(t, status.Complete, "job should not be complete yet")
+	assert.Equal(t, 0, status.Done, "nothing should be done yet")
+	assert.Nil(t, status.Results, "results should be hidden until complete")
+
+	j.record(1, siteParams{ExtHost: "second"})
+	j.record(0, siteParams{ExtHost: "first"})
+
+	status = j.status()
+	assert.True(t, status.Complete, "job should be complete")
+	assert.Equal(t, 2, status.Done, "both sites should be done")
+	assert.Equal(t, []siteParams{{ExtHost: "first"}, {ExtHost: "second"}},
+		status.Results, "results came back in the wrong order")
+}
+
+func TestJobStore_expire(t *testing.T) {
+	store := newJobStore(time.Minute)
+
+	finished, _ := store.add(0)
+	running, _ := store.add(1)
+
+	finished.finished = time.Now().Add(-2 * time.Minute)
+
+	assert.Nil(t, store.get(finished.id), "finished job should have expired")
+	assert.NotNil(t, store.get(running.id), "running job should never expire")
+}
+
+func TestJobStore_live(t *testing.T) {
+	store := newJobStore(time.Minute)
+
+	for i := 0; i < MaxLiveJobs; i++ {
+		_, locErr := store.add(1)
+		assert.Nil(t, locErr, "job %d should have been taken - %v", i, locErr)
+	}
+	_, locErr := store.add(0)
+	assert.ErrorIs(t, locErr, ErrTooManyJobs, "should refuse a job over the limit")
+
+	for _, j := range store.jobs {
+		j.record(0, siteParams{})
+		break
+	}
+	_, locErr = store.add(1)
+	assert.Nil(t, locErr, "a finished job should make room - %v", locErr)
+}
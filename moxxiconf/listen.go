@@ -0,0 +1,147 @@
+package moxxiConf
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// UnixPrefix marks a listen address as the path to a unix socket
+const UnixPrefix = "unix:"
+
+// SystemdPrefix marks a listen address as a socket handed over by systemd
+const SystemdPrefix = "systemd:"
+
+// DefaultSocketMode is the permissions given to unix sockets moxxi creates
+const DefaultSocketMode os.FileMode = 0660
+
+// systemd passes sockets starting at this file descriptor
+const systemdFirstFD = 3
+
+var systemdOnce sync.Once
+var systemdListeners []net.Listener
+var systemdNames []string
+var systemdErr error
+
+// Listen opens the listener described by the config
+// Addresses can be a TCP host:port, unix:/path/to.sock, or systemd:name where
+// name is either the FileDescriptorName or the index of a socket passed in
+// through socket activation.
+func (l ListenConfig) Listen() (net.Listener, Err) {
+	var ln net.Listener
+	var err error
+
+	switch {
+	case strings.HasPrefix(l.Addr, UnixPrefix):
+		ln, err = listenUnix(strings.TrimPrefix(l.Addr, UnixPrefix), l.SocketMode)
+	case strings.HasPrefix(l.Addr, SystemdPrefix):
+		ln, err = systemdListener(strings.TrimPrefix(l.Addr, SystemdPrefix))
+	default:
+		ln, err = net.Listen("tcp", l.Addr)
+	}
+
+	if err != nil {
+		return nil, NewErr{Code: ErrListen, value: l.Addr, deepErr: err}
+	}
+	return ln, nil
+}
+
+// listenUnix creates a unix socket, replacing a stale one left behind
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode == 0 {
+		mode = DefaultSocketMode
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// systemdListener returns one of the sockets passed in by systemd
+func systemdListener(name string) (net.Listener, error) {
+	systemdOnce.Do(func() {
+		systemdListeners, systemdNames, systemdErr = loadSystemdListeners()
+	})
+	if systemdErr != nil {
+		return nil, systemdErr
+	}
+
+	if name == "" {
+		name = "0"
+	}
+	for id, each := range systemdNames {
+		if each == name {
+			return systemdListeners[id], nil
+		}
+	}
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 && id < len(systemdListeners) {
+		return systemdListeners[id], nil
+	}
+	return nil, fmt.Errorf("no socket %s was passed in by systemd", name)
+}
+
+// loadSystemdListeners picks up the sockets from LISTEN_FDS
+// the environment is cleared so children do not try to use them as well
+func loadSystemdListeners() ([]net.Listener, []string, error) {
+	count, names, err := parseSystemdEnv(os.Getpid(),
+		os.Getenv("LISTEN_PID"),
+		os.Getenv("LISTEN_FDS"),
+		os.Getenv("LISTEN_FDNAMES"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var listeners []net.Listener
+	for id := 0; id < count; id++ {
+		f := os.NewFile(uintptr(systemdFirstFD+id), names[id])
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("socket %d from systemd - %v", id, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, names, nil
+}
+
+// parseSystemdEnv checks the socket activation variables were meant for us
+func parseSystemdEnv(pid int, listenPID, listenFDs, listenNames string) (int, []string, error) {
+	if listenPID == "" || listenFDs == "" {
+		return 0, nil, fmt.Errorf("not started with systemd socket activation")
+	}
+	if listenPID != strconv.Itoa(pid) {
+		return 0, nil, fmt.Errorf("sockets were passed to pid %s, not %d", listenPID, pid)
+	}
+
+	count, err := strconv.Atoi(listenFDs)
+	if err != nil || count < 1 {
+		return 0, nil, fmt.Errorf("bad LISTEN_FDS value %q", listenFDs)
+	}
+
+	names := make([]string, count)
+	if listenNames != "" {
+		copy(names, strings.Split(listenNames, ":"))
+	}
+	return count, names, nil
+}
@@ -0,0 +1,64 @@
+package moxxiConf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListen_unix(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "moxxi_test_")
+	assert.Nil(t, err, "could not make temp dir - %v", err)
+	defer os.RemoveAll(dir)
+
+	sockPath := filepath.Join(dir, "moxxi.sock")
+	l := ListenConfig{Addr: UnixPrefix + sockPath, SocketMode: 0600}
+
+	ln, locErr := l.Listen()
+	assert.Nil(t, locErr, "got an error opening the socket - %v", locErr)
+
+	info, err := os.Stat(sockPath)
+	assert.Nil(t, err, "socket was not created - %v", err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "socket had the wrong permissions")
+
+	// leave a stale socket behind and make sure it gets replaced
+	ln.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	ln.Close()
+
+	ln, locErr = l.Listen()
+	assert.Nil(t, locErr, "got an error replacing a stale socket - %v", locErr)
+	ln.Close()
+
+	notSock := filepath.Join(dir, "regular")
+	assert.Nil(t, ioutil.WriteFile(notSock, []byte("data"), 0644), "could not write file")
+	_, locErr = ListenConfig{Addr: UnixPrefix + notSock}.Listen()
+	if assert.NotNil(t, locErr, "should not replace a regular file") {
+		assert.Equal(t, ErrListen, locErr.GetCode(), "got the wrong error type back")
+	}
+}
+
+func TestParseSystemdEnv(t *testing.T) {
+	var testData = []struct {
+		pid, fds, names string
+		count           int
+		outNames        []string
+		ok              bool
+	}{
+		{"100", "2", "http:https", 2, []string{"http", "https"}, true},
+		{"100", "2", "", 2, []string{"", ""}, true},
+		{"100", "1", "http:extra", 1, []string{"http"}, true},
+		{"101", "1", "", 0, nil, false},
+		{"", "", "", 0, nil, false},
+		{"100", "zero", "", 0, nil, false},
+	}
+
+	for id, test := range testData {
+		count, names, err := parseSystemdEnv(100, test.pid, test.fds, test.names)
+		assert.Equal(t, test.ok, err == nil, "test %d - wrong error result - %v", id, err)
+		assert.Equal(t, test.count, count, "test %d - wrong socket count", id)
+		assert.Equal(t, test.outNames, names, "test %d - wrong socket names", id)
+	}
+}
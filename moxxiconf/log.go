@@ -0,0 +1,76 @@
+package moxxiConf
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// RequestIDHeader is the header a request ID is read from and returned in
+const RequestIDHeader = "X-Request-ID"
+
+// NewLogger - creates the structured logger used throughout the application
+// format is either "json" or "logfmt" (the default), and level is one of
+// debug, info, warn, or error
+func NewLogger(w io.Writer, format, level string) (*slog.Logger, Err) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, NewErr{Code: ErrConfigBadValue, value: "logLevel", deepErr: err}
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "logfmt", "":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	default:
+		return nil, NewErr{
+			Code:    ErrConfigBadValue,
+			value:   "logFormat",
+			deepErr: fmt.Errorf("want json or logfmt, got %q", format),
+		}
+	}
+}
+
+// logResult - writes one record for each attempt to create a proxy
+// site should be what was asked for, as a failed check returns an empty site
+func logResult(l *slog.Logger, r *http.Request, config HandlerConfig,
+	site siteParams, err Err) {
+
+	attrs := resultAttrs(r, config, site)
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", tagRequest(err, r)))
+		l.LogAttrs(r.Context(), slog.LevelError, "proxy failed", attrs...)
+		return
+	}
+	l.LogAttrs(r.Context(), slog.LevelInfo, "proxy created", attrs...)
+}
+
+// logWarning - writes the record for a proxy that was created even though
+// something went wrong, like a failed redirect trace
+func logWarning(l *slog.Logger, r *http.Request, config HandlerConfig,
+	site siteParams, warning Err) {
+
+	if warning == nil {
+		logResult(l, r, config, site, nil)
+		return
+	}
+	attrs := append(resultAttrs(r, config, site), slog.Any("warning", tagRequest(warning, r)))
+	l.LogAttrs(r.Context(), slog.LevelWarn, "proxy created", attrs...)
+}
+
+// resultAttrs - what every record about a proxy starts with
+func resultAttrs(r *http.Request, config HandlerConfig, site siteParams) []slog.Attr {
+	return []slog.Attr{
+		slog.String("requestID", RequestID(r)),
+		slog.String("client", r.RemoteAddr),
+		slog.String("route", config.handlerRoute),
+		slog.String("extHost", site.ExtHost),
+		slog.String("intHost", site.IntHost),
+		slog.String("intIP", site.IntIP),
+	}
+}
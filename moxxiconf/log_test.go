@@ -0,0 +1,105 @@
+package moxxiConf
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLogger(t *testing.T) {
+	var testData = []struct {
+		format  string
+		level   string
+		prefix  string
+		debug   bool
+		errCode ErrCode
+	}{
+		{format: "json", level: "info", prefix: "{"},
+		{format: "logfmt", level: "debug", prefix: "time=", debug: true},
+		{format: "", level: "", prefix: "time="},
+		{format: "xml", errCode: ErrConfigBadValue},
+		{format: "json", level: "loud", errCode: ErrConfigBadValue},
+	}
+
+	for id, test := range testData {
+		var out bytes.Buffer
+		l, err := NewLogger(&out, test.format, test.level)
+		if test.errCode != 0 {
+			if assert.NotNil(t, err, "test %d - should have gotten an error", id) {
+				assert.Equal(t, test.errCode, err.GetCode(), "test %d - wrong error", id)
+			}
+			continue
+		}
+		assert.Nil(t, err, "test %d - got an error - %v", id, err)
+
+		l.Debug("debugging")
+		assert.Equal(t, test.debug, strings.Contains(out.String(), "debugging"),
+			"test %d - debug logging was wrong", id)
+
+		out.Reset()
+		l.Info("testing")
+		assert.True(t, strings.HasPrefix(out.String(), test.prefix),
+			"test %d - wrong format - %s", id, out.String())
+	}
+}
+
+func TestLogResult(t *testing.T) {
+	var out bytes.Buffer
+	l, _ := NewLogger(&out, "json", "info")
+
+	r, _ := http.NewRequest("POST", "http://moxxi.com/form/", nil)
+	r.RemoteAddr = "10.0.0.1:5555"
+	r = withRequestID(r, "abc123")
+	config := HandlerConfig{handlerRoute: "/form/"}
+	site := siteParams{ExtHost: "x.test.com", IntHost: "domain.com", IntIP: "127.0.0.1"}
+
+	logResult(l, r, config, site, nil)
+	logResult(l, r, config, site, &NewErr{Code: ErrBadIP, value: "127.1"})
+	logWarning(l, r, config, site, &NewErr{Code: ErrBadHostnameTrace, value: "http://domain.com/"})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if !assert.Len(t, lines, 3, "should have gotten one record per result") {
+		return
+	}
+
+	var record map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &record), "bad record")
+	assert.Equal(t, "INFO", record["level"], "wrong level for success")
+	assert.Equal(t, "proxy created", record["msg"], "wrong message for success")
+	for key, value := range map[string]string{
+		"requestID": "abc123",
+		"client":    "10.0.0.1:5555",
+		"route":     "/form/",
+		"extHost":   "x.test.com",
+		"intHost":   "domain.com",
+		"intIP":     "127.0.0.1",
+	} {
+		assert.Equal(t, value, record[key], "wrong value for %s", key)
+	}
+	assert.Nil(t, record["error"], "success should not have an error")
+
+	record = nil
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &record), "bad record")
+	assert.Equal(t, "ERROR", record["level"], "wrong level for failure")
+	assert.Equal(t, map[string]interface{}{
+		"code":      float64(ErrBadIP),
+		"id":        "bad_ip",
+		"message":   "bad IP provided [127.1]",
+		"value":     "127.1",
+		"requestID": "abc123",
+	}, record["error"], "wrong error recorded")
+
+	record = nil
+	assert.NoError(t, json.Unmarshal([]byte(lines[2]), &record), "bad record")
+	assert.Equal(t, "WARN", record["level"], "wrong level for a warning")
+	assert.Equal(t, "proxy created", record["msg"], "a warning is still a created proxy")
+	assert.Equal(t, "x.test.com", record["extHost"], "should log the site written")
+	assert.Nil(t, record["error"], "a warning should not have an error")
+	if warning, ok := record["warning"].(map[string]interface{}); assert.True(t, ok, "should have a warning") {
+		assert.Equal(t, "bad_hostname_trace", warning["id"], "wrong warning recorded")
+	}
+}
@@ -0,0 +1,198 @@
+package moxxiConf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrorIDHeader carries the stable identifier of an error sent to a client
+const ErrorIDHeader = "X-Moxxi-Error"
+
+// MessageExt is the extension of the translated message files in messageDir
+const MessageExt = ".json"
+
+// messages - translated error messages, by language and then code
+type messages map[string]map[ErrCode]string
+
+// loadMessages reads every translation file in dir
+// each file is named for its language (de.json, pt-br.json) and holds an
+// object of error ID to message, which must take the same arguments as the
+// English message it replaces
+func loadMessages(dir string) (messages, Err) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+MessageExt))
+	if err != nil {
+		return nil, NewErr{Code: ErrConfigBadMessages, value: dir, deepErr: err}
+	}
+
+	codes := make(map[string]ErrCode, len(errID))
+	for code, id := range errID {
+		codes[id] = code
+	}
+
+	all := make(messages)
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, NewErr{Code: ErrConfigBadMessages, value: file, deepErr: err}
+		}
+		var byID map[string]string
+		if err = json.Unmarshal(raw, &byID); err != nil {
+			return nil, NewErr{Code: ErrConfigBadMessages, value: file, deepErr: err}
+		}
+
+		lang := strings.ToLower(strings.TrimSuffix(filepath.Base(file), MessageExt))
+		all[lang] = make(map[ErrCode]string, len(byID))
+		for id, msg := range byID {
+			code, ok := codes[id]
+			if !ok {
+				return nil, NewErr{Code: ErrConfigBadMessages, value: file,
+					deepErr: fmt.Errorf("unknown error id %q", id)}
+			}
+			if countVerbs(msg) != countVerbs(errMsg[code]) {
+				return nil, NewErr{Code: ErrConfigBadMessages, value: file,
+					deepErr: fmt.Errorf("%s does not take the same arguments as %q",
+						id, errMsg[code])}
+			}
+			all[lang][code] = msg
+		}
+	}
+	return all, nil
+}
+
+// countVerbs counts the printf verbs in a message, ignoring %%
+func countVerbs(msg string) int {
+	var count int
+	for i := 0; i < len(msg); i++ {
+		if msg[i] != '%' {
+			continue
+		}
+		if i+1 < len(msg) && msg[i+1] == '%' {
+			i++
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// forRequest picks the translation for the first language the request accepts
+// a nil map is returned if there is none, which falls back to English
+func (m messages) forRequest(r *http.Request) map[ErrCode]string {
+	for _, lang := range requestLanguages(r) {
+		if msgs, ok := m[lang]; ok {
+			return msgs
+		}
+		if base, _, found := strings.Cut(lang, "-"); found {
+			if msgs, ok := m[base]; ok {
+				return msgs
+			}
+		}
+	}
+	return nil
+}
+
+// requestLanguages lists the languages a request asks for, most preferred first
+// a lang query value comes before anything in the Accept-Language header - the
+// body is never looked at, so this is safe while a batch is still being read
+func requestLanguages(r *http.Request) []string {
+	var langs []string
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		langs = append(langs, strings.ToLower(lang))
+	}
+
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var accepted []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		lang, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		lang = strings.ToLower(strings.TrimSpace(lang))
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			accepted = append(accepted, weighted{lang: lang, q: q})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].q > accepted[j].q
+	})
+	for _, each := range accepted {
+		langs = append(langs, each.lang)
+	}
+	return langs
+}
+
+// localize gives the message for err in the language the request asked for
+func localize(config HandlerConfig, r *http.Request, err Err) string {
+	return err.Localize(config.messages.forRequest(r))
+}
+
+// sendErr writes err back to the client in its language
+// the error ID goes in a header so clients do not have to parse the message
+func sendErr(w http.ResponseWriter, r *http.Request, config HandlerConfig, err Err) {
+	w.Header().Set(ErrorIDHeader, err.GetCode().ID())
+	http.Error(w, localize(config, r, err), err.HTTPStatus())
+}
+
+// catalogueEntry - one error in the catalogue
+type catalogueEntry struct {
+	Code         int
+	ID           string
+	Message      string
+	Status       int
+	Translations map[string]string `json:",omitempty"`
+}
+
+// errorCatalogue lists every error, in code order, with any translations
+func errorCatalogue(msgs messages) []catalogueEntry {
+	codes := make([]int, 0, len(errMsg))
+	for code := range errMsg {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+
+	entries := make([]catalogueEntry, 0, len(codes))
+	for _, each := range codes {
+		code := ErrCode(each)
+		entry := catalogueEntry{
+			Code:    each,
+			ID:      code.ID(),
+			Message: errMsg[code],
+			Status:  NewErr{Code: code}.HTTPStatus(),
+		}
+		for lang, translated := range msgs {
+			if msg, ok := translated[code]; ok {
+				if entry.Translations == nil {
+					entry.Translations = make(map[string]string)
+				}
+				entry.Translations[lang] = msg
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// ErrorCatalogueHandler - creates and returns a Handler listing every error
+// code moxxi can return, with its ID, message, status and translations
+func ErrorCatalogueHandler(config HandlerConfig) http.HandlerFunc {
+	catalogue := errorCatalogue(config.messages)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(catalogue)
+	}
+}
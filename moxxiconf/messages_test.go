@@ -0,0 +1,169 @@
+package moxxiConf
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMessages(t *testing.T) {
+	var testData = []struct {
+		files   map[string]string
+		out     messages
+		errCode ErrCode
+	}{
+		{
+			files: map[string]string{
+				"de.json":    `{"blocked_ip": "IP-Adresse [%s] ist nicht erlaubt"}`,
+				"PT-BR.json": `{"no_ip": "nenhum IP informado"}`,
+				"notes.txt":  `not a translation`,
+			},
+			out: messages{
+				"de":    {ErrBlockedIP: "IP-Adresse [%s] ist nicht erlaubt"},
+				"pt-br": {ErrNoIP: "nenhum IP informado"},
+			},
+		}, {
+			files:   map[string]string{"de.json": `{"not_an_error": "egal"}`},
+			errCode: ErrConfigBadMessages,
+		}, {
+			files:   map[string]string{"de.json": `{"blocked_ip": "IP-Adresse ist nicht erlaubt"}`},
+			errCode: ErrConfigBadMessages,
+		}, {
+			files:   map[string]string{"de.json": `["blocked_ip"]`},
+			errCode: ErrConfigBadMessages,
+		},
+	}
+
+	for id, test := range testData {
+		dir, err := ioutil.TempDir(os.TempDir(), "moxxi_test_")
+		assert.Nil(t, err, "could not make temp dir - %v", err)
+		for name, content := range test.files {
+			assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+		}
+
+		out, locErr := loadMessages(dir)
+		os.RemoveAll(dir)
+		if test.errCode != 0 {
+			assert.ErrorIs(t, locErr, test.errCode, "test %d - wrong error", id)
+			continue
+		}
+		assert.Nil(t, locErr, "test %d - unexpected error - %v", id, locErr)
+		assert.Equal(t, test.out, out, "test %d - wrong messages", id)
+	}
+}
+
+func TestCountVerbs(t *testing.T) {
+	var testData = []struct {
+		in  string
+		out int
+	}{
+		{"no provided IP", 0},
+		{"bad IP provided [%s]", 1},
+		{"failed to close the file [%s] - %v", 2},
+		{"100%% sure [%s]", 1},
+		{"trailing %", 1},
+	}
+	for id, test := range testData {
+		assert.Equal(t, test.out, countVerbs(test.in), "test %d - wrong count", id)
+	}
+}
+
+func TestRequestLanguages(t *testing.T) {
+	var testData = []struct {
+		query  string
+		header string
+		out    []string
+	}{
+		{"", "", nil},
+		{"", "de-DE,de;q=0.9,en;q=0.8", []string{"de-de", "de", "en"}},
+		{"", "en;q=0.5, fr, *;q=0.1, es;q=0", []string{"fr", "en"}},
+		{"?lang=PT-BR", "de", []string{"pt-br", "de"}},
+	}
+	for id, test := range testData {
+		r := httptest.NewRequest("GET", "/"+test.query, nil)
+		if test.header != "" {
+			r.Header.Set("Accept-Language", test.header)
+		}
+		assert.Equal(t, test.out, requestLanguages(r), "test %d - wrong languages", id)
+	}
+}
+
+func TestRequestLanguages_body(t *testing.T) {
+	r := httptest.NewRequest("POST", "/?lang=de", strings.NewReader("lang=fr&host=proxied.com"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	assert.Equal(t, []string{"de"}, requestLanguages(r), "only the query should be used")
+	body, _ := ioutil.ReadAll(r.Body)
+	assert.Equal(t, "lang=fr&host=proxied.com", string(body), "the body should not have been read")
+}
+
+func TestSendErr(t *testing.T) {
+	config := HandlerConfig{messages: messages{
+		"de": {ErrNoIP: "keine IP angegeben"},
+	}}
+
+	var testData = []struct {
+		header string
+		body   string
+	}{
+		{"de-AT,en;q=0.5", "keine IP angegeben\n"},
+		{"fr", "no provided IP\n"},
+		{"", "no provided IP\n"},
+	}
+	for id, test := range testData {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Language", test.header)
+		w := httptest.NewRecorder()
+		sendErr(w, r, config, NewErr{Code: ErrNoIP})
+
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code, "test %d - wrong status", id)
+		assert.Equal(t, "no_ip", w.Header().Get(ErrorIDHeader), "test %d - wrong error ID", id)
+		assert.Equal(t, test.body, w.Body.String(), "test %d - wrong message", id)
+	}
+}
+
+func TestErrorCatalogueHandler(t *testing.T) {
+	msgs := messages{
+		"de": {ErrBlockedIP: "IP-Adresse [%s] ist nicht erlaubt"},
+	}
+	server := httptest.NewServer(CreateMux(context.Background(), []HandlerConfig{{
+		handlerType:  "errors",
+		handlerRoute: "/errors",
+		messages:     msgs,
+	}}, slog.New(slog.NewTextHandler(ioutil.Discard, nil))))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/errors")
+	assert.NoError(t, err, "could not get the catalogue")
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"), "wrong content type")
+
+	var catalogue []catalogueEntry
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&catalogue), "bad catalogue")
+	assert.Len(t, catalogue, len(errMsg), "every error should be listed")
+
+	for id, entry := range catalogue {
+		if id > 0 {
+			assert.True(t, catalogue[id-1].Code < entry.Code, "catalogue should be in code order")
+		}
+		if entry.ID != "blocked_ip" {
+			continue
+		}
+		assert.Equal(t, catalogueEntry{
+			Code:         int(ErrBlockedIP),
+			ID:           "blocked_ip",
+			Message:      "IP address provided - [%s] - was not allowed",
+			Status:       http.StatusPreconditionFailed,
+			Translations: map[string]string{"de": "IP-Adresse [%s] ist nicht erlaubt"},
+		}, entry, "wrong entry for blocked_ip")
+	}
+}
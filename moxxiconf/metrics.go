@@ -0,0 +1,276 @@
+package moxxiConf
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsContentType is the content type for the Prometheus text format
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the histogram upper bounds (in seconds) used for latency
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// labelSep joins label values into a single map key - it is not valid UTF-8
+// so it can never show up in a real label value
+const labelSep = "\xff"
+
+// counter - a Prometheus counter with a fixed set of labels
+type counter struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	return &counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+// inc adds one to the series with the given label values
+func (c *counter) inc(labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[strings.Join(labelValues, labelSep)]++
+}
+
+func (c *counter) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name,
+			formatLabels(c.labels, strings.Split(key, labelSep)),
+			formatValue(c.values[key]))
+	}
+}
+
+// histogram - a Prometheus histogram with a fixed set of labels
+type histogram struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+}
+
+// observe records one value in the series with the given label values
+func (h *histogram) observe(value float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+
+	key := strings.Join(labelValues, labelSep)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for id, bound := range h.buckets {
+		if value <= bound {
+			s.counts[id]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		s := h.series[key]
+		labelValues := strings.Split(key, labelSep)
+		bucketValues := append(append([]string{}, labelValues...), "")
+		last := len(bucketValues) - 1
+
+		for id, bound := range h.buckets {
+			bucketValues[last] = formatValue(bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(bucketLabels, bucketValues), s.counts[id])
+		}
+		bucketValues[last] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			formatLabels(bucketLabels, bucketValues), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name,
+			formatLabels(h.labels, labelValues), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name,
+			formatLabels(h.labels, labelValues), s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelEscaper escapes label values the way the Prometheus text format wants
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) < 1 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for id, name := range names {
+		var value string
+		if id < len(values) {
+			value = values[id]
+		}
+		parts[id] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// all of the metrics moxxi keeps track of
+var (
+	metricProxiesCreated = newCounter("moxxi_proxies_created_total",
+		"Proxies successfully created.", "handler")
+	metricProxyFailures = newCounter("moxxi_proxy_failures_total",
+		"Proxy requests that failed, by error ID.", "handler", "error")
+	metricTraceDuration = newHistogram("moxxi_redirect_trace_duration_seconds",
+		"Time spent tracing redirects for the backend.", DefaultBuckets, "outcome")
+	metricConfWriteRetries = newCounter("moxxi_conf_write_retries_total",
+		"Subdomains picked again while writing a config.", "handler", "reason")
+	metricRequestDuration = newHistogram("moxxi_http_request_duration_seconds",
+		"Time spent serving HTTP requests.", DefaultBuckets, "handler", "method", "code")
+)
+
+// recordResult counts the outcome of one proxy creation attempt
+func recordResult(config HandlerConfig, err Err) {
+	if err != nil {
+		metricProxyFailures.inc(config.handlerRoute, err.GetCode().ID())
+	} else {
+		metricProxiesCreated.inc(config.handlerRoute)
+	}
+}
+
+// writeLiveProxies counts the configs currently sitting in each confPath
+func writeLiveProxies(w io.Writer, handlers []HandlerConfig) {
+	const name = "moxxi_live_proxies"
+	fmt.Fprintf(w, "# HELP %s Proxy configs currently in the config path.\n", name)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+
+	seen := make(map[string]bool)
+	for _, handler := range handlers {
+		if handler.handlerType != "form" && handler.handlerType != "json" {
+			continue
+		}
+		for _, out := range handler.confOutputs() {
+			ext := DomainSep + strings.TrimLeft(out.confExt, DomainSep)
+			if seen[out.confPath+labelSep+ext] {
+				continue
+			}
+			seen[out.confPath+labelSep+ext] = true
+
+			files, err := ioutil.ReadDir(out.confPath)
+			if err != nil {
+				continue
+			}
+			var count int
+			for _, file := range files {
+				if !file.IsDir() && strings.HasSuffix(file.Name(), ext) {
+					count++
+				}
+			}
+			fmt.Fprintf(w, "%s%s %d\n", name,
+				formatLabels([]string{"path", "ext"}, []string{out.confPath, ext}), count)
+		}
+	}
+}
+
+// MetricsHandler - creates and returns a Handler exposing Prometheus metrics
+func MetricsHandler(handlers []HandlerConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", MetricsContentType)
+		metricProxiesCreated.write(w)
+		metricProxyFailures.write(w)
+		metricTraceDuration.write(w)
+		metricConfWriteRetries.write(w)
+		metricRequestDuration.write(w)
+		writeLiveProxies(w, handlers)
+	}
+}
+
+// statusRecorder - keeps track of the response code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// knownMethods are the request methods recorded as themselves - anything
+// else a client sends is recorded as "other", so clients cannot add series
+var knownMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost,
+	http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+
+// methodLabel gives the method to record a request under
+func methodLabel(method string) string {
+	if inArr(knownMethods, method) {
+		return method
+	}
+	return "other"
+}
+
+// instrument wraps a handler to record how long each request takes
+func instrument(route string, h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		metricRequestDuration.observe(time.Since(start).Seconds(),
+			route, methodLabel(r.Method), strconv.Itoa(rec.code))
+	}
+}
@@ -0,0 +1,124 @@
+package moxxiConf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dchest/uniuri"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounter_write(t *testing.T) {
+	c := newCounter("test_total", "A test counter.", "handler", "code")
+	c.inc("/json/", "32")
+	c.inc("/json/", "32")
+	c.inc("/form/", "64")
+
+	var out bytes.Buffer
+	c.write(&out)
+
+	expected := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{handler="/form/",code="64"} 1
+test_total{handler="/json/",code="32"} 2
+`
+	assert.Equal(t, expected, out.String(), "counter output did not match")
+}
+
+func TestHistogram_write(t *testing.T) {
+	h := newHistogram("test_seconds", "A test histogram.", []float64{.1, 1}, "outcome")
+	h.observe(.05, "success")
+	h.observe(.5, "success")
+	h.observe(5, "success")
+
+	var out bytes.Buffer
+	h.write(&out)
+
+	expected := `# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{outcome="success",le="0.1"} 1
+test_seconds_bucket{outcome="success",le="1"} 2
+test_seconds_bucket{outcome="success",le="+Inf"} 3
+test_seconds_sum{outcome="success"} 5.55
+test_seconds_count{outcome="success"} 3
+`
+	assert.Equal(t, expected, out.String(), "histogram output did not match")
+}
+
+func TestMetricsHandler(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "moxxi_test_")
+	assert.Nil(t, err, "could not make temp dir - %v", err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.test.com.conf", "b.test.com.conf", "notes.txt"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0644)
+		assert.Nil(t, err, "could not write file - %v", err)
+	}
+
+	handlers := []HandlerConfig{
+		{handlerType: "form", handlerRoute: "/form/", confPath: dir, confExt: "conf"},
+		{handlerType: "json", handlerRoute: "/json/", confPath: dir, confExt: ".conf"},
+		{handlerType: "static", handlerRoute: "/"},
+	}
+
+	server := httptest.NewServer(instrument("/metrics/", MetricsHandler(handlers)))
+	defer server.Close()
+
+	// the first request gets recorded so it shows up in the second
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(server.URL)
+		assert.NoError(t, err, "got an error I should not have")
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err, "problem reading response - %v", err)
+
+		assert.Equal(t, MetricsContentType, resp.Header.Get("Content-Type"),
+			"wrong content type")
+		assert.Contains(t, string(body),
+			`moxxi_live_proxies{path="`+dir+`",ext=".conf"} 2`+"\n",
+			"live proxies were not counted once")
+		if i > 0 {
+			assert.Contains(t, string(body),
+				`moxxi_http_request_duration_seconds_count{handler="/metrics/",method="GET",code="200"}`,
+				"request duration was not recorded")
+		}
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	assert.Equal(t, `{a="plain",b="back\\slash \"quoted\"\nnext",c="tab`+"\t"+`and é"}`,
+		formatLabels([]string{"a", "b", "c"}, []string{"plain", "back\\slash \"quoted\"\nnext", "tab\tand é"}),
+		"only backslashes, quotes and newlines should be escaped")
+}
+
+func TestInstrument_method(t *testing.T) {
+	// the metrics are shared, so every run counts under its own route
+	route := "/method/" + uniuri.New() + "/"
+	h := instrument(route, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, method := range []string{"GET", "BREW", "PROPFIND"} {
+		h(httptest.NewRecorder(), httptest.NewRequest(method, route, nil))
+	}
+
+	var out bytes.Buffer
+	metricRequestDuration.write(&out)
+	assert.Contains(t, out.String(), `_count{handler="`+route+`",method="GET",code="200"} 1`,
+		"known methods should be recorded")
+	assert.Contains(t, out.String(), `_count{handler="`+route+`",method="other",code="200"} 2`,
+		"other methods should be recorded together")
+	assert.NotContains(t, out.String(), "BREW", "unknown methods should not get their own series")
+}
+
+func TestRecordResult(t *testing.T) {
+	config := HandlerConfig{handlerRoute: "/record/"}
+	recordResult(config, &NewErr{Code: ErrBlockedIP, value: "10.0.0.1"})
+
+	var out bytes.Buffer
+	metricProxyFailures.write(&out)
+	assert.Contains(t, out.String(), `moxxi_proxy_failures_total{handler="/record/",error="blocked_ip"} `,
+		"failures should be counted by the error ID")
+}
@@ -0,0 +1,93 @@
+package moxxiConf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PathWildcard in an allowed or blocked path matches any run of characters
+const PathWildcard = "*"
+
+// isPath matches the characters allowed in a path prefix or pattern - enough
+// for real paths, with nothing any of the config formats treat specially
+// there is no %, as paths are checked after the servers have decoded them
+var isPath *regexp.Regexp
+
+func init() {
+	isPath = regexp.MustCompile(`^/[A-Za-z0-9._~!*+,=:@/-]*$`)
+}
+
+// checkPath makes sure a path is safe to write into a config
+// paths are checked after the servers have normalized them, so a path with
+// . or .. parts or doubled slashes could never match
+func checkPath(path string) error {
+	if !isPath.MatchString(path) {
+		return fmt.Errorf("must start with %s and hold only plain path characters", PathSep)
+	}
+	if strings.Contains(path, "..") || strings.Contains(path, PathSep+PathSep) {
+		return fmt.Errorf("cannot hold .. or %s%s", PathSep, PathSep)
+	}
+	for _, part := range strings.Split(path, PathSep) {
+		if part == "." {
+			return fmt.Errorf("cannot hold . parts")
+		}
+	}
+	return nil
+}
+
+// pathRegex is a regular expression matching the start of any of the path
+// patterns given - the patterns have been through checkPath, so the only
+// character special to a regular expression that is left is the wildcard
+// {{ .AllowPaths | pathRegex }}
+func pathRegex(patterns []string) string {
+	parts := make([]string, len(patterns))
+	for id, pattern := range patterns {
+		parts[id] = strings.Replace(regexp.QuoteMeta(pattern), regexp.QuoteMeta(PathWildcard), ".*", -1)
+	}
+	return "^(?:" + strings.Join(parts, "|") + ")"
+}
+
+// checkPaths validates the backend path prefix and the allowed and blocked
+// paths asked for in proxy, filling them into conf
+// the prefix always starts and ends with a /, and is left out if it is just /
+func checkPaths(proxy siteParams, conf *siteParams) Err {
+	if proxy.PathPrefix != "" {
+		prefix := PathSep + strings.Trim(proxy.PathPrefix, PathSep) + PathSep
+		if prefix == PathSep+PathSep {
+			prefix = PathSep
+		}
+		// a prefix is used as is
+		if strings.Contains(prefix, PathWildcard) {
+			return &NewErr{Code: ErrBadPath, value: proxy.PathPrefix,
+				deepErr: fmt.Errorf("a prefix cannot hold %s", PathWildcard)}
+		}
+		if err := checkPath(prefix); err != nil {
+			return &NewErr{Code: ErrBadPath, value: proxy.PathPrefix, deepErr: err}
+		}
+		if prefix != PathSep {
+			conf.PathPrefix = prefix
+		}
+	}
+
+	for _, list := range []struct {
+		in  []string
+		out *[]string
+	}{
+		{proxy.AllowPaths, &conf.AllowPaths},
+		{proxy.BlockPaths, &conf.BlockPaths},
+	} {
+		for _, path := range list.in {
+			if path == "" {
+				continue
+			}
+			if err := checkPath(path); err != nil {
+				return &NewErr{Code: ErrBadPath, value: path, deepErr: err}
+			}
+			if !inArr(*list.out, path) {
+				*list.out = append(*list.out, path)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package moxxiConf
+
+import (
+	"io/ioutil"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPaths(t *testing.T) {
+	var testData = []struct {
+		in      siteParams
+		out     siteParams
+		errCode ErrCode
+	}{
+		{},
+		{
+			in:  siteParams{PathPrefix: "shop"},
+			out: siteParams{PathPrefix: "/shop/"},
+		}, {
+			in:  siteParams{PathPrefix: "/shop/staging/"},
+			out: siteParams{PathPrefix: "/shop/staging/"},
+		}, {
+			in: siteParams{PathPrefix: "/"},
+		}, {
+			in: siteParams{
+				AllowPaths: []string{"/staging/", "", "/assets/*.css", "/staging/"},
+				BlockPaths: []string{"/staging/admin"},
+			},
+			out: siteParams{
+				AllowPaths: []string{"/staging/", "/assets/*.css"},
+				BlockPaths: []string{"/staging/admin"},
+			},
+		}, {
+			in:      siteParams{PathPrefix: "/shop/*/"},
+			errCode: ErrBadPath,
+		}, {
+			in:      siteParams{PathPrefix: "/shop%20"},
+			errCode: ErrBadPath,
+		}, {
+			in:      siteParams{PathPrefix: "/shop/../admin"},
+			errCode: ErrBadPath,
+		}, {
+			in:      siteParams{AllowPaths: []string{"staging"}},
+			errCode: ErrBadPath,
+		}, {
+			in:      siteParams{BlockPaths: []string{"/admin\"; return 200"}},
+			errCode: ErrBadPath,
+		}, {
+			in:      siteParams{BlockPaths: []string{"/{admin}"}},
+			errCode: ErrBadPath,
+		}, {
+			in:      siteParams{BlockPaths: []string{"/%61dmin"}},
+			errCode: ErrBadPath,
+		}, {
+			in:      siteParams{AllowPaths: []string{"/shop/../admin"}},
+			errCode: ErrBadPath,
+		}, {
+			in:      siteParams{AllowPaths: []string{"/shop/..."}},
+			errCode: ErrBadPath,
+		}, {
+			in:      siteParams{BlockPaths: []string{"//admin"}},
+			errCode: ErrBadPath,
+		}, {
+			in:      siteParams{BlockPaths: []string{"/./admin"}},
+			errCode: ErrBadPath,
+		},
+	}
+
+	for id, test := range testData {
+		var out siteParams
+		locErr := checkPaths(test.in, &out)
+		if test.errCode != 0 {
+			assert.ErrorIs(t, locErr, test.errCode, "test %d - wrong error", id)
+			continue
+		}
+		assert.Nil(t, locErr, "test %d - unexpected error - %v", id, locErr)
+		assert.Equal(t, test.out, out, "test %d - wrong paths", id)
+	}
+}
+
+func TestPathRegex(t *testing.T) {
+	expr := pathRegex([]string{"/staging/", "/assets/*.css", "/a+b"})
+	assert.Equal(t, `^(?:/staging/|/assets/.*\.css|/a\+b)`, expr, "wrong expression")
+
+	re := regexp.MustCompile(expr)
+	var testData = []struct {
+		in  string
+		out bool
+	}{
+		{"/staging/", true},
+		{"/staging/app/index.html", true},
+		{"/stagingx", false},
+		{"/assets/site.css", true},
+		{"/assets/deep/site.css", true},
+		{"/assets/siteXcss", false},
+		{"/a+b/c", true},
+		{"/aab", false},
+		{"/", false},
+	}
+	for id, test := range testData {
+		assert.Equal(t, test.out, re.MatchString(test.in), "test %d - wrong match for %s", id, test.in)
+	}
+}
+
+func TestPaths_bypass(t *testing.T) {
+	// what the servers check the block list against once they have normalized
+	// the path - HAProxy only does this with the normalize-uri rules
+	normalize := func(p string) string {
+		decoded, err := url.PathUnescape(p)
+		if err != nil {
+			return p
+		}
+		return path.Clean(decoded)
+	}
+
+	block := regexp.MustCompile(pathRegex([]string{"/admin"}))
+	allow := regexp.MustCompile(pathRegex([]string{"/shop/"}))
+	for _, attempt := range []string{"/shop/../admin", "//admin", "/%61dmin", "/shop/%2e%2e/admin", "/./admin"} {
+		assert.True(t, block.MatchString(normalize(attempt)), "%s should be blocked", attempt)
+		assert.False(t, allow.MatchString(normalize(attempt)), "%s should not be allowed", attempt)
+	}
+
+	for _, file := range []string{"proxy.template", "proxy.apache.template",
+		"proxy.haproxy.template", "proxy.caddy.template"} {
+
+		testConfig := HandlerConfig{
+			baseURL:      "proxy.com",
+			confPath:     t.TempDir(),
+			confExt:      "conf",
+			confTempl:    template.Must(parseTemplate(filepath.Join("..", file))),
+			subdomainLen: 8,
+		}
+		site, locErr := confCheck(siteParams{IntHost: "domain.com", IntIP: "10.0.0.1",
+			AllowPaths: []string{"/shop/"}, BlockPaths: []string{"/admin"}}, testConfig)
+		if !assert.Nil(t, locErr, "%s - paths should be taken - %v", file, locErr) {
+			continue
+		}
+		site, locErr = confWrite(testConfig)(site)
+		if !assert.Nil(t, locErr, "%s - should write - %v", file, locErr) {
+			continue
+		}
+		contents, _ := ioutil.ReadFile(testConfig.confOutputs()[0].fileName(site.ExtHost))
+		conf := string(contents)
+
+		switch file {
+		case "proxy.template":
+			// $uri is already decoded and normalized
+			assert.Contains(t, conf, "$uri ~", "%s - should check the normalized path", file)
+		case "proxy.apache.template":
+			// so is REQUEST_URI in an expression
+			assert.Contains(t, conf, "%{REQUEST_URI} =~", "%s - should check the normalized path", file)
+		case "proxy.haproxy.template":
+			assert.NotContains(t, conf, "path_reg", "%s - should not check the raw path", file)
+			assert.Contains(t, conf, "path,url_dec -m reg", "%s - should check the decoded path", file)
+			check := strings.Index(conf, "deny deny_status 403 if { path")
+			for _, rule := range []string{"percent-decode-unreserved", "path-strip-dotdot full",
+				"path-strip-dot", "path-merge-slashes"} {
+				normalized := strings.Index(conf, "http-request normalize-uri "+rule+"\n")
+				assert.True(t, normalized >= 0 && normalized < check,
+					"%s - should %s before checking paths", file, rule)
+			}
+		case "proxy.caddy.template":
+			// path_regexp matches the cleaned, decoded path
+			assert.Contains(t, conf, "path_regexp", "%s - should check the normalized path", file)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package moxxiConf
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ProbeTimeout is how long the pre-flight probe of a backend can take by default
+const ProbeTimeout = 5 * time.Second
+
+// what a handler does with the result of the pre-flight probe
+const (
+	ProbeOff    = "off"
+	ProbeWarn   = "warn"
+	ProbeReject = "reject"
+)
+
+// probePolicy - if and how a handler checks a backend before writing its config
+type probePolicy struct {
+	mode    string
+	timeout time.Duration
+	// roots verifies backend certificates - the system roots when nil
+	roots *x509.CertPool
+}
+
+// probeResult - what the pre-flight probe found out about a backend
+type probeResult struct {
+	Latency     float64
+	Status      int        `json:",omitempty"`
+	CertSubject string     `json:",omitempty"`
+	CertExpiry  *time.Time `json:",omitempty"`
+	Warning     string     `json:",omitempty"`
+}
+
+// probeBackend connects to the backend's IntIP and IntPort, doing a TLS
+// handshake with the IntHost as SNI if the site is Encrypted, and asks for
+// the front page. The latency (in seconds), status and certificate are
+// recorded as far as the probe got, along with why it failed if it did - a
+// certificate that does not match IntHost or is not trusted is a failure.
+func probeBackend(site siteParams, policy probePolicy) (result probeResult, err error) {
+	timeout := policy.timeout
+	if timeout <= 0 {
+		timeout = ProbeTimeout
+	}
+
+	start := time.Now()
+	defer func() { result.Latency = time.Since(start).Seconds() }()
+
+	addr := net.JoinHostPort(site.IntIP, strconv.Itoa(site.IntPort))
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(start.Add(timeout))
+
+	if site.Encrypted {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: site.tlsServerName(),
+			// verified below, so the certificate is recorded even when it is wrong
+			InsecureSkipVerify: true,
+		})
+		if err = tlsConn.Handshake(); err != nil {
+			return result, fmt.Errorf("TLS handshake failed - %v", err)
+		}
+		certs := tlsConn.ConnectionState().PeerCertificates
+		if len(certs) < 1 {
+			return result, fmt.Errorf("no certificate presented")
+		}
+		expiry := certs[0].NotAfter
+		result.CertSubject = certs[0].Subject.String()
+		result.CertExpiry = &expiry
+		roots := policy.roots
+		if site.UpstreamCAFile != "" {
+			if roots, err = loadCABundle(site.UpstreamCAFile); err != nil {
+				return result, err
+			}
+		}
+		if err = verifyCert(site.tlsServerName(), certs, roots); err != nil {
+			return result, err
+		}
+		conn = tlsConn
+	}
+
+	result.Status, err = headRequest(conn, site)
+	return result, err
+}
+
+// headRequest asks for the front page of the site over conn, and gives the
+// status of the response
+func headRequest(conn net.Conn, site siteParams) (int, error) {
+	req, err := http.NewRequest(http.MethodHead, traceURL(site.IntHost, site.IntPort, site.Encrypted), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", TraceUserAgent)
+	req.Close = true
+	if err = req.Write(conn); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return 0, fmt.Errorf("no HTTP response - %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// detectBackendTLS works out if the backend speaks HTTPS or plain HTTP on the
+// port given - or on 443 and then 80 if no port was given. Whatever answers
+// first is used, with a TLS handshake tried before plain HTTP on each port.
+// The site comes back with Encrypted, IntPort, and TLSDecision filled in.
+func detectBackendTLS(site siteParams, timeout time.Duration) (siteParams, error) {
+	if timeout <= 0 {
+		timeout = ProbeTimeout
+	}
+	ports := []int{443, 80}
+	if site.IntPort > 0 {
+		ports = []int{site.IntPort}
+	}
+
+	var err error
+	for _, port := range ports {
+		site.IntPort = port
+		for _, encrypted := range []bool{true, false} {
+			site.Encrypted = encrypted
+			if err = speaksHTTP(site, timeout); err == nil {
+				site.TLSDecision = fmt.Sprintf("detected %s on port %d", tlsName(encrypted), port)
+				return site, nil
+			}
+		}
+	}
+	return site, err
+}
+
+// speaksHTTP checks the backend answers a request, over TLS if the site is Encrypted
+func speaksHTTP(site siteParams, timeout time.Duration) error {
+	addr := net.JoinHostPort(site.IntIP, strconv.Itoa(site.IntPort))
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if site.Encrypted {
+		// only the protocol matters here - the certificate is the probe's job
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         site.tlsServerName(),
+			InsecureSkipVerify: true,
+		})
+		if err = tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("no TLS on port %d - %v", site.IntPort, err)
+		}
+		conn = tlsConn
+	}
+	_, err = headRequest(conn, site)
+	return err
+}
+
+// tlsName is what the protocol is called in messages
+func tlsName(encrypted bool) string {
+	if encrypted {
+		return "HTTPS"
+	}
+	return "HTTP"
+}
+
+// loadCABundle reads the certificates in a CA bundle
+func loadCABundle(file string) (*x509.CertPool, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// verifyCert checks the certificate chain is trusted and valid for host
+func verifyCert(host string, certs []*x509.Certificate, roots *x509.CertPool) error {
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return fmt.Errorf("bad certificate - %v", err)
+	}
+	return nil
+}
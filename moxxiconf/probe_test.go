@@ -0,0 +1,190 @@
+package moxxiConf
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// backend gives the IP and port a test server listens on
+func backend(t *testing.T, server *httptest.Server) (string, int) {
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	assert.Nil(t, err, "bad test server address - %v", err)
+	portNum, _ := strconv.Atoi(port)
+	return host, portNum
+}
+
+// closedPort is a local port with nothing listening on it
+func closedPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "could not listen - %v", err)
+	l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestProbeBackend(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer secure.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(secure.Certificate())
+
+	plainIP, plainPort := backend(t, plain)
+	secureIP, securePort := backend(t, secure)
+
+	var testData = []struct {
+		site    siteParams
+		policy  probePolicy
+		status  int
+		subject bool
+		fails   bool
+	}{
+		{
+			site:   siteParams{IntHost: "example.com", IntIP: plainIP, IntPort: plainPort},
+			status: http.StatusTeapot,
+		}, {
+			site:  siteParams{IntHost: "example.com", IntIP: "127.0.0.1", IntPort: closedPort(t)},
+			fails: true,
+		}, {
+			site: siteParams{IntHost: "example.com", IntIP: secureIP, IntPort: securePort,
+				Encrypted: true},
+			policy:  probePolicy{roots: roots},
+			status:  http.StatusOK,
+			subject: true,
+		}, {
+			site: siteParams{IntHost: "wrong.test.com", IntIP: secureIP, IntPort: securePort,
+				Encrypted: true},
+			policy:  probePolicy{roots: roots},
+			subject: true,
+			fails:   true,
+		}, {
+			site: siteParams{IntHost: "example.com", IntIP: secureIP, IntPort: securePort,
+				Encrypted: true},
+			subject: true,
+			fails:   true,
+		}, {
+			site: siteParams{IntHost: "example.com", IntIP: plainIP, IntPort: plainPort,
+				Encrypted: true},
+			policy: probePolicy{timeout: time.Second},
+			fails:  true,
+		},
+	}
+
+	for id, test := range testData {
+		out, err := probeBackend(test.site, test.policy)
+		if test.fails {
+			assert.Error(t, err, "test %d - should have failed", id)
+		} else {
+			assert.NoError(t, err, "test %d - should have worked", id)
+		}
+		assert.Equal(t, test.status, out.Status, "test %d - wrong status", id)
+		assert.True(t, out.Latency > 0, "test %d - latency not recorded", id)
+		if test.subject {
+			assert.NotEmpty(t, out.CertSubject, "test %d - no certificate subject", id)
+			if assert.NotNil(t, out.CertExpiry, "test %d - no certificate expiry", id) {
+				assert.Equal(t, secure.Certificate().NotAfter, *out.CertExpiry,
+					"test %d - wrong certificate expiry", id)
+			}
+		} else {
+			assert.Empty(t, out.CertSubject, "test %d - unexpected certificate", id)
+		}
+	}
+}
+
+func TestConfCheck_probe(t *testing.T) {
+	site := siteParams{IntHost: "example.com", IntIP: "127.0.0.1", IntPort: closedPort(t)}
+
+	out, err := confCheck(site, HandlerConfig{})
+	assert.Nil(t, err, "should not probe by default - %v", err)
+	assert.Nil(t, out.Probe, "should not probe by default")
+
+	out, err = confCheck(site, HandlerConfig{probe: probePolicy{mode: ProbeWarn}})
+	assert.Nil(t, err, "should only warn - %v", err)
+	if assert.NotNil(t, out.Probe, "should have probed") {
+		assert.NotEmpty(t, out.Probe.Warning, "should have warned")
+	}
+
+	_, err = confCheck(site, HandlerConfig{probe: probePolicy{mode: ProbeReject}})
+	assert.ErrorIs(t, err, ErrBackendProbe, "should have rejected the backend")
+
+	c := map[string]interface{}{
+		"baseURL": "proxy.com",
+		"listen":  []interface{}{"localhost:8080"},
+		"probe":   "maybe",
+		"handler": defaultHandlers(),
+	}
+	assert.ErrorIs(t, validateConfig(&c), ErrConfigBadValue, "should not accept a bad probe mode")
+}
+
+func TestDetectBackendTLS(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer secure.Close()
+
+	_, plainPort := backend(t, plain)
+	_, securePort := backend(t, secure)
+	closed := closedPort(t)
+
+	var testData = []struct {
+		port      int
+		encrypted bool
+		decision  string
+		fails     bool
+	}{
+		{port: plainPort, decision: "detected HTTP on port " + strconv.Itoa(plainPort)},
+		{port: securePort, encrypted: true,
+			decision: "detected HTTPS on port " + strconv.Itoa(securePort)},
+		{port: closed, fails: true},
+	}
+	for id, test := range testData {
+		out, err := detectBackendTLS(siteParams{
+			IntHost: "example.com",
+			IntIP:   "127.0.0.1",
+			IntPort: test.port,
+		}, time.Second)
+		if test.fails {
+			assert.Error(t, err, "test %d - should have failed", id)
+			continue
+		}
+		assert.NoError(t, err, "test %d - should have detected", id)
+		assert.Equal(t, test.port, out.IntPort, "test %d - wrong port", id)
+		assert.Equal(t, test.encrypted, out.Encrypted, "test %d - wrong Encrypted", id)
+		assert.Equal(t, test.decision, out.TLSDecision, "test %d - wrong decision", id)
+	}
+}
+
+func TestConfCheck_detectTLS(t *testing.T) {
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer secure.Close()
+	_, securePort := backend(t, secure)
+
+	out, err := confCheck(siteParams{
+		IntHost:   "example.com",
+		IntIP:     "127.0.0.1",
+		IntPort:   securePort,
+		detectTLS: true,
+	}, HandlerConfig{})
+	assert.Nil(t, err, "should have detected - %v", err)
+	assert.True(t, out.Encrypted, "should have found HTTPS")
+	assert.Equal(t, securePort, out.IntPort, "should keep the port")
+	assert.NotEmpty(t, out.TLSDecision, "should report the decision")
+
+	_, err = confCheck(siteParams{
+		IntHost:   "example.com",
+		IntIP:     "127.0.0.1",
+		IntPort:   closedPort(t),
+		detectTLS: true,
+	}, HandlerConfig{})
+	assert.ErrorIs(t, err, ErrTLSDetect, "nothing should answer")
+}
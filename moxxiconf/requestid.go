@@ -0,0 +1,48 @@
+package moxxiConf
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/dchest/uniuri"
+)
+
+// RequestIDLen is the length of request IDs generated by moxxi
+const RequestIDLen = 20
+
+// MaxRequestIDLen is the longest request ID accepted from a client
+const MaxRequestIDLen = 64
+
+// requestIDKey is the context key the request ID is stored under
+type requestIDKey struct{}
+
+// isRequestID matches request IDs that are safe to put in logs and configs
+var isRequestID = regexp.MustCompile("^[a-zA-Z0-9._-]+$")
+
+// RequestID returns the ID assigned to the request by RequestIDHandler
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID returns a copy of the request carrying the given ID
+func withRequestID(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// RequestIDHandler - wraps a handler to give every request an ID
+// an ID given in the X-Request-ID header is kept if it is safe to use,
+// otherwise a new one is generated. The ID is sent back in the same header.
+func RequestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if len(id) > MaxRequestIDLen || !isRequestID.MatchString(id) {
+			id = uniuri.NewLen(RequestIDLen)
+		}
+
+		r.Header.Set(RequestIDHeader, id)
+		w.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(w, withRequestID(r, id))
+	})
+}
@@ -0,0 +1,56 @@
+package moxxiConf
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDHandler(t *testing.T) {
+	var seen string
+	server := httptest.NewServer(RequestIDHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			seen = RequestID(r)
+		})))
+	defer server.Close()
+
+	var testData = []struct {
+		in   string
+		keep bool
+	}{
+		{in: "abc-123.DEF_456", keep: true},
+		{in: "", keep: false},
+		{in: "bad id; }", keep: false},
+		{in: strings.Repeat("a", MaxRequestIDLen+1), keep: false},
+	}
+
+	for id, test := range testData {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		if test.in != "" {
+			req.Header.Set(RequestIDHeader, test.in)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "test %d - got an error I should not have", id)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, seen, resp.Header.Get(RequestIDHeader),
+			"test %d - response header did not match the request ID", id)
+		if test.keep {
+			assert.Equal(t, test.in, seen, "test %d - should have kept the given ID", id)
+		} else {
+			assert.Len(t, seen, RequestIDLen, "test %d - should have generated an ID", id)
+			assert.True(t, isRequestID.MatchString(seen), "test %d - generated a bad ID", id)
+		}
+	}
+}
+
+func TestRequestID_none(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://example.com", nil)
+	r.Header.Set(RequestIDHeader, "not trusted")
+	assert.Equal(t, "", RequestID(r), "should only trust IDs set by the handler")
+}
@@ -0,0 +1,105 @@
+package moxxiConf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// IntHostPlaceholder in a substitution stands for the site's IntHost, so
+// handler defaults like www.{IntHost} work for every site
+const IntHostPlaceholder = "{IntHost}"
+
+// DefaultSubstituteType is always substituted, so never needs to be listed
+const DefaultSubstituteType = "text/html"
+
+// isMIMEType matches a plain type/subtype, with no parameters or wildcards
+var isMIMEType = regexp.MustCompile(`^[a-z0-9][a-z0-9!#&^_.+-]*/[a-z0-9][a-z0-9!#&^_.+-]*$`)
+
+// substitution - replaces From with To in responses from the backend
+// an empty To is the ExtHost
+type substitution struct {
+	From string
+	To   string `json:",omitempty"`
+}
+
+// substituteDefaults - the substitutions and types a handler gives every site
+type substituteDefaults struct {
+	rules []substitution
+	types []string
+}
+
+// checkSubstitution makes sure a substitution can be written into every kind
+// of config - a $ would be read as a variable, and a | would end the pattern
+func checkSubstitution(rule substitution) error {
+	if rule.From == "" {
+		return fmt.Errorf("nothing to replace")
+	}
+	for _, value := range []string{rule.From, rule.To} {
+		if !validValue(value) || strings.ContainsAny(value, "$|") {
+			return fmt.Errorf("%q cannot hold line breaks, $ or |", value)
+		}
+	}
+	return nil
+}
+
+// checkSubstituteType cleans up a MIME type, making sure it is one
+func checkSubstituteType(mimeType string) (string, error) {
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	if !isMIMEType.MatchString(mimeType) {
+		return "", fmt.Errorf("%q is not a MIME type", mimeType)
+	}
+	return mimeType, nil
+}
+
+// checkSubstitutions validates the handler's default substitutions followed by
+// the ones asked for in proxy, filling them into conf - a later rule for the
+// same From replaces an earlier one
+// the types asked for replace the handler's, and html is always substituted
+func checkSubstitutions(proxy siteParams, conf *siteParams, defaults substituteDefaults) Err {
+	seen := make(map[string]int)
+	for _, rule := range append(append([]substitution{}, defaults.rules...), proxy.Substitutions...) {
+		if err := checkSubstitution(rule); err != nil {
+			return &NewErr{Code: ErrBadSubstitution, value: rule.From, deepErr: err}
+		}
+		if id, ok := seen[rule.From]; ok {
+			conf.Substitutions[id] = rule
+			continue
+		}
+		seen[rule.From] = len(conf.Substitutions)
+		conf.Substitutions = append(conf.Substitutions, rule)
+	}
+
+	types := proxy.SubstituteTypes
+	if len(types) < 1 {
+		types = defaults.types
+	}
+	for _, each := range types {
+		mimeType, err := checkSubstituteType(each)
+		if err != nil {
+			return &NewErr{Code: ErrBadSubstitution, value: each, deepErr: err}
+		}
+		if mimeType != DefaultSubstituteType && !inArr(conf.SubstituteTypes, mimeType) {
+			conf.SubstituteTypes = append(conf.SubstituteTypes, mimeType)
+		}
+	}
+	return nil
+}
+
+// expandSubstitutions fills the IntHost in to the substitutions, dropping any
+// that then have nothing to do
+func expandSubstitutions(rules []substitution, intHost string) []substitution {
+	var out []substitution
+	for _, rule := range rules {
+		rule.From = strings.Replace(rule.From, IntHostPlaceholder, intHost, -1)
+		rule.To = strings.Replace(rule.To, IntHostPlaceholder, intHost, -1)
+		switch {
+		case rule.From == rule.To:
+		case rule.From == intHost && rule.To == "":
+			// the IntHost always goes to the ExtHost already
+		default:
+			out = append(out, rule)
+		}
+	}
+	return out
+}
@@ -0,0 +1,131 @@
+package moxxiConf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSubstitutions(t *testing.T) {
+	defaults := substituteDefaults{
+		rules: []substitution{{From: "www." + IntHostPlaceholder}, {From: "cdn.old.com", To: "cdn.new.com"}},
+		types: []string{"application/json"},
+	}
+
+	var testData = []struct {
+		in       siteParams
+		defaults substituteDefaults
+		out      siteParams
+		errCode  ErrCode
+	}{
+		{},
+		{
+			defaults: defaults,
+			out: siteParams{
+				Substitutions:   defaults.rules,
+				SubstituteTypes: []string{"application/json"},
+			},
+		}, {
+			in: siteParams{
+				Substitutions:   []substitution{{From: "cdn.old.com", To: "static.new.com"}, {From: "https://api.old.com"}},
+				SubstituteTypes: []string{"Application/JavaScript", "text/html", "application/javascript"},
+			},
+			defaults: defaults,
+			out: siteParams{
+				Substitutions: []substitution{{From: "www." + IntHostPlaceholder},
+					{From: "cdn.old.com", To: "static.new.com"}, {From: "https://api.old.com"}},
+				SubstituteTypes: []string{"application/javascript"},
+			},
+		}, {
+			in:      siteParams{Substitutions: []substitution{{To: "new.com"}}},
+			errCode: ErrBadSubstitution,
+		}, {
+			in:      siteParams{Substitutions: []substitution{{From: "old.com", To: "$remote_addr"}}},
+			errCode: ErrBadSubstitution,
+		}, {
+			in:      siteParams{Substitutions: []substitution{{From: "old.com|new.com"}}},
+			errCode: ErrBadSubstitution,
+		}, {
+			in:      siteParams{Substitutions: []substitution{{From: "old.com\";\n", To: "new.com"}}},
+			errCode: ErrBadSubstitution,
+		}, {
+			in:      siteParams{SubstituteTypes: []string{"*/*"}},
+			errCode: ErrBadSubstitution,
+		}, {
+			in:      siteParams{SubstituteTypes: []string{"text/html; charset=utf-8"}},
+			errCode: ErrBadSubstitution,
+		},
+	}
+
+	for id, test := range testData {
+		var out siteParams
+		locErr := checkSubstitutions(test.in, &out, test.defaults)
+		if test.errCode != 0 {
+			assert.ErrorIs(t, locErr, test.errCode, "test %d - wrong error", id)
+			continue
+		}
+		assert.Nil(t, locErr, "test %d - unexpected error - %v", id, locErr)
+		assert.Equal(t, test.out, out, "test %d - wrong substitutions", id)
+	}
+}
+
+func TestExpandSubstitutions(t *testing.T) {
+	out := expandSubstitutions([]substitution{
+		{From: "www." + IntHostPlaceholder},
+		{From: "https://" + IntHostPlaceholder, To: "http://" + IntHostPlaceholder},
+		{From: IntHostPlaceholder},
+		{From: "same.com", To: "same.com"},
+	}, "domain.com")
+	assert.Equal(t, []substitution{
+		{From: "www.domain.com"},
+		{From: "https://domain.com", To: "http://domain.com"},
+	}, out, "wrong substitutions")
+}
+
+func TestConfCheck_substitutions(t *testing.T) {
+	config := HandlerConfig{substitute: substituteDefaults{rules: []substitution{{From: "www." + IntHostPlaceholder}}}}
+
+	out, locErr := confCheck(siteParams{IntHost: "domain.com", IntIP: "10.0.0.1",
+		Substitutions: []substitution{{From: "api." + IntHostPlaceholder}}}, config)
+	assert.Nil(t, locErr, "should take the substitutions - %v", locErr)
+	assert.Equal(t, []substitution{{From: "www.domain.com"}, {From: "api.domain.com"}},
+		out.Substitutions, "the IntHost should be filled in")
+
+	_, locErr = confCheck(siteParams{IntHost: "domain.com", IntIP: "10.0.0.1",
+		Substitutions: []substitution{{From: "$host"}}}, config)
+	assert.ErrorIs(t, locErr, ErrBadSubstitution, "should refuse a bad substitution")
+}
+
+func TestValidateConfigSubstitutions(t *testing.T) {
+	c := map[string]interface{}{
+		"baseURL": "proxy.com",
+		"listen":  []interface{}{"localhost:8080"},
+		"substitutions": []interface{}{
+			map[string]interface{}{"from": "www.{IntHost}"},
+			map[string]interface{}{"from": "cdn.old.com", "to": "cdn.new.com"},
+		},
+		"substituteTypes": "Application/JSON",
+		"handler": []interface{}{
+			map[string]interface{}{"handlerType": "form", "handlerRoute": "/submit/"},
+		},
+	}
+	assert.Nil(t, validateConfig(&c), "substitutions should be valid")
+	h := c["handler"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, substituteDefaults{
+		rules: []substitution{{From: "www.{IntHost}"}, {From: "cdn.old.com", To: "cdn.new.com"}},
+		types: []string{"application/json"},
+	}, decodeSubstitutions(h), "wrong substitutions")
+
+	var badData = []map[string]interface{}{
+		{"substitutions": map[string]interface{}{"from": "old.com"}},
+		{"substitutions": []interface{}{"old.com"}},
+		{"substitutions": []interface{}{map[string]interface{}{"to": "new.com"}}},
+		{"substitutions": []interface{}{map[string]interface{}{"from": "old.com", "to": 5}}},
+		{"substitutions": []interface{}{map[string]interface{}{"from": "$host"}}},
+		{"substituteTypes": []interface{}{"html"}},
+		{"substituteTypes": []interface{}{5}},
+	}
+	for id, bad := range badData {
+		assert.Error(t, validateConfigSubstitutions(bad), "test %d - should be invalid", id)
+	}
+}
@@ -0,0 +1,101 @@
+package moxxiConf
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SweepInterval is how often moxxi tidies up after proxies that were removed
+// anything newer than this is left alone, as a proxy's htpasswd file is
+// written before its configs are
+const SweepInterval = time.Hour
+
+// proxyHandlers lists the handlers that create proxies
+func proxyHandlers(handlers []HandlerConfig) []HandlerConfig {
+	var found []HandlerConfig
+	for _, handler := range handlers {
+		if handler.handlerType == "form" || handler.handlerType == "json" {
+			found = append(found, handler)
+		}
+	}
+	return found
+}
+
+// allOutputs lists the outputs of every handler - handlers can share a
+// confPath, so a proxy is only gone once none of these have a config for it
+func allOutputs(handlers []HandlerConfig) []confOutput {
+	var outputs []confOutput
+	for _, handler := range handlers {
+		outputs = append(outputs, handler.confOutputs()...)
+	}
+	return outputs
+}
+
+// sweepRemoved tidies up after proxies whose configs are gone - removed by
+// the cron job or by hand - by removing their htpasswd files and recording
+// them as deleted in the audit log
+func sweepRemoved(handlers []HandlerConfig) []Err {
+	outputs := allOutputs(handlers)
+
+	var errs []Err
+	for _, handler := range handlers {
+		if err := auditRemoved(handler, outputs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	cutoff := time.Now().Add(-SweepInterval)
+	seen := make(map[string]bool)
+	for _, handler := range handlers {
+		dir := handler.confOutputs()[0].confPath
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			errs = append(errs, &NewErr{Code: ErrFileUnexpect, value: dir, deepErr: err})
+			continue
+		}
+		for _, file := range files {
+			extHost, found := strings.CutSuffix(file.Name(), DomainSep+AuthFileExt)
+			if !found || file.ModTime().After(cutoff) || proxyExists(extHost, outputs) {
+				continue
+			}
+			fileName := filepath.Join(dir, file.Name())
+			if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, &NewErr{Code: ErrRemoveFile, value: fileName, deepErr: err})
+			}
+		}
+	}
+	return errs
+}
+
+// startSweep runs sweepRemoved now, and every SweepInterval after until ctx
+// is done
+func startSweep(ctx context.Context, handlers []HandlerConfig, l *slog.Logger) {
+	handlers = proxyHandlers(handlers)
+	if len(handlers) < 1 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(SweepInterval)
+		defer ticker.Stop()
+		for {
+			for _, err := range sweepRemoved(handlers) {
+				l.Error("failed to tidy up after a removed proxy", "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,71 @@
+package moxxiConf
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSweepRemoved(t *testing.T) {
+	shared, other := t.TempDir(), t.TempDir()
+	handlers := []HandlerConfig{
+		{handlerType: "form", confPath: shared, confExt: "conf"},
+		{handlerType: "json", outputs: []confOutput{
+			{confPath: shared, confExt: "cfg"},
+			{confPath: other, confExt: "conf"},
+		}},
+	}
+
+	old := time.Now().Add(-2 * SweepInterval)
+	write := func(name string, modTime time.Time) {
+		fileName := filepath.Join(shared, name)
+		assert.Nil(t, ioutil.WriteFile(fileName, nil, 0644))
+		assert.Nil(t, os.Chtimes(fileName, modTime, modTime))
+	}
+	write("kept.proxy.com.conf", old)
+	write("kept.proxy.com.htpasswd", old)
+	write("other.proxy.com.cfg", old)
+	write("other.proxy.com.htpasswd", old)
+	write("gone.proxy.com.htpasswd", old)
+	write("new.proxy.com.htpasswd", time.Now())
+	write("notes.txt", old)
+
+	assert.Empty(t, sweepRemoved(handlers), "should sweep without errors")
+
+	var left []string
+	files, _ := ioutil.ReadDir(shared)
+	for _, file := range files {
+		left = append(left, file.Name())
+	}
+	assert.Equal(t, []string{"kept.proxy.com.conf", "kept.proxy.com.htpasswd", "new.proxy.com.htpasswd",
+		"notes.txt", "other.proxy.com.cfg", "other.proxy.com.htpasswd"}, left,
+		"only the htpasswd file of the removed proxy should go")
+}
+
+func TestStartSweep(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "gone.proxy.com."+AuthFileExt)
+	old := time.Now().Add(-2 * SweepInterval)
+	assert.Nil(t, ioutil.WriteFile(fileName, nil, 0644))
+	assert.Nil(t, os.Chtimes(fileName, old, old))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startSweep(ctx, []HandlerConfig{{handlerType: "form", confPath: dir, confExt: "conf"}},
+		slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+
+	var err error
+	for i := 0; i < 50; i++ {
+		if _, err = os.Stat(fileName); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, os.IsNotExist(err), "the sweep should run as soon as it starts")
+}
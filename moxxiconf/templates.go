@@ -0,0 +1,156 @@
+package moxxiConf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateFuncs are the helpers available in every confFile and resFile
+var templateFuncs = template.FuncMap{
+	"join":        templateJoin,
+	"quote":       nginxQuote,
+	"escape":      nginxEscape,
+	"lower":       strings.ToLower,
+	"upper":       strings.ToUpper,
+	"default":     templateDefault,
+	"hostPort":    hostPort,
+	"regexEscape": regexp.QuoteMeta,
+	"now":         templateNow,
+	"expiry":      templateExpiry,
+	"date":        templateDate,
+	"toJSON":      templateJSON,
+	"pathRegex":   pathRegex,
+	"trimSuffix":  templateTrimSuffix,
+	"fail":        templateFail,
+}
+
+// the names of the built in templates used when a handler does not give its own
+const (
+	DefaultConfFile      = "proxy.template"
+	DefaultFormResFile   = "response.template"
+	DefaultJSONResFile   = "response.flat.template"
+	DefaultStaticResFile = "simple_form.html"
+)
+
+// DefaultTemplates holds the built in templates - the moxxi binary fills it
+// in with the ones from the repository
+var DefaultTemplates fs.FS
+
+// parseTemplate loads a template file with the helpers available to it
+func parseTemplate(file string) (*template.Template, error) {
+	return template.New(filepath.Base(file)).Funcs(templateFuncs).ParseFiles(file)
+}
+
+// parseDefaultTemplate loads one of the built in templates
+func parseDefaultTemplate(name string) (*template.Template, error) {
+	if DefaultTemplates == nil {
+		return nil, fmt.Errorf("no file given and no built in %s", name)
+	}
+	return template.New(name).Funcs(templateFuncs).ParseFS(DefaultTemplates, name)
+}
+
+// readDefaultFile reads one of the built in files as is
+func readDefaultFile(name string) ([]byte, error) {
+	if DefaultTemplates == nil {
+		return nil, fmt.Errorf("no file given and no built in %s", name)
+	}
+	return fs.ReadFile(DefaultTemplates, name)
+}
+
+// templateJoin joins a list - the separator comes first so it can be piped
+// {{ .StripHeaders | join " " }}
+func templateJoin(sep string, list []string) string {
+	return strings.Join(list, sep)
+}
+
+// nginxEscape escapes a value to go inside a double quoted nginx string
+// line breaks are not allowed in a directive, so they become spaces
+func nginxEscape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\r", " ",
+		"\n", " ",
+	).Replace(s)
+}
+
+// nginxQuote escapes a value and wraps it in double quotes
+func nginxQuote(s string) string {
+	return `"` + nginxEscape(s) + `"`
+}
+
+// templateTrimSuffix drops suffix from the end of s - the suffix comes first so
+// it can be piped
+// {{ .PathPrefix | trimSuffix "/" }}
+func templateTrimSuffix(suffix, s string) string {
+	return strings.TrimSuffix(s, suffix)
+}
+
+// templateFail stops the template with an error - for a template that cannot
+// do something a site asks for
+// {{ if .AuthFile }}{{ fail "no basic auth here" }}{{ end }}
+func templateFail(msg string) (string, error) {
+	return "", fmt.Errorf("%s", msg)
+}
+
+// templateDefault gives def if value is empty - def comes first so it can be piped
+// {{ .IntPort | default 80 }}
+func templateDefault(def, value interface{}) interface{} {
+	if value == nil {
+		return def
+	}
+	if v := reflect.ValueOf(value); v.IsZero() {
+		return def
+	}
+	return value
+}
+
+// hostPort joins a host and port, bracketing IPv6 addresses
+func hostPort(host string, port interface{}) (string, error) {
+	switch p := port.(type) {
+	case int:
+		return net.JoinHostPort(host, strconv.Itoa(p)), nil
+	case string:
+		return net.JoinHostPort(host, p), nil
+	default:
+		return "", fmt.Errorf("hostPort - port of wrong type %T", port)
+	}
+}
+
+// templateNow is the current time in UTC
+func templateNow() time.Time {
+	return time.Now().UTC()
+}
+
+// templateExpiry is the time (in UTC) a duration like "744h" from now
+func templateExpiry(after string) (time.Time, error) {
+	d, err := time.ParseDuration(after)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().UTC().Add(d), nil
+}
+
+// templateDate formats a time - the layout comes first so it can be piped
+// {{ now | date "2006-01-02" }}
+func templateDate(layout string, t time.Time) string {
+	return t.Format(layout)
+}
+
+// templateJSON encodes a value as JSON
+func templateJSON(v interface{}) (string, error) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,97 @@
+package moxxiConf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	site := siteParams{
+		ExtHost:      "abcdefgh.test.com",
+		IntHost:      "Example.COM",
+		IntIP:        "2001:db8::1",
+		IntPort:      8443,
+		StripHeaders: []string{"X-Frame-Options", "Accept-Encoding"},
+		PathPrefix:   "/shop/",
+		AllowPaths:   []string{"/staging/", "/*.css"},
+	}
+
+	var testData = []struct {
+		templ string
+		out   string
+	}{
+		{`{{ .StripHeaders | join ", " }}`, "X-Frame-Options, Accept-Encoding"},
+		{`{{ .IntHost | lower }} {{ .IntHost | upper }}`, "example.com EXAMPLE.COM"},
+		{`{{ quote "say \"hi\" \\ now" }}`, `"say \"hi\" \\ now"`},
+		{`{{ escape "two\nlines" }}`, "two lines"},
+		{`{{ .RequestID | default "none" }} {{ .IntPort | default 80 }}`, "none 8443"},
+		{`{{ hostPort .IntIP .IntPort }}`, "[2001:db8::1]:8443"},
+		{`{{ hostPort "10.0.0.1" "80" }}`, "10.0.0.1:80"},
+		{`{{ regexEscape .ExtHost }}`, `abcdefgh\.test\.com`},
+		{`{{ .StripHeaders | toJSON }}`, `["X-Frame-Options","Accept-Encoding"]`},
+		{`{{ .PathPrefix | trimSuffix "/" }}`, "/shop"},
+		{`{{ .AllowPaths | pathRegex }}`, `^(?:/staging/|/.*\.css)`},
+		{`{{ date "2006" now }}`, time.Now().UTC().Format("2006")},
+		{`{{ expiry "48h" | date "2006-01-02" }}`,
+			time.Now().UTC().Add(48 * time.Hour).Format("2006-01-02")},
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "moxxi_test_")
+	assert.Nil(t, err, "could not make temp dir - %v", err)
+	defer os.RemoveAll(dir)
+
+	for id, test := range testData {
+		file := filepath.Join(dir, "test.template")
+		assert.Nil(t, ioutil.WriteFile(file, []byte(test.templ), 0644))
+
+		templ, err := parseTemplate(file)
+		if !assert.NoError(t, err, "test %d - failed to parse", id) {
+			continue
+		}
+		var out bytes.Buffer
+		assert.NoError(t, templ.Execute(&out, site), "test %d - failed to execute", id)
+		assert.Equal(t, test.out, out.String(), "test %d - wrong output", id)
+	}
+}
+
+func TestTemplateFuncs_errors(t *testing.T) {
+	_, err := templateFail("cannot do that")
+	assert.EqualError(t, err, "cannot do that", "fail should give the message")
+
+	_, err = hostPort("10.0.0.1", 80.5)
+	assert.Error(t, err, "a float port should fail")
+
+	_, err = templateExpiry("a month")
+	assert.Error(t, err, "a bad duration should fail")
+}
+
+func TestResponseTemplate_escapes(t *testing.T) {
+	templ, err := parseTemplate(filepath.Join("..", "response.template"))
+	if !assert.NoError(t, err, "should parse the built in response") {
+		return
+	}
+
+	var testData = []siteParams{
+		{RequestHeaders: []headerRule{{Action: HeaderSet, Name: "X-A", Value: "<script>alert(1)</script>"}}},
+		{ResponseHeaders: []headerRule{{Action: HeaderAdd, Name: "X-A", Value: "<script>alert(1)</script>"}}},
+		{Error: "bad header rule provided [set:<script>alert(1)</script>]"},
+		{TraceChain: []traceHop{{Method: "GET", Status: 302, URL: "http://domain.com/?q=<script>alert(1)</script>"}}},
+		{ExtHost: "abc.proxy.com", Substitutions: []substitution{{From: "<script>alert(1)</script>"}}},
+		{Probe: &probeResult{CertSubject: "CN=<script>alert(1)</script>"}},
+		{Probe: &probeResult{Warning: "certificate is not valid for <script>alert(1)</script>"}},
+	}
+	for id, site := range testData {
+		var out bytes.Buffer
+		if !assert.NoError(t, templ.Execute(&out, []siteParams{site}), "test %d - failed to execute", id) {
+			continue
+		}
+		assert.NotContains(t, out.String(), "<script>", "test %d - markup should be escaped", id)
+		assert.Contains(t, out.String(), "&lt;script&gt;", "test %d - the value should still be shown", id)
+	}
+}
@@ -0,0 +1,218 @@
+package moxxiConf
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxTraceHops is the most redirects followed while tracing a backend by default
+const MaxTraceHops = 10
+
+// TraceTimeout is how long tracing a backend can take in total by default
+const TraceTimeout = 10 * time.Second
+
+// TraceUserAgent is the User-Agent sent while tracing by default
+const TraceUserAgent = "moxxi redirect tracer"
+
+// tracePolicy - how a handler traces redirects
+type tracePolicy struct {
+	timeout     time.Duration
+	maxHops     int
+	userAgent   string
+	getFallback bool
+	crossDomain bool
+	verifyTLS   bool
+}
+
+// withDefaults fills in anything the handler did not set
+func (p tracePolicy) withDefaults() tracePolicy {
+	if p.timeout <= 0 {
+		p.timeout = TraceTimeout
+	}
+	if p.maxHops <= 0 {
+		p.maxHops = MaxTraceHops
+	}
+	if p.userAgent == "" {
+		p.userAgent = TraceUserAgent
+	}
+	return p
+}
+
+// traceHop - one request made while tracing redirects
+type traceHop struct {
+	Method string
+	URL    string
+	Status int
+}
+
+// sameFamily checks if host is part of the same site as the one traced from
+// that is the host itself, anything under it, or anything under the domain
+// with a leading www. removed - example.com and www.example.com can redirect
+// to each other, but neither can send the trace off to example.org
+func sameFamily(origin, host string) bool {
+	origin = strings.TrimPrefix(strings.ToLower(origin), "www.")
+	host = strings.ToLower(host)
+	return host == origin || strings.HasSuffix(host, DomainSep+origin)
+}
+
+// traceURL is the first URL requested when tracing a backend
+func traceURL(host string, port int, encrypted bool) string {
+	switch {
+	case encrypted && port == 443:
+		return fmt.Sprintf("https://%s/", host)
+	case encrypted:
+		return fmt.Sprintf("https://%s/", net.JoinHostPort(host, strconv.Itoa(port)))
+	case port == 80:
+		return fmt.Sprintf("http://%s/", host)
+	default:
+		return fmt.Sprintf("http://%s/", net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+}
+
+// redirectTrace follows the redirects of the backend to find where the site
+// really lives. Every request to the site is sent to the backend's IntIP
+// rather than wherever DNS points, with the hostname in the Host header and
+// SNI - so a site being moved is traced on its new server. Unless the policy
+// allows it, redirects that leave the domain family are not followed. If the
+// backend refuses HEAD requests, the policy can have the trace done again
+// with GET. The site that comes back has the traced IntHost, IntPort and
+// Encrypted, along with every hop in TraceChain.
+func redirectTrace(site siteParams, policy tracePolicy) (siteParams, Err) {
+	policy = policy.withDefaults()
+
+	traced, status, err := traceWith(http.MethodHead, site, policy)
+	if err == nil && policy.getFallback &&
+		(status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented) {
+		traced, _, err = traceWith(http.MethodGet, site, policy)
+	}
+	return traced, err
+}
+
+// traceWith does one trace of the site, using the given method for every hop
+// the status of the last response is returned along with the site
+func traceWith(method string, site siteParams, policy tracePolicy) (siteParams, int, Err) {
+	initURL := traceURL(site.IntHost, site.IntPort, site.Encrypted)
+
+	dialer := &net.Dialer{Timeout: policy.timeout}
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: !policy.verifyTLS,
+		},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			// hops off to other domains are looked up like normal
+			if site.IntIP != "" && sameFamily(site.IntHost, host) {
+				addr = net.JoinHostPort(site.IntIP, port)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	var chain []traceHop
+	c := &http.Client{
+		Timeout:   policy.timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			chain = append(chain, traceHop{
+				Method: method,
+				URL:    via[len(via)-1].URL.String(),
+				Status: req.Response.StatusCode,
+			})
+			if !policy.crossDomain && !sameFamily(site.IntHost, req.URL.Hostname()) {
+				return http.ErrUseLastResponse
+			}
+			if len(via) > policy.maxHops {
+				return fmt.Errorf("stopped after %d redirects", policy.maxHops)
+			}
+			return nil
+		},
+	}
+
+	req, err := http.NewRequest(method, initURL, nil)
+	if err != nil {
+		return site, 0, NewErr{Code: ErrBadHostnameTrace, value: initURL, deepErr: err}
+	}
+	req.Header.Set("User-Agent", policy.userAgent)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		site.TraceChain = chain
+		return site, 0, NewErr{
+			Code:    ErrBadHostnameTrace,
+			value:   initURL,
+			deepErr: err,
+		}
+	}
+	resp.Body.Close()
+
+	if resp.Request == nil || resp.Request.URL == nil {
+		return site, resp.StatusCode, NewErr{
+			Code:    ErrBadHostnameTrace,
+			value:   initURL,
+			deepErr: fmt.Errorf("did not get a request back from %s", initURL),
+		}
+	}
+
+	// a redirect that was not followed is already the last hop
+	final := resp.Request.URL
+	if len(chain) < 1 || chain[len(chain)-1].URL != final.String() {
+		chain = append(chain, traceHop{Method: method, URL: final.String(), Status: resp.StatusCode})
+	}
+	site.TraceChain = chain
+
+	traced, tErr := tracedSite(site, final, initURL)
+	return traced, resp.StatusCode, tErr
+}
+
+// tracedSite fills in the site from the last URL the trace reached
+// the proxy still sends everything to the IntIP, so a trace that ends off the
+// domain family - only possible when crossing domains - fails, rather than
+// send that other site's name to the backend
+func tracedSite(site siteParams, final *url.URL, initURL string) (siteParams, Err) {
+	if !sameFamily(site.IntHost, final.Hostname()) {
+		return site, NewErr{
+			Code:    ErrBadHostnameTrace,
+			value:   initURL,
+			deepErr: fmt.Errorf("redirected off the domain to %q", final.Hostname()),
+		}
+	}
+
+	site.Encrypted = final.Scheme == "https"
+
+	site.IntPort = 80
+	if site.Encrypted {
+		site.IntPort = 443
+	}
+	if final.Port() != "" {
+		port, err := strconv.Atoi(final.Port())
+		if err != nil || port < 1 || port > MaxAllowedPort {
+			return site, NewErr{
+				Code:    ErrBadHostnameTrace,
+				value:   initURL,
+				deepErr: fmt.Errorf("redirected to a bad port %q", final.Port()),
+			}
+		}
+		site.IntPort = port
+	}
+
+	// the host came from the backend, so it gets the same checks as a request
+	if site.IntHost = validHost(final.Hostname()); site.IntHost == "" {
+		return site, NewErr{
+			Code:    ErrBadHostnameTrace,
+			value:   initURL,
+			deepErr: fmt.Errorf("redirected to a bad hostname %q", final.Hostname()),
+		}
+	}
+	return site, nil
+}
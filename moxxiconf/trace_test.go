@@ -0,0 +1,282 @@
+package moxxiConf
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSameFamily(t *testing.T) {
+	var testData = []struct {
+		origin string
+		host   string
+		out    bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "www.example.com", true},
+		{"www.example.com", "example.com", true},
+		{"www.example.com", "shop.example.com", true},
+		{"Example.com", "WWW.EXAMPLE.COM", true},
+		{"app.example.com", "login.example.com", false},
+		{"example.com", "example.org", false},
+		{"example.com", "badexample.com", false},
+	}
+	for id, test := range testData {
+		assert.Equal(t, test.out, sameFamily(test.origin, test.host),
+			"test %d - wrong answer for %s to %s", id, test.origin, test.host)
+	}
+}
+
+func TestTraceURL(t *testing.T) {
+	assert.Equal(t, "http://example.com/", traceURL("example.com", 80, false))
+	assert.Equal(t, "http://example.com:8080/", traceURL("example.com", 8080, false))
+	assert.Equal(t, "https://example.com/", traceURL("example.com", 443, true))
+	assert.Equal(t, "https://example.com:80/", traceURL("example.com", 80, true))
+}
+
+func TestRedirectTrace_backendIP(t *testing.T) {
+	var port string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Host == "example.com:"+port && r.URL.Path == "/":
+			http.Redirect(w, r, "http://www.example.com:"+port+"/home", http.StatusMovedPermanently)
+		case r.Host == "www.example.com:"+port && r.URL.Path == "/home":
+			http.Redirect(w, r, "http://elsewhere.org/", http.StatusFound)
+		case strings.HasPrefix(r.Host, "loop."):
+			next, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+			http.Redirect(w, r, "/"+strconv.Itoa(next+1), http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	_, port, _ = net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	out, err := redirectTrace(siteParams{
+		IntHost: "example.com",
+		IntIP:   "127.0.0.1",
+		IntPort: portNum,
+	}, tracePolicy{})
+	assert.Nil(t, err, "trace should work - %v", err)
+	assert.Equal(t, "www.example.com", out.IntHost, "should follow the redirect in the family")
+	assert.Equal(t, portNum, out.IntPort, "wrong port")
+	assert.False(t, out.Encrypted, "should not be encrypted")
+	assert.Equal(t, []traceHop{
+		{Method: "HEAD", URL: "http://example.com:" + port + "/", Status: http.StatusMovedPermanently},
+		{Method: "HEAD", URL: "http://www.example.com:" + port + "/home", Status: http.StatusFound},
+	}, out.TraceChain, "wrong redirect chain")
+
+	_, err = redirectTrace(siteParams{
+		IntHost: "loop.example.com",
+		IntIP:   "127.0.0.1",
+		IntPort: portNum,
+	}, tracePolicy{})
+	assert.True(t, errors.Is(err, ErrBadHostnameTrace), "endless redirects should fail - %v", err)
+}
+
+func TestRedirectTrace_sni(t *testing.T) {
+	var serverName string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverName = r.TLS.ServerName
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	out, err := redirectTrace(siteParams{
+		IntHost:   "secure.example.com",
+		IntIP:     "127.0.0.1",
+		IntPort:   portNum,
+		Encrypted: true,
+	}, tracePolicy{})
+	assert.Nil(t, err, "trace should work - %v", err)
+	assert.Equal(t, "secure.example.com", serverName, "SNI should be the IntHost")
+	assert.Equal(t, "secure.example.com", out.IntHost, "host should not change")
+	assert.True(t, out.Encrypted, "should stay encrypted")
+	assert.Len(t, out.TraceChain, 1, "no redirects should be one hop")
+}
+
+func TestRedirectTrace(t *testing.T) {
+	// one backend on both a plain and a TLS port, redirecting like real sites
+	// do - to www, to https, or to both
+	var plainPort, tlsPort string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.Host)
+		switch {
+		case host == "google.example.com":
+			http.Redirect(w, r, "http://www.google.example.com:"+plainPort+"/", http.StatusMovedPermanently)
+		case host == "github.example.com" && r.TLS == nil:
+			http.Redirect(w, r, "https://github.example.com:"+tlsPort+"/", http.StatusMovedPermanently)
+		case host == "facebook.example.com":
+			http.Redirect(w, r, "https://www.facebook.example.com:"+tlsPort+"/", http.StatusMovedPermanently)
+		}
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+	_, plainPort, _ = net.SplitHostPort(plain.Listener.Addr().String())
+	_, tlsPort, _ = net.SplitHostPort(secure.Listener.Addr().String())
+	plainNum, _ := strconv.Atoi(plainPort)
+	tlsNum, _ := strconv.Atoi(tlsPort)
+
+	var testData = []struct {
+		hostIn  string
+		hostOut string
+		portOut int
+		tlsOut  bool
+	}{
+		{
+			hostIn:  "google.example.com",
+			hostOut: "www.google.example.com",
+			portOut: plainNum,
+			tlsOut:  false,
+		}, {
+			hostIn:  "github.example.com",
+			hostOut: "github.example.com",
+			portOut: tlsNum,
+			tlsOut:  true,
+		}, {
+			hostIn:  "facebook.example.com",
+			hostOut: "www.facebook.example.com",
+			portOut: tlsNum,
+			tlsOut:  true,
+		},
+	}
+
+	for id, test := range testData {
+		res, err := redirectTrace(siteParams{
+			IntHost: test.hostIn,
+			IntIP:   "127.0.0.1",
+			IntPort: plainNum,
+		}, tracePolicy{})
+		hostRes, portRes, tlsRes := res.IntHost, res.IntPort, res.Encrypted
+		assert.Nil(t, err,
+			"test %d - got an error back that I should not have\n%v", id, err)
+		assert.Equal(t, test.hostOut, hostRes,
+			"test %d - got the wrong/unexpected host back", id)
+		assert.Equal(t, test.portOut, portRes,
+			"test %d - got the wrong/unexpected port back", id)
+		assert.Equal(t, test.tlsOut, tlsRes,
+			"test %d - got the wrong/unexpected encryption back", id)
+	}
+}
+
+func TestConfCheck_redirectTracing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			http.Redirect(w, r, "/welcome", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	out, err := confCheck(siteParams{
+		IntHost:      "moving.example.com",
+		IntIP:        "127.0.0.1",
+		IntPort:      portNum,
+		StripHeaders: []string{"a"},
+	}, HandlerConfig{redirectTracing: true})
+	assert.Nil(t, err, "trace should work - %v", err)
+	assert.Equal(t, siteParams{
+		IntHost:      "moving.example.com",
+		IntIP:        "127.0.0.1",
+		IntPort:      portNum,
+		StripHeaders: []string{"a"},
+		TraceChain: []traceHop{
+			{Method: "HEAD", URL: "http://moving.example.com:" + port + "/", Status: http.StatusFound},
+			{Method: "HEAD", URL: "http://moving.example.com:" + port + "/welcome", Status: http.StatusOK},
+		},
+	}, out, "wrong site traced")
+}
+
+func TestRedirectTrace_policy(t *testing.T) {
+	var userAgent string
+	var port string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+		switch {
+		case strings.HasPrefix(r.Host, "nohead.") && r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case strings.HasPrefix(r.Host, "away.") && r.URL.Path == "/":
+			http.Redirect(w, r, "http://other.invalid:"+port+"/", http.StatusFound)
+		case strings.HasPrefix(r.Host, "leaves.") && r.URL.Path == "/":
+			http.Redirect(w, r, "http://localhost:"+port+"/", http.StatusFound)
+		case strings.HasPrefix(r.Host, "returns.") && r.URL.Path == "/":
+			http.Redirect(w, r, "http://localhost:"+port+"/back", http.StatusFound)
+		case strings.HasPrefix(r.Host, "localhost") && r.URL.Path == "/back":
+			http.Redirect(w, r, "http://www.returns.example.com:"+port+"/", http.StatusFound)
+		case strings.HasPrefix(r.Host, "hops.") && r.URL.Path != "/3":
+			next, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+			http.Redirect(w, r, "/"+strconv.Itoa(next+1), http.StatusFound)
+		}
+	}))
+	defer server.Close()
+	_, port, _ = net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	site := func(host string) siteParams {
+		return siteParams{IntHost: host, IntIP: "127.0.0.1", IntPort: portNum}
+	}
+
+	_, err := redirectTrace(site("plain.example.com"), tracePolicy{userAgent: "tester/1.0"})
+	assert.Nil(t, err, "trace should work - %v", err)
+	assert.Equal(t, "tester/1.0", userAgent, "should send the User-Agent given")
+
+	_, err = redirectTrace(site("plain.example.com"), tracePolicy{})
+	assert.Nil(t, err, "trace should work - %v", err)
+	assert.Equal(t, TraceUserAgent, userAgent, "should send the default User-Agent")
+
+	out, err := redirectTrace(site("nohead.example.com"), tracePolicy{})
+	assert.Nil(t, err, "trace should work - %v", err)
+	assert.Equal(t, []traceHop{{Method: "HEAD", URL: "http://nohead.example.com:" + port + "/",
+		Status: http.StatusMethodNotAllowed}}, out.TraceChain, "should not fall back")
+
+	out, err = redirectTrace(site("nohead.example.com"), tracePolicy{getFallback: true})
+	assert.Nil(t, err, "trace should work - %v", err)
+	assert.Equal(t, []traceHop{{Method: "GET", URL: "http://nohead.example.com:" + port + "/",
+		Status: http.StatusOK}}, out.TraceChain, "should fall back to GET")
+
+	// .invalid never resolves, so following the redirect off the domain fails
+	out, err = redirectTrace(site("away.example.com"), tracePolicy{})
+	assert.Nil(t, err, "trace should stop at the domain - %v", err)
+	assert.Equal(t, "away.example.com", out.IntHost, "should not leave the domain")
+	_, err = redirectTrace(site("away.example.com"), tracePolicy{crossDomain: true, timeout: time.Second})
+	assert.True(t, errors.Is(err, ErrBadHostnameTrace), "should have left the domain - %v", err)
+
+	// localhost is looked up like any other domain, and is not the IntIP's
+	out, err = redirectTrace(site("leaves.example.com"), tracePolicy{crossDomain: true})
+	assert.True(t, errors.Is(err, ErrBadHostnameTrace), "should not end on another domain - %v", err)
+	assert.Equal(t, "leaves.example.com", out.IntHost, "should keep the IntHost asked for")
+	assert.Len(t, out.TraceChain, 2, "should still record where it went")
+	out, err = redirectTrace(site("returns.example.com"), tracePolicy{crossDomain: true})
+	assert.Nil(t, err, "a trace back to the domain should work - %v", err)
+	assert.Equal(t, "www.returns.example.com", out.IntHost, "should take the host it came back to")
+
+	_, err = redirectTrace(site("hops.example.com"), tracePolicy{maxHops: 2})
+	assert.True(t, errors.Is(err, ErrBadHostnameTrace), "should stop after 2 hops - %v", err)
+	out, err = redirectTrace(site("hops.example.com"), tracePolicy{maxHops: 3})
+	assert.Nil(t, err, "3 hops should be enough - %v", err)
+	assert.Len(t, out.TraceChain, 4, "should record every hop")
+}
+
+func TestRedirectTrace_verifyTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	site := siteParams{IntHost: "secure.example.com", IntIP: "127.0.0.1", IntPort: portNum, Encrypted: true}
+
+	_, err := redirectTrace(site, tracePolicy{})
+	assert.Nil(t, err, "should not verify by default - %v", err)
+	_, err = redirectTrace(site, tracePolicy{verifyTLS: true})
+	assert.True(t, errors.Is(err, ErrBadHostnameTrace), "the test certificate should not verify - %v", err)
+}
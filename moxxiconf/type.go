@@ -1,7 +1,10 @@
 package moxxiConf
 
 import (
+	"encoding/json"
+	"fmt"
 	"net"
+	"os"
 	"regexp"
 	"strings"
 	"text/template"
@@ -20,9 +23,27 @@ const DefaultBackendTLS = false
 // ConnTimeout is the tiemout to use on the server
 const ConnTimeout = 10 * time.Second
 
+// DefaultShutdownTimeout is how long in-flight requests get to finish on shutdown
+const DefaultShutdownTimeout = 30 * time.Second
+
+// DefaultJobRetention is how long finished batch jobs are kept around
+const DefaultJobRetention = time.Hour
+
+// MaxBatchSites is the most sites a single JSON request can hold
+const MaxBatchSites = 1000
+
+// MaxLiveJobs is how many batch jobs a handler works on at once
+const MaxLiveJobs = 16
+
 // MaxAllowedPort is the maximum allowed destination port
 const MaxAllowedPort = 65535
 
+// ConfFileMode is the permissions given to the config files written out
+const ConfFileMode os.FileMode = 0644
+
+// MaxConfWriteAttempts is how many subdomains are tried before giving up
+const MaxConfWriteAttempts = 100
+
 var SubdomainChars = []byte("abcdeefghijklmnopqrstuvwxyz")
 
 type siteParams struct {
@@ -32,13 +53,111 @@ type siteParams struct {
 	IntPort      int
 	Encrypted    bool
 	StripHeaders []string
-	Error        string
+	// headers to add, set or remove on the way to and from the backend, and
+	// whether cookies for the IntHost get moved to the ExtHost
+	RequestHeaders      []headerRule `json:",omitempty"`
+	ResponseHeaders     []headerRule `json:",omitempty"`
+	RewriteCookieDomain bool         `json:",omitempty"`
+	// what else to replace in responses besides the IntHost, and in which types
+	Substitutions   []substitution `json:",omitempty"`
+	SubstituteTypes []string       `json:",omitempty"`
+	// the path on the backend the proxy's / goes to, and the paths it allows
+	// or blocks - a blocked path is blocked even if it is also allowed
+	PathPrefix string   `json:",omitempty"`
+	AllowPaths []string `json:",omitempty"`
+	BlockPaths []string `json:",omitempty"`
+	// access protection - generated basic auth credentials and the client
+	// networks allowed in - the password is only ever handed back once
+	BasicAuth    bool     `json:",omitempty"`
+	AllowFrom    []string `json:",omitempty"`
+	AuthUser     string   `json:",omitempty"`
+	AuthPassword string   `json:",omitempty"`
+	// the htpasswd file, and the hash in it
+	AuthFile string `json:"-"`
+	AuthHash string `json:"-"`
+	// the backend's TLS - the SNI name, verifying its certificate against a
+	// CA bundle, and showing it a client certificate - by name
+	UpstreamSNI    string `json:",omitempty"`
+	UpstreamVerify bool   `json:",omitempty"`
+	UpstreamCA     string `json:",omitempty"`
+	ClientCert     string `json:",omitempty"`
+	// the files for the CA bundle and client certificate
+	UpstreamCAFile string       `json:"-"`
+	ClientCertFile string       `json:"-"`
+	ClientKeyFile  string       `json:"-"`
+	RequestID      string       `json:",omitempty"`
+	TraceChain     []traceHop   `json:",omitempty"`
+	Probe          *probeResult `json:",omitempty"`
+	TLSDecision    string       `json:",omitempty"`
+	CertFile       string       `json:"-"`
+	KeyFile        string       `json:"-"`
+	Error          string
+	ErrorID        string `json:",omitempty"`
+	// something that went wrong without stopping the proxy being created
+	Warning   string `json:",omitempty"`
+	WarningID string `json:",omitempty"`
+	// detectTLS - Encrypted was asked to be worked out from the backend
+	detectTLS bool
+}
+
+// TLSAuto is given instead of true or false to have moxxi work out if the
+// backend speaks HTTPS
+const TLSAuto = "auto"
+
+// UnmarshalJSON - reads a site, where Encrypted can be true, false, or "auto"
+func (s *siteParams) UnmarshalJSON(data []byte) error {
+	type plainSite siteParams
+	var raw struct {
+		plainSite
+		Encrypted json.RawMessage
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*s = siteParams(raw.plainSite)
+
+	switch {
+	case len(raw.Encrypted) < 1 || string(raw.Encrypted) == "null":
+	case string(raw.Encrypted) == `"`+TLSAuto+`"`:
+		s.detectTLS = true
+	default:
+		if err := json.Unmarshal(raw.Encrypted, &s.Encrypted); err != nil {
+			return fmt.Errorf("Encrypted must be true, false, or %q - %v", TLSAuto, err)
+		}
+	}
+	return nil
 }
 
 var isNotAlphaNum *regexp.Regexp
 
+// isToken matches an RFC 7230 token, which is what a header name must be
+var isToken *regexp.Regexp
+
 func init() {
 	isNotAlphaNum = regexp.MustCompile("[^a-zA-Z0-9]")
+	isToken = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+}
+
+// ServerConfig - everything needed to start up moxxi
+type ServerConfig struct {
+	Listens   []ListenConfig
+	AccessLog string
+	ErrorLog  string
+	LogFormat string
+	LogLevel  string
+	Handlers  []HandlerConfig
+}
+
+// ListenConfig - the settings for one server moxxi listens on
+type ListenConfig struct {
+	Addr            string
+	CertFile        string
+	KeyFile         string
+	SocketMode      os.FileMode
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
 }
 
 type HandlerConfig struct {
@@ -48,6 +167,8 @@ type HandlerConfig struct {
 	confPath        string
 	confExt         string
 	redirectTracing bool
+	async           bool
+	jobRetention    time.Duration
 	exclude         []string
 	confFile        string
 	confTempl       *template.Template
@@ -56,6 +177,54 @@ type HandlerConfig struct {
 	ipFile          string
 	ipList          []*net.IPNet
 	subdomainLen    int
+	minFreeSpace    uint64
+	nginxTest       []string
+	auditLog        string
+	audit           *auditLog
+	auditToken      string
+	identityHeader  string
+	messageDir      string
+	messages        messages
+	outputs         []confOutput
+	noBasicAuth     string
+	trace           tracePolicy
+	probe           probePolicy
+	certs           *certManager
+	upstream        upstreamTLS
+	substitute      substituteDefaults
+}
+
+// confOutput - one of the config files written for every proxy
+type confOutput struct {
+	name      string
+	confPath  string
+	confExt   string
+	confFile  string
+	confTempl *template.Template
+}
+
+// fileName is where this output goes for the given ExtHost
+func (o confOutput) fileName(extHost string) string {
+	return strings.Join([]string{
+		strings.TrimRight(o.confPath, PathSep),
+		PathSep,
+		extHost,
+		DomainSep,
+		strings.TrimLeft(o.confExt, DomainSep)}, "")
+}
+
+// confOutputs - every config file to write for each proxy
+// a handler without a list of outputs writes its confFile into its confPath
+func (h HandlerConfig) confOutputs() []confOutput {
+	if len(h.outputs) > 0 {
+		return h.outputs
+	}
+	return []confOutput{{
+		confPath:  h.confPath,
+		confExt:   h.confExt,
+		confFile:  h.confFile,
+		confTempl: h.confTempl,
+	}}
 }
 
 // everything below this line can likely go?
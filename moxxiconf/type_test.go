@@ -1,6 +1,7 @@
 package moxxiConf
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -66,3 +67,31 @@ func TestIsNotAlphaNum(t *testing.T) {
 	}
 
 }
+
+func TestSiteParams_UnmarshalJSON(t *testing.T) {
+	var testData = []struct {
+		in        string
+		encrypted bool
+		detectTLS bool
+		fails     bool
+	}{
+		{in: `{"IntHost": "domain.com", "Encrypted": true}`, encrypted: true},
+		{in: `{"IntHost": "domain.com", "Encrypted": false}`},
+		{in: `{"IntHost": "domain.com"}`},
+		{in: `{"IntHost": "domain.com", "Encrypted": null}`},
+		{in: `{"IntHost": "domain.com", "Encrypted": "auto"}`, detectTLS: true},
+		{in: `{"IntHost": "domain.com", "Encrypted": "yes"}`, fails: true},
+	}
+	for id, test := range testData {
+		var out siteParams
+		err := json.Unmarshal([]byte(test.in), &out)
+		if test.fails {
+			assert.Error(t, err, "test %d - should have failed", id)
+			continue
+		}
+		assert.NoError(t, err, "test %d - should have decoded", id)
+		assert.Equal(t, "domain.com", out.IntHost, "test %d - lost the other fields", id)
+		assert.Equal(t, test.encrypted, out.Encrypted, "test %d - wrong Encrypted", id)
+		assert.Equal(t, test.detectTLS, out.detectTLS, "test %d - wrong detectTLS", id)
+	}
+}
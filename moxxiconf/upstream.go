@@ -0,0 +1,75 @@
+package moxxiConf
+
+import "fmt"
+
+// DefaultCABundle is the CA bundle used when a site verifies its backend
+// without naming one
+const DefaultCABundle = "default"
+
+// clientCert - a client certificate and key that proxies can show backends
+type clientCert struct {
+	certFile string
+	keyFile  string
+}
+
+// upstreamTLS - the CA bundles and client certificates a handler offers to
+// the proxies it creates, by name - requests only ever name them, so no
+// path on the server comes from a request
+type upstreamTLS struct {
+	caBundles   map[string]string
+	clientCerts map[string]clientCert
+}
+
+// tlsServerName is the name to send as SNI to the backend
+func (s siteParams) tlsServerName() string {
+	if s.UpstreamSNI != "" {
+		return s.UpstreamSNI
+	}
+	return s.IntHost
+}
+
+// checkUpstreamTLS validates the upstream TLS options asked for in proxy,
+// filling them into conf along with the files they refer to
+func checkUpstreamTLS(proxy siteParams, conf *siteParams, upstream upstreamTLS) Err {
+	if proxy.UpstreamSNI != "" {
+		if conf.UpstreamSNI = validHost(proxy.UpstreamSNI); conf.UpstreamSNI == "" {
+			return &NewErr{
+				Code:    ErrBadUpstreamTLS,
+				value:   proxy.UpstreamSNI,
+				deepErr: fmt.Errorf("not a valid SNI name"),
+			}
+		}
+	}
+
+	conf.UpstreamCA = proxy.UpstreamCA
+	if conf.UpstreamCA == "" && proxy.UpstreamVerify {
+		conf.UpstreamCA = DefaultCABundle
+	}
+	if conf.UpstreamCA != "" {
+		file, ok := upstream.caBundles[conf.UpstreamCA]
+		if !ok {
+			return &NewErr{
+				Code:    ErrBadUpstreamTLS,
+				value:   conf.UpstreamCA,
+				deepErr: fmt.Errorf("no such CA bundle"),
+			}
+		}
+		conf.UpstreamCAFile = file
+		// a CA bundle is only any use for verifying
+		conf.UpstreamVerify = true
+	}
+
+	if proxy.ClientCert != "" {
+		cert, ok := upstream.clientCerts[proxy.ClientCert]
+		if !ok {
+			return &NewErr{
+				Code:    ErrBadUpstreamTLS,
+				value:   proxy.ClientCert,
+				deepErr: fmt.Errorf("no such client certificate"),
+			}
+		}
+		conf.ClientCert = proxy.ClientCert
+		conf.ClientCertFile, conf.ClientKeyFile = cert.certFile, cert.keyFile
+	}
+	return nil
+}
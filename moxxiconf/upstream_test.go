@@ -0,0 +1,144 @@
+package moxxiConf
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckUpstreamTLS(t *testing.T) {
+	upstream := upstreamTLS{
+		caBundles: map[string]string{
+			"default":  "/etc/ssl/certs/ca-certificates.crt",
+			"internal": "/etc/moxxi/internal-ca.pem",
+		},
+		clientCerts: map[string]clientCert{
+			"partner": {certFile: "/etc/moxxi/partner.crt", keyFile: "/etc/moxxi/partner.key"},
+		},
+	}
+
+	var testData = []struct {
+		in      siteParams
+		out     siteParams
+		errCode ErrCode
+	}{
+		{},
+		{
+			in:  siteParams{UpstreamSNI: "backend.example.com"},
+			out: siteParams{UpstreamSNI: "backend.example.com"},
+		}, {
+			in:      siteParams{UpstreamSNI: "not a host"},
+			errCode: ErrBadUpstreamTLS,
+		}, {
+			in: siteParams{UpstreamVerify: true},
+			out: siteParams{UpstreamVerify: true, UpstreamCA: "default",
+				UpstreamCAFile: "/etc/ssl/certs/ca-certificates.crt"},
+		}, {
+			in: siteParams{UpstreamCA: "internal"},
+			out: siteParams{UpstreamVerify: true, UpstreamCA: "internal",
+				UpstreamCAFile: "/etc/moxxi/internal-ca.pem"},
+		}, {
+			in:      siteParams{UpstreamCA: "/etc/passwd"},
+			errCode: ErrBadUpstreamTLS,
+		}, {
+			in: siteParams{ClientCert: "partner"},
+			out: siteParams{ClientCert: "partner", ClientCertFile: "/etc/moxxi/partner.crt",
+				ClientKeyFile: "/etc/moxxi/partner.key"},
+		}, {
+			in:      siteParams{ClientCert: "someone"},
+			errCode: ErrBadUpstreamTLS,
+		},
+	}
+
+	for id, test := range testData {
+		var out siteParams
+		locErr := checkUpstreamTLS(test.in, &out, upstream)
+		if test.errCode != 0 {
+			assert.ErrorIs(t, locErr, test.errCode, "test %d - wrong error", id)
+			continue
+		}
+		assert.Nil(t, locErr, "test %d - unexpected error - %v", id, locErr)
+		assert.Equal(t, test.out, out, "test %d - wrong settings", id)
+	}
+
+	// with no bundles at all, verifying has nothing to check against
+	var out siteParams
+	locErr := checkUpstreamTLS(siteParams{UpstreamVerify: true}, &out, upstreamTLS{})
+	assert.ErrorIs(t, locErr, ErrBadUpstreamTLS, "should need a CA bundle to verify")
+}
+
+func TestProbeBackend_upstreamTLS(t *testing.T) {
+	var serverName string
+	secure := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverName = r.TLS.ServerName
+	}))
+	secure.StartTLS()
+	defer secure.Close()
+	ip, port := backend(t, secure)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.Nil(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: secure.Certificate().Raw}), 0644))
+
+	// the test certificate is for example.com, not the IntHost
+	site := siteParams{IntHost: "backend.test.com", IntIP: ip, IntPort: port, Encrypted: true,
+		UpstreamSNI: "example.com", UpstreamCAFile: caFile}
+	_, err := probeBackend(site, probePolicy{})
+	assert.NoError(t, err, "should verify with the SNI name and CA bundle")
+	assert.Equal(t, "example.com", serverName, "should send the SNI name")
+
+	site.UpstreamSNI = ""
+	_, err = probeBackend(site, probePolicy{})
+	assert.Error(t, err, "should not verify for the IntHost")
+}
+
+func TestDecodeUpstream(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"ca.pem", "client.crt", "client.key"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+
+	c := map[string]interface{}{
+		"baseURL":   "proxy.com",
+		"listen":    []interface{}{"localhost:8080"},
+		"caBundles": map[string]interface{}{"internal": filepath.Join(dir, "ca.pem")},
+		"handler": []interface{}{map[string]interface{}{
+			"handlerType":  "form",
+			"handlerRoute": "/submit/",
+			"clientCerts": map[string]interface{}{"partner": map[string]interface{}{
+				"certFile": filepath.Join(dir, "client.crt"),
+				"keyFile":  filepath.Join(dir, "client.key"),
+			}},
+		}},
+	}
+	assert.Nil(t, validateConfig(&c), "upstream settings should be valid")
+	h := c["handler"].([]interface{})[0].(map[string]interface{})
+	out, locErr := decodeUpstream(h)
+	assert.Nil(t, locErr, "upstream settings should load - %v", locErr)
+	assert.Equal(t, upstreamTLS{
+		caBundles: map[string]string{"internal": filepath.Join(dir, "ca.pem")},
+		clientCerts: map[string]clientCert{"partner": {
+			certFile: filepath.Join(dir, "client.crt"),
+			keyFile:  filepath.Join(dir, "client.key"),
+		}},
+	}, out, "wrong upstream settings")
+
+	h["caBundles"] = map[string]interface{}{"missing": filepath.Join(dir, "missing.pem")}
+	_, locErr = decodeUpstream(h)
+	assert.ErrorIs(t, locErr, ErrConfigBadValue, "a missing CA bundle should fail")
+
+	var badData = []map[string]interface{}{
+		{"caBundles": "/etc/ssl/ca.pem"},
+		{"caBundles": map[string]interface{}{"internal": 5}},
+		{"clientCerts": map[string]interface{}{"partner": "/etc/moxxi/partner.pem"}},
+		{"clientCerts": map[string]interface{}{"partner": map[string]interface{}{"certFile": "/a"}}},
+	}
+	for id, bad := range badData {
+		assert.Error(t, validateConfigUpstream(bad), "test %d - should be invalid", id)
+	}
+}
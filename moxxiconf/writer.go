@@ -2,11 +2,12 @@ package moxxiConf
 
 import (
 	"bufio"
-	"crypto/tls"
+	"bytes"
+	"errors"
 	"fmt"
 	"net"
-	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -41,9 +42,29 @@ func validHost(s string) string {
 			i++
 		}
 	}
+	if isNotAlphaNum.MatchString(parts[len(parts)-1]) {
+		return ""
+	}
 	return strings.Join(parts, DomainSep)
 }
 
+// validHeader checks a header name is an RFC 7230 token, so it can safely be
+// written into a config file
+func validHeader(s string) bool {
+	return isToken.MatchString(s)
+}
+
+// validValue checks a value has nothing that could end the directive it gets
+// written into
+func validValue(s string) bool {
+	for _, c := range s {
+		if c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
 func confCheck(proxy siteParams, config HandlerConfig) (siteParams, Err) {
 	var conf siteParams
 	if conf.IntHost = validHost(proxy.IntHost); conf.IntHost == "" {
@@ -65,19 +86,82 @@ func confCheck(proxy siteParams, config HandlerConfig) (siteParams, Err) {
 
 	conf.IntIP = tempIP.String()
 	conf.Encrypted = proxy.Encrypted
-	conf.StripHeaders = proxy.StripHeaders
+	if tlsErr := checkUpstreamTLS(proxy, &conf, config.upstream); tlsErr != nil {
+		return siteParams{}, tlsErr
+	}
+	if proxy.detectTLS {
+		conf.IntPort = 0
+		if proxy.IntPort > 0 && proxy.IntPort < MaxAllowedPort {
+			conf.IntPort = proxy.IntPort
+		}
+		detected, err := detectBackendTLS(conf, config.probe.timeout)
+		if err != nil {
+			return siteParams{}, &NewErr{Code: ErrTLSDetect, value: conf.IntIP, deepErr: err}
+		}
+		conf.IntPort = detected.IntPort
+		conf.Encrypted = detected.Encrypted
+		conf.TLSDecision = detected.TLSDecision
+	}
+	for _, header := range proxy.StripHeaders {
+		switch {
+		case header == "":
+		case !validHeader(header):
+			return siteParams{}, &NewErr{Code: ErrBadHeader, value: header}
+		default:
+			conf.StripHeaders = append(conf.StripHeaders, header)
+		}
+	}
+	if ruleErr := checkHeaderRules(proxy, &conf); ruleErr != nil {
+		return siteParams{}, ruleErr
+	}
+	if subErr := checkSubstitutions(proxy, &conf, config.substitute); subErr != nil {
+		return siteParams{}, subErr
+	}
+	if pathErr := checkPaths(proxy, &conf); pathErr != nil {
+		return siteParams{}, pathErr
+	}
+	if accessErr := checkAccess(proxy, &conf); accessErr != nil {
+		return siteParams{}, accessErr
+	}
+	if conf.BasicAuth && config.noBasicAuth != "" {
+		return siteParams{}, &NewErr{
+			Code:    ErrBadAccess,
+			value:   "BasicAuth",
+			deepErr: fmt.Errorf("the %s config cannot check passwords", config.noBasicAuth),
+		}
+	}
 
-	var newIntHost string
-	var newIntPort int
-	var newEncrypted bool
 	var err Err
 
 	if config.redirectTracing {
-		newIntHost, newIntPort, newEncrypted, err = redirectTrace(conf.IntHost, conf.IntPort, conf.Encrypted)
+		start := time.Now()
+		var traced siteParams
+		traced, err = redirectTrace(conf, config.trace)
+		conf.TraceChain = traced.TraceChain
 		if err == nil {
-			conf.IntHost = newIntHost
-			conf.IntPort = newIntPort
-			conf.Encrypted = newEncrypted
+			metricTraceDuration.observe(time.Since(start).Seconds(), "success")
+			conf.IntHost = traced.IntHost
+			conf.IntPort = traced.IntPort
+			conf.Encrypted = traced.Encrypted
+		} else {
+			metricTraceDuration.observe(time.Since(start).Seconds(), "failure")
+		}
+	}
+	conf.Substitutions = expandSubstitutions(conf.Substitutions, conf.IntHost)
+
+	// the probe checks wherever the proxy is going to end up pointing
+	if err == nil && config.probe.mode != "" && config.probe.mode != ProbeOff {
+		result, probeErr := probeBackend(conf, config.probe)
+		conf.Probe = &result
+		if probeErr != nil && config.probe.mode == ProbeReject {
+			return conf, NewErr{
+				Code:    ErrBackendProbe,
+				value:   net.JoinHostPort(conf.IntIP, strconv.Itoa(conf.IntPort)),
+				deepErr: probeErr,
+			}
+		}
+		if probeErr != nil {
+			conf.Probe.Warning = probeErr.Error()
 		}
 	}
 
@@ -85,58 +169,236 @@ func confCheck(proxy siteParams, config HandlerConfig) (siteParams, Err) {
 }
 
 func confWrite(config HandlerConfig) func(siteParams) (siteParams, Err) {
+	outputs := config.confOutputs()
 
 	return func(siteConfig siteParams) (siteParams, Err) {
 
-		err := os.ErrExist
-		var randPart, fileName string
-		var f *os.File
+		var randPart string
+		var err Err
+
+		// credentials are made once, whichever subdomain is picked
+		siteConfig.AuthUser, siteConfig.AuthPassword, siteConfig.AuthHash = "", "", ""
+		if siteConfig.BasicAuth {
+			newCredentials(&siteConfig)
+		}
 
-		for os.IsExist(err) {
+		var collided bool
+		for attempt := 0; ; attempt++ {
+			if attempt >= MaxConfWriteAttempts {
+				return siteParams{ExtHost: randPart}, &NewErr{Code: ErrNoRandom}
+			}
+			if collided {
+				metricConfWriteRetries.inc(config.handlerRoute, "exists")
+			}
 			randPart = uniuri.NewLenChars(config.subdomainLen, SubdomainChars)
 			// pick again if you got something reserved
-			if inArr(config.exclude, randPart) {
-				continue
-			}
-			if inArr(config.exclude, randPart+DomainSep+config.baseURL) {
+			if inArr(config.exclude, randPart) ||
+				inArr(config.exclude, randPart+DomainSep+config.baseURL) {
+				metricConfWriteRetries.inc(config.handlerRoute, "excluded")
+				collided = false
 				continue
 			}
-			fileName = strings.Join([]string{
-				strings.TrimRight(config.confPath, PathSep),
-				PathSep,
+
+			siteConfig.ExtHost = strings.Join([]string{
 				randPart,
 				DomainSep,
-				config.baseURL,
-				DomainSep,
-				strings.TrimLeft(config.confExt, DomainSep)}, "")
-			f, err = os.Create(fileName)
+				config.baseURL}, "")
+
+			// the certificate is reserved before anything is written, so a
+			// name that is taken is found before a certificate is issued
+			if config.certs != nil {
+				if proxyExists(siteConfig.ExtHost, outputs) {
+					collided = true
+					continue
+				}
+				if err = config.certs.reserve(siteConfig.ExtHost); errors.Is(err, os.ErrExist) {
+					collided = true
+					continue
+				} else if err != nil {
+					break
+				}
+			}
+
+			err = writeSite(config.certs, outputs, &siteConfig)
+			if !errors.Is(err, os.ErrExist) {
+				break
+			}
+			collided = true
 		}
 
-		siteConfig.ExtHost = strings.Join([]string{
-			randPart,
-			DomainSep,
-			config.baseURL}, "")
+		if err != nil {
+			return siteParams{ExtHost: randPart}, err
+		}
+		return siteConfig, nil
+	}
+}
 
-		if err == os.ErrPermission {
-			return siteParams{ExtHost: randPart}, &NewErr{Code: ErrFilePerm, value: fileName, deepErr: err}
-		} else if err != nil {
-			return siteParams{ExtHost: randPart}, &NewErr{Code: ErrFileUnexpect, value: fileName, deepErr: err}
+// writeSite writes out everything for a site under a name that looks free -
+// the htpasswd file first, so the config never points at one that is not
+// there, then the certificate once every config has rendered, then the configs
+// anything written for the site is removed again if a later step fails
+func writeSite(certs *certManager, outputs []confOutput, site *siteParams) (err Err) {
+	var authFile string
+	defer func() {
+		if err == nil {
+			return
 		}
+		if certs != nil {
+			certs.release(site.ExtHost)
+		}
+		if authFile != "" {
+			if rmErr := os.Remove(authFile); rmErr != nil {
+				err = &NewErr{Code: ErrRemoveFile, value: authFile, deepErr: rmErr}
+			}
+		}
+	}()
+
+	if site.BasicAuth {
+		site.AuthFile = authFileName(outputs, site.ExtHost)
+		htpasswd := []byte(site.AuthUser + ":" + site.AuthHash + "\n")
+		if err = writeNewFile(site.AuthFile, htpasswd); err != nil {
+			return err
+		}
+		authFile = site.AuthFile
+	}
+
+	if certs != nil {
+		site.CertFile, site.KeyFile = certs.certPaths(certs.certName(site.ExtHost))
+	}
+	var rendered [][]byte
+	if rendered, err = renderOutputs(outputs, *site); err != nil {
+		return err
+	}
 
-		tErr := config.confTempl.Execute(f, siteConfig)
+	if certs != nil {
+		if _, _, certErr := certs.certFor(site.ExtHost); certErr != nil {
+			return &NewErr{Code: ErrACME, value: site.ExtHost, deepErr: certErr}
+		}
+	}
+	return writeOutputs(outputs, *site, rendered)
+}
 
-		if err = f.Close(); err != nil {
-			return siteParams{}, &NewErr{Code: ErrCloseFile, value: fileName, deepErr: err}
+// renderOutputs renders every output for the site, before anything is written
+func renderOutputs(outputs []confOutput, site siteParams) ([][]byte, Err) {
+	rendered := make([][]byte, len(outputs))
+	for id, out := range outputs {
+		var buf bytes.Buffer
+		if err := out.confTempl.Execute(&buf, site); err != nil {
+			return nil, &NewErr{Code: ErrRenderTemplate, value: out.fileName(site.ExtHost), deepErr: err}
 		}
+		rendered[id] = buf.Bytes()
+	}
+	return rendered, nil
+}
 
-		if tErr != nil {
-			if err = os.Remove(fileName); err != nil {
-				return siteParams{}, &NewErr{Code: ErrRemoveFile, value: fileName, deepErr: err}
+// writeOutputs writes every rendered output for the site, or none of them
+// anything already written is removed again if a later output fails
+func writeOutputs(outputs []confOutput, site siteParams, rendered [][]byte) Err {
+	var written []string
+	for id, out := range outputs {
+		fileName := out.fileName(site.ExtHost)
+		if err := writeNewFile(fileName, rendered[id]); err != nil {
+			for _, each := range written {
+				if rmErr := os.Remove(each); rmErr != nil {
+					return &NewErr{Code: ErrRemoveFile, value: each, deepErr: rmErr}
+				}
 			}
+			return err
 		}
+		written = append(written, fileName)
+	}
+	return nil
+}
 
-		return siteConfig, nil
+// writeNewFile writes out a file that must not already exist
+// the contents go to a hidden temp file in the same directory first, which
+// is synced and then linked to the final name - so anything reading the
+// directory only ever sees a complete file, and linking fails if the name
+// was taken in the meantime, even by another process
+func writeNewFile(fileName string, contents []byte) Err {
+	dir, base := filepath.Split(fileName)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := os.CreateTemp(dir, "."+base+".*.tmp")
+	if errors.Is(err, os.ErrPermission) {
+		return &NewErr{Code: ErrFilePerm, value: fileName, deepErr: err}
+	} else if err != nil {
+		return &NewErr{Code: ErrFileUnexpect, value: fileName, deepErr: err}
+	}
+	tempName := f.Name()
+	defer os.Remove(tempName)
+
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Chmod(ConfFileMode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); cErr != nil && err == nil {
+		return &NewErr{Code: ErrCloseFile, value: tempName, deepErr: cErr}
+	}
+	if err != nil {
+		return &NewErr{Code: ErrFileUnexpect, value: tempName, deepErr: err}
+	}
+
+	if err = os.Link(tempName, fileName); errors.Is(err, os.ErrPermission) {
+		return &NewErr{Code: ErrFilePerm, value: fileName, deepErr: err}
+	} else if err != nil {
+		return &NewErr{Code: ErrFileUnexpect, value: fileName, deepErr: err}
+	}
+
+	syncDir(dir)
+	return nil
+}
+
+// replaceFile writes contents over fileName, so anything reading it sees
+// either the old contents or the new - never part of either
+func replaceFile(fileName string, contents []byte, mode os.FileMode) error {
+	dir, base := filepath.Split(fileName)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := os.CreateTemp(dir, "."+base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tempName := f.Name()
+	defer os.Remove(tempName)
+
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		err = f.Sync()
 	}
+	if cErr := f.Close(); cErr != nil && err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tempName, fileName); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir makes sure a new entry in the directory is on disk
+// not every platform or filesystem allows this, so failures are ignored
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
 }
 
 func parseCheckbox(in string) bool {
@@ -195,83 +457,3 @@ func ipListContains(address net.IP, list []*net.IPNet) bool {
 	}
 	return false
 }
-
-func redirectTrace(initHost string, initPort int, initTLS bool) (string, int, bool, Err) {
-
-	var initURL string
-	switch {
-	case initTLS && initPort == 443:
-		initURL = (fmt.Sprintf("https://%s/", initHost))
-	case initTLS && initPort != 443:
-		initURL = (fmt.Sprintf("https://%s:%d/", initHost, initPort))
-	case !initTLS && initPort == 80:
-		initURL = (fmt.Sprintf("http://%s/", initHost))
-	case !initTLS && initPort != 80:
-		initURL = (fmt.Sprintf("http://%s:%d/", initHost, initPort))
-	}
-
-	c := &http.Client{
-		Timeout: time.Second * 10,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
-	}
-
-	resp, err := c.Head(initURL)
-	if err != nil {
-		return "", 0, false, NewErr{
-			Code:    ErrBadHostnameTrace,
-			value:   initURL,
-			deepErr: err,
-		}
-	}
-
-	var respHost string
-	var respPort int
-	var respTLS bool
-
-	if resp.Request == nil {
-		return "", 0, false, NewErr{
-			Code:    ErrBadHostnameTrace,
-			value:   initURL,
-			deepErr: fmt.Errorf("did not get a request back from %s", initURL),
-		}
-	}
-
-	var hostname string
-	if resp.Request.Host != "" {
-		hostname = resp.Request.Host
-	} else if resp.Request.URL != nil {
-		hostname = resp.Request.URL.Host
-	} else {
-		return "", 0, false, NewErr{
-			Code:    ErrBadHostnameTrace,
-			value:   initURL,
-			deepErr: fmt.Errorf("cound not find the URL"),
-		}
-	}
-
-	if strings.Contains(hostname, ":") {
-		parts := strings.Split(hostname, ":")
-		respPort, err = strconv.Atoi(parts[len(parts)-1])
-		if err != nil {
-			respHost = resp.Request.Host
-		} else {
-			respHost = strings.Join(parts[:len(parts)-1], ":")
-		}
-	} else {
-		respHost = hostname
-		if resp.TLS == nil {
-			respPort = 80
-		} else {
-			respPort = 443
-		}
-	}
-	if resp.TLS != nil {
-		respTLS = true
-	}
-
-	return respHost, respPort, respTLS, nil
-}
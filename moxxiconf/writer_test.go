@@ -1,16 +1,17 @@
 package moxxiConf
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"strings"
 	"testing"
 	"text/template"
 
 	"github.com/stretchr/testify/assert"
-	// "strings"
 )
 
 func TestInArr(t *testing.T) {
@@ -74,6 +75,9 @@ func TestValidHost(t *testing.T) {
 		}, {
 			"sub.do;main.com",
 			"",
+		}, {
+			"sub.domain.com;}",
+			"",
 		},
 	}
 	for id, test := range testData {
@@ -81,6 +85,25 @@ func TestValidHost(t *testing.T) {
 	}
 }
 
+func TestValidHeader(t *testing.T) {
+	var testData = []struct {
+		in  string
+		out bool
+	}{
+		{"X-Frame-Options", true},
+		{"x_custom.header~1", true},
+		{"", false},
+		{"X-Frame Options", false},
+		{"X-Frame-Options;", false},
+		{"Accept\nproxy_pass", false},
+		{"{header}", false},
+		{"\"quoted\"", false},
+	}
+	for id, test := range testData {
+		assert.Equal(t, test.out, validHeader(test.in), "test %d - wrong result for %q", id, test.in)
+	}
+}
+
 func TestConfCheck(t *testing.T) {
 	var testData = []struct {
 		siteIn  siteParams
@@ -124,24 +147,6 @@ func TestConfCheck(t *testing.T) {
 			},
 			errOut: nil,
 		},
-		{
-			siteIn: siteParams{
-				IntHost:      "github.com",
-				Encrypted:    false,
-				IntPort:      80,
-				IntIP:        "127.0.0.1",
-				StripHeaders: []string{"a", "b", "c"},
-			},
-			confIn: HandlerConfig{redirectTracing: true},
-			siteOut: siteParams{
-				IntHost:      "github.com",
-				IntPort:      443,
-				Encrypted:    true,
-				IntIP:        "127.0.0.1",
-				StripHeaders: []string{"a", "b", "c"},
-			},
-			errOut: nil,
-		},
 		{
 			siteIn: siteParams{
 				IntHost:      "com",
@@ -164,6 +169,30 @@ func TestConfCheck(t *testing.T) {
 			confIn:  HandlerConfig{},
 			siteOut: siteParams{},
 			errOut:  &NewErr{Code: ErrBadIP, value: "127.1"},
+		}, {
+			siteIn: siteParams{
+				IntHost:      "domain.com",
+				IntIP:        "127.0.0.1",
+				StripHeaders: []string{"X-Frame-Options", "", "Accept-Encoding"},
+			},
+			confIn: HandlerConfig{},
+			siteOut: siteParams{
+				IntHost:      "domain.com",
+				IntPort:      80,
+				IntIP:        "127.0.0.1",
+				StripHeaders: []string{"X-Frame-Options", "Accept-Encoding"},
+			},
+			errOut: nil,
+		}, {
+			siteIn: siteParams{
+				IntHost:      "domain.com",
+				IntIP:        "127.0.0.1",
+				StripHeaders: []string{"X-Frame-Options", "a \"\"; }\nserver { listen 80; #"},
+			},
+			confIn:  HandlerConfig{},
+			siteOut: siteParams{},
+			errOut: &NewErr{Code: ErrBadHeader,
+				value: "a \"\"; }\nserver { listen 80; #"},
 		},
 	}
 
@@ -219,9 +248,13 @@ func TestConfWrite(t *testing.T) {
 
 	templateString := `{{.IntHost}} {{.IntIP}} {{.IntPort}} {{.Encrypted}} {{ range .StripHeaders }}{{.}} {{end}}`
 
+	dir, tmpErr := ioutil.TempDir(os.TempDir(), "moxxi_test_")
+	assert.Nil(t, tmpErr, "could not make temp dir - %v", tmpErr)
+	defer os.RemoveAll(dir)
+
 	testConfig := HandlerConfig{
 		baseURL:      "proxy.com",
-		confPath:     os.TempDir(),
+		confPath:     dir,
 		confExt:      ".out",
 		exclude:      []string{"a.domain.com", "b.domain.com", "c.domain.com"},
 		confTempl:    template.Must(template.New("testing").Parse(templateString)),
@@ -280,9 +313,10 @@ func TestConfWrite_badLocation(t *testing.T) {
 	badFile += DomainSep
 	badFile += testConfig.baseURL
 	badFile += testConfig.confExt
-	test.err = fmt.Errorf("unknown error with file [%s] - open %s: no such file or directory", badFile, badFile)
-
-	assert.Equal(t, test.err.Error(), err.Error(), "errors did not match up")
+	assert.True(t, errors.Is(err, ErrFileUnexpect), "got the wrong error - %v", err)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "lost the underlying error - %v", err)
+	assert.True(t, strings.HasPrefix(err.Error(), fmt.Sprintf("unknown error with file [%s] - ", badFile)),
+		"error did not name the file - %v", err)
 }
 
 func TestParseCheckbox(t *testing.T) {
@@ -404,51 +438,122 @@ func TestParseIPList_BadFile(t *testing.T) {
 	assert.Equal(t, ErrConfigBadIPFile, locErr.GetCode(), "got the wrong error type back")
 }
 
-func TestRedirectTrace(t *testing.T) {
-	if testing.Short() {
-		t.Skipf("skipping RedirectTracing tests in case of no internet")
+func TestConfWrite_permission(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
 	}
-	var testData = []struct {
-		hostIn  string
-		portIn  int
-		tlsIn   bool
-		hostOut string
-		portOut int
-		tlsOut  bool
-	}{
-		{
-			hostIn:  "google.com",
-			portIn:  80,
-			tlsIn:   false,
-			hostOut: "www.google.com",
-			portOut: 80,
-			tlsOut:  false,
-		}, {
-			hostIn:  "github.com",
-			portIn:  80,
-			tlsIn:   false,
-			hostOut: "github.com",
-			portOut: 443,
-			tlsOut:  true,
-		}, {
-			hostIn:  "facebook.com",
-			portIn:  80,
-			tlsIn:   false,
-			hostOut: "www.facebook.com",
-			portOut: 443,
-			tlsOut:  true,
+
+	dir, err := ioutil.TempDir(os.TempDir(), "moxxi_test_")
+	assert.Nil(t, err, "could not make temp dir - %v", err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.Chmod(dir, 0500), "could not make temp dir read only")
+
+	testConfig := HandlerConfig{
+		baseURL:      "proxy.com",
+		confPath:     dir,
+		confExt:      ".out",
+		confTempl:    template.Must(template.New("testing").Parse("{{ .IntHost }}")),
+		subdomainLen: 8,
+	}
+
+	_, locErr := confWrite(testConfig)(siteParams{IntHost: "domain.com"})
+	if assert.NotNil(t, locErr, "should not be able to write the file") {
+		assert.True(t, errors.Is(locErr, ErrFilePerm), "got the wrong error - %v", locErr)
+		assert.True(t, errors.Is(locErr, os.ErrPermission), "lost the underlying error")
+	}
+}
+
+func TestConfWrite_outputs(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "moxxi_test_")
+	assert.Nil(t, err, "could not make temp dir - %v", err)
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"nginx", "haproxy"} {
+		assert.Nil(t, os.Mkdir(dir+PathSep+sub, 0755), "could not make %s dir", sub)
+	}
+
+	testConfig := HandlerConfig{
+		baseURL:      "proxy.com",
+		subdomainLen: 8,
+		outputs: []confOutput{
+			{
+				name:      "nginx",
+				confPath:  dir + PathSep + "nginx",
+				confExt:   "conf",
+				confTempl: template.Must(template.New("nginx").Parse("nginx {{ .IntHost }}")),
+			}, {
+				name:      "haproxy",
+				confPath:  dir + PathSep + "haproxy",
+				confExt:   ".cfg",
+				confTempl: template.Must(template.New("haproxy").Parse("haproxy {{ .IntHost }}")),
+			},
 		},
 	}
 
-	for id, test := range testData {
-		hostRes, portRes, tlsRes, err := redirectTrace(test.hostIn, test.portIn, test.tlsIn)
-		assert.Nil(t, err,
-			"test %d - got an error back that I should not have\n%v", id, err)
-		assert.Equal(t, test.hostOut, hostRes,
-			"test %d - got the wrong/unexpected host back", id)
-		assert.Equal(t, test.portOut, portRes,
-			"test %d - got the wrong/unexpected port back", id)
-		assert.Equal(t, test.tlsOut, tlsRes,
-			"test %d - got the wrong/unexpected encryption back", id)
+	out, locErr := confWrite(testConfig)(siteParams{IntHost: "domain.com"})
+	assert.Nil(t, locErr, "failed to write the outputs - %v", locErr)
+	for _, each := range testConfig.outputs {
+		contents, err := ioutil.ReadFile(each.fileName(out.ExtHost))
+		assert.Nil(t, err, "output %s was not written - %v", each.name, err)
+		assert.Equal(t, each.name+" domain.com", string(contents), "output %s did not match", each.name)
+	}
+
+	// all or nothing - a failure in the second output takes out the first
+	testConfig.outputs[1].confPath = dir + PathSep + "missing"
+	out, locErr = confWrite(testConfig)(siteParams{IntHost: "other.com"})
+	assert.True(t, errors.Is(locErr, ErrFileUnexpect), "got the wrong error - %v", locErr)
+	files, _ := ioutil.ReadDir(dir + PathSep + "nginx")
+	assert.Len(t, files, 1, "the first output should have been removed")
+
+	// a template that fails to render writes nothing at all
+	testConfig.outputs[1].confPath = dir + PathSep + "haproxy"
+	testConfig.outputs[1].confTempl = template.Must(template.New("bad").Parse("{{ .IntHost.Nope }}"))
+	_, locErr = confWrite(testConfig)(siteParams{IntHost: "other.com"})
+	assert.True(t, errors.Is(locErr, ErrRenderTemplate), "got the wrong error - %v", locErr)
+	files, _ = ioutil.ReadDir(dir + PathSep + "nginx")
+	assert.Len(t, files, 1, "nothing should have been written")
+}
+
+func TestConfWrite_exhausted(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "moxxi_test_")
+	assert.Nil(t, err, "could not make temp dir - %v", err)
+	defer os.RemoveAll(dir)
+
+	testConfig := HandlerConfig{
+		baseURL:      "proxy.com",
+		confPath:     dir,
+		confExt:      ".out",
+		confTempl:    template.Must(template.New("testing").Parse("{{ .IntHost }}")),
+		subdomainLen: 1,
+	}
+	for _, each := range SubdomainChars {
+		name := dir + PathSep + string(each) + ".proxy.com.out"
+		assert.Nil(t, ioutil.WriteFile(name, nil, 0644), "could not fill %s", name)
 	}
+
+	_, locErr := confWrite(testConfig)(siteParams{IntHost: "domain.com"})
+	assert.True(t, errors.Is(locErr, ErrNoRandom), "got the wrong error - %v", locErr)
+}
+
+func TestWriteNewFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "moxxi_test_")
+	assert.Nil(t, err, "could not make temp dir - %v", err)
+	defer os.RemoveAll(dir)
+
+	fileName := dir + PathSep + "abcdefgh.proxy.com.conf"
+	assert.Nil(t, writeNewFile(fileName, []byte("first")), "should write a new file")
+
+	locErr := writeNewFile(fileName, []byte("second"))
+	assert.True(t, errors.Is(locErr, os.ErrExist), "should not replace a file - %v", locErr)
+
+	contents, err := ioutil.ReadFile(fileName)
+	assert.Nil(t, err, "could not read the file - %v", err)
+	assert.Equal(t, "first", string(contents), "the first file should be left alone")
+
+	info, err := os.Stat(fileName)
+	if assert.Nil(t, err, "could not stat the file - %v", err) {
+		assert.Equal(t, ConfFileMode, info.Mode().Perm(), "wrong permissions")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1, "no temp files should be left behind")
 }